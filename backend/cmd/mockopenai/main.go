@@ -0,0 +1,52 @@
+// mockopenai 启动一个离线的 OpenAI 兼容模拟服务，用于本地开发和 CI。
+//
+//	go run ./backend/cmd/mockopenai -addr :8081
+//
+// 然后让后端指向它，例如：
+//
+//	LLM_PROVIDER=ollama OLLAMA_BASE_URL=http://localhost:8081/v1
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/soaringjerry/AnyQA/backend/mockopenai"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "监听地址")
+	apiKey := flag.String("api-key", "", "要求客户端携带的 API 密钥（为空则不校验）")
+	dims := flag.Int("dims", mockopenai.DefaultDimensions, "默认向量维度")
+	delay := flag.Duration("stream-delay", 0, "流式响应中每个增量之间的间隔，例如 50ms")
+	failFirst := flag.Int("fail-first", 0, "前 N 个请求返回错误，用于演练重试")
+	failStatus := flag.Int("fail-status", 503, "注入失败时的状态码")
+	retryAfter := flag.Duration("retry-after", 0, "注入失败时附带的 Retry-After")
+	overloaded := flag.String("overloaded-models", "", "始终返回 429 的聊天模型（逗号分隔），用于演练备用模型")
+	flag.Parse()
+
+	var overloadedModels []string
+	for _, model := range strings.Split(*overloaded, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			overloadedModels = append(overloadedModels, model)
+		}
+	}
+
+	handler := mockopenai.NewHandler(mockopenai.Options{
+		APIKey:      *apiKey,
+		Dimensions:  *dims,
+		StreamDelay: *delay,
+		FailFirst:   *failFirst,
+		FailStatus:  *failStatus,
+		RetryAfter:  *retryAfter,
+
+		OverloadedModels: overloadedModels,
+	})
+
+	fmt.Printf("模拟 OpenAI 服务已启动: http://localhost%s/v1\n", *addr)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		panic(err)
+	}
+}
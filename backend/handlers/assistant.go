@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+	"github.com/soaringjerry/AnyQA/backend/services"
+)
+
+// assistantNameMaxRunes 助手名称的最大长度
+const assistantNameMaxRunes = 100
+
+// assistantRequest 创建或修改助手的请求体
+type assistantRequest struct {
+	Name     string                     `json:"name"`
+	Prompt   string                     `json:"prompt"`
+	UseKB    bool                       `json:"useKb"`
+	Params   *models.GenerationSettings `json:"params"`
+	Position int                        `json:"position"`
+	Enabled  *bool                      `json:"enabled"` // 省略时为 true
+}
+
+// bindAssistant 解析并校验助手请求体，失败时写入 400 并返回 nil
+func bindAssistant(c *gin.Context, cfg *config.Config) *models.SessionAssistant {
+	var req assistantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return nil
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return nil
+	}
+	if len([]rune(req.Name)) > assistantNameMaxRunes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be at most %d characters", assistantNameMaxRunes)})
+		return nil
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prompt is required"})
+		return nil
+	}
+	// 使用知识库的助手按知识库提示词校验，必须引用 {{.Context}}
+	if err := services.ValidatePromptTemplate(services.AssistantPromptType(req.UseKB), req.Prompt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil
+	}
+	if req.Params == nil {
+		req.Params = &models.GenerationSettings{}
+	}
+	if err := validateGenerationSettings(cfg, req.Params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+	return &models.SessionAssistant{
+		SessionID: c.Param("sessionId"),
+		Name:      req.Name,
+		Prompt:    req.Prompt,
+		UseKB:     req.UseKB,
+		Params:    *req.Params,
+		Position:  req.Position,
+		Enabled:   enabled,
+	}
+}
+
+// parseAssistantID 解析路由中的助手 ID，失败时写入 400 并返回 false
+func parseAssistantID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("assistantId"))
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid assistant id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeAssistantError 把助手相关的错误转换为对应的状态码
+func writeAssistantError(c *gin.Context, err error) {
+	switch err {
+	case services.ErrAssistantNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case services.ErrAssistantNameTaken, services.ErrAssistantLimitReached:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ListSessionAssistants 列出会话的助手（包括已停用的）
+// GET /api/sessions/:sessionId/assistants
+func ListSessionAssistants(c *gin.Context, db *sql.DB) {
+	assistants, err := services.ListSessionAssistants(db, c.Param("sessionId"), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, assistants)
+}
+
+// CreateSessionAssistant 为会话新建助手，之后的新问题会多生成一路建议
+// POST /api/sessions/:sessionId/assistants
+// 会话的助手数不能超过 MAX_SESSION_ASSISTANTS，超出或名称重复时返回 409
+func CreateSessionAssistant(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	if requireWritableSession(c, db, c.Param("sessionId"), false) == nil {
+		return
+	}
+	assistant := bindAssistant(c, cfg)
+	if assistant == nil {
+		return
+	}
+	id, err := services.CreateSessionAssistant(db, assistant, cfg.MaxSessionAssistants)
+	if err != nil {
+		writeAssistantError(c, err)
+		return
+	}
+	created, err := services.GetSessionAssistant(db, assistant.SessionID, id)
+	if err != nil {
+		writeAssistantError(c, err)
+		return
+	}
+	services.GetAnswerCache().InvalidateSession(assistant.SessionID)
+	fmt.Printf("会话 %s 已创建助手 %d (%s)。\n", assistant.SessionID, id, assistant.Name)
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateSessionAssistant 整体替换助手的设置
+// PUT /api/sessions/:sessionId/assistants/:assistantId
+func UpdateSessionAssistant(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	id, ok := parseAssistantID(c)
+	if !ok {
+		return
+	}
+	assistant := bindAssistant(c, cfg)
+	if assistant == nil {
+		return
+	}
+	assistant.ID = id
+	if err := services.UpdateSessionAssistant(db, assistant); err != nil {
+		writeAssistantError(c, err)
+		return
+	}
+	updated, err := services.GetSessionAssistant(db, assistant.SessionID, id)
+	if err != nil {
+		writeAssistantError(c, err)
+		return
+	}
+	services.GetAnswerCache().InvalidateSession(assistant.SessionID)
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteSessionAssistant 删除助手，已为问题生成的建议保留
+// DELETE /api/sessions/:sessionId/assistants/:assistantId
+func DeleteSessionAssistant(c *gin.Context, db *sql.DB) {
+	sessionId := c.Param("sessionId")
+	id, ok := parseAssistantID(c)
+	if !ok {
+		return
+	}
+	if err := services.DeleteSessionAssistant(db, sessionId, id); err != nil {
+		writeAssistantError(c, err)
+		return
+	}
+	services.GetAnswerCache().InvalidateSession(sessionId)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "assistant deleted"})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// 演讲者凭证的请求头及 gin.Context 中的键
+const (
+	presenterTokenHeader  = "X-Presenter-Token"
+	ctxPresenterSessionID = "presenterSessionId" // 凭证所属的会话
+	ctxPresenterAdmin     = "presenterAdmin"     // 使用管理员令牌访问，可操作任意会话
+)
+
+// newPresenterToken 生成随机的演讲者令牌，返回明文和用于入库的哈希
+func newPresenterToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate presenter token: %w", err)
+	}
+	token = hex.EncodeToString(buf)
+	return token, hashPresenterToken(token), nil
+}
+
+// hashPresenterToken 数据库只保存令牌的 SHA-256，明文仅在签发时返回一次
+func hashPresenterToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// presenterTokenFromRequest 从 X-Presenter-Token 或 Authorization: Bearer 中读取令牌
+func presenterTokenFromRequest(c *gin.Context) string {
+	if token := strings.TrimSpace(c.GetHeader(presenterTokenHeader)); token != "" {
+		return token
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// RequirePresenter 校验演讲者凭证的中间件，观众路由不应使用
+// 凭证可以是会话创建时签发的令牌，也可以是配置中的管理员令牌。
+// 路由带 :sessionId 参数时直接校验归属；否则由处理函数在查出资源所属会话后
+// 调用 authorizePresenter 校验
+func RequirePresenter(db *sql.DB, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := presenterTokenFromRequest(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "presenter token is required"})
+			return
+		}
+
+		if cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+			c.Set(ctxPresenterAdmin, true)
+			c.Next()
+			return
+		}
+
+		var sessionId string
+		err := db.QueryRow(`SELECT id FROM sessions WHERE presenter_token_hash = ?`, hashPresenterToken(token)).Scan(&sessionId)
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid presenter token"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify presenter token: " + err.Error()})
+			return
+		}
+		c.Set(ctxPresenterSessionID, sessionId)
+
+		if paramSession := c.Param("sessionId"); paramSession != "" && paramSession != sessionId {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "presenter token does not belong to this session"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorizePresenter 校验当前演讲者凭证能否操作 sessionId；失败时写入 403 并返回 false
+// 仅在 RequirePresenter 之后调用
+func authorizePresenter(c *gin.Context, sessionId string) bool {
+	if c.GetBool(ctxPresenterAdmin) {
+		return true
+	}
+	if c.GetString(ctxPresenterSessionID) == sessionId && sessionId != "" {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "presenter token does not belong to this session"})
+	return false
+}
+
+// RotatePresenterToken 为会话重新签发演讲者令牌，旧令牌立即失效
+// POST /api/sessions/:sessionId/presenter-token
+func RotatePresenterToken(c *gin.Context, db *sql.DB) {
+	s, err := loadSession(db, c.Param("sessionId"))
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, hash, err := newPresenterToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := db.Exec(`UPDATE sessions SET presenter_token_hash = ? WHERE id = ?`, hash, s.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update presenter token: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "presenterToken": token})
+}
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +27,12 @@ func HandleDocumentUpload(c *gin.Context, db *sql.DB, cfg *config.Config) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "sessionId is required"})
 		return
 	}
+	if !authorizePresenter(c, sessionId) {
+		return
+	}
+	if requireWritableSession(c, db, sessionId, false) == nil {
+		return
+	}
 
 	// 2. 从表单获取上传的文件
 	file, err := c.FormFile("file")
@@ -73,18 +81,19 @@ func HandleDocumentUpload(c *gin.Context, db *sql.DB, cfg *config.Config) {
 	docId, _ := result.LastInsertId()
 	doc.ID = int(docId) // 获取插入的ID
 
-	// 异步触发文档处理
-	go func(docID int, filePath string, dbConn *sql.DB, cfgInstance *config.Config) {
+	// 异步触发文档处理（服务停机时会被取消）
+	docID, filePath := doc.ID, doc.FilePath
+	services.GetBackgroundTasks().Go(func(ctx context.Context) {
 		fmt.Printf("开始异步处理文档 ID: %d, Path: %s\n", docID, filePath)
 		// 传递配置给处理函数
-		err := services.ProcessUploadedDocument(dbConn, cfgInstance, docID, filePath)
+		err := services.ProcessUploadedDocument(ctx, db, cfg, sessionId, docID, filePath)
 		if err != nil {
 			// 记录错误，实际应用中可能需要更健壮的错误处理机制
 			fmt.Printf("异步处理文档 ID %d 失败: %v\n", docID, err)
 		} else {
 			fmt.Printf("异步处理文档 ID %d 完成\n", docID)
 		}
-	}(doc.ID, doc.FilePath, db, cfg)
+	})
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "document": doc})
 }
@@ -151,6 +160,9 @@ func DeleteDocument(c *gin.Context, db *sql.DB) {
 		}
 		return
 	}
+	if !authorizePresenter(c, sessionId) {
+		return
+	}
 
 	// 3. 从数据库删除文档记录 (关联的 chunks 会级联删除)
 	_, err = tx.Exec(`DELETE FROM documents WHERE id = ?`, docId)
@@ -178,8 +190,15 @@ func DeleteDocument(c *gin.Context, db *sql.DB) {
 		fmt.Printf("警告：文档 %s 的文件路径为空，无法删除物理文件。\n", docId)
 	}
 
-	// 6. 使向量缓存失效
-	services.GetVectorCache().InvalidateSession(sessionId)
+	// 6. 从向量缓存中移除文档块
+	if id, err := strconv.Atoi(docId); err == nil {
+		services.GetVectorCache().RemoveDocument(sessionId, id)
+	} else {
+		services.GetVectorCache().InvalidateSession(sessionId)
+	}
+	services.GetAnswerCache().InvalidateSession(sessionId)
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "document deleted successfully"})
+
+	services.GetEventHub().Publish(sessionId, services.EventDocumentDeleted, gin.H{"id": docId})
 }
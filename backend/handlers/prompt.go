@@ -1,16 +1,21 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"net/http"
-	"time" // 导入 time 包
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/soaringjerry/AnyQA/backend/config" // 确保路径正确
 	"github.com/soaringjerry/AnyQA/backend/models" // 确保路径正确
+	"github.com/soaringjerry/AnyQA/backend/services"
 )
 
-// GetSessionPrompts 获取指定会话的自定义提示词，如果不存在则返回默认值
+// GetSessionPrompts 获取指定会话实际使用的提示词：会话自定义 → 引用的预设 → 默认值
 // GET /api/prompts/:sessionId
 func GetSessionPrompts(c *gin.Context, db *sql.DB, cfg *config.Config) {
 	sessionId := c.Param("sessionId")
@@ -19,43 +24,68 @@ func GetSessionPrompts(c *gin.Context, db *sql.DB, cfg *config.Config) {
 		return
 	}
 
-	var prompt models.SessionPrompt
-	err := db.QueryRow(`SELECT session_id, generic_prompt, kb_prompt, updated_at FROM session_prompts WHERE session_id = ?`, sessionId).Scan(
-		&prompt.SessionID, &prompt.GenericPrompt, &prompt.KbPrompt, &prompt.UpdatedAt,
+	prompt := models.SessionPrompt{SessionID: sessionId}
+	err := db.QueryRow(`SELECT prompt_version, updated_at FROM session_prompts WHERE session_id = ?`, sessionId).Scan(
+		&prompt.Version, &prompt.UpdatedAt,
 	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// 没有找到自定义提示词，返回配置中的默认值
-			defaultPrompt := models.SessionPrompt{
-				SessionID:     sessionId,
-				GenericPrompt: &cfg.GenericSystemPrompt,       // 返回默认值指针
-				KbPrompt:      &cfg.KnowledgeBaseSystemPrompt, // 返回默认值指针
-				UpdatedAt:     time.Time{},                    // 表示未使用自定义
-			}
-			c.JSON(http.StatusOK, defaultPrompt)
-			return
-		}
-		// 其他数据库错误
+	// 没有记录时 UpdatedAt 为零值，表示未使用自定义
+	if err != nil && err != sql.ErrNoRows {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query session prompts: " + err.Error()})
 		return
 	}
 
-	// 如果数据库中的字段为 NULL，Scan 会将指针设为 nil，我们需要处理这种情况
-	// 如果用户从未设置过某个提示词，我们应该返回默认值
-	if prompt.GenericPrompt == nil {
-		prompt.GenericPrompt = &cfg.GenericSystemPrompt
+	resolved, err := services.ResolveSessionPrompts(db, cfg, sessionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	if prompt.KbPrompt == nil {
-		prompt.KbPrompt = &cfg.KnowledgeBaseSystemPrompt
+	// 旧版 %s 提示词以转换后的模板形式展示，保存时即完成迁移
+	kbPrompt := services.MigrateLegacyPrompt(resolved.KbPrompt)
+	prompt.GenericPrompt = &resolved.GenericPrompt
+	prompt.KbPrompt = &kbPrompt
+	prompt.GenericSource = resolved.GenericSource
+	prompt.KbSource = resolved.KbSource
+	prompt.PresetID = resolved.PresetID
+	prompt.PresetName = resolved.PresetName
+
+	genericParams, kbParams, err := services.GetSessionGenerationSettings(db, sessionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	prompt.GenericParams = &genericParams
+	prompt.KbParams = &kbParams
 
 	c.JSON(http.StatusOK, prompt)
 }
 
+// validatePrompts 校验通用与知识库提示词模板，旧版 %s 知识库提示词会先被原地转换，
+// 返回是否发生了转换。为空的提示词表示使用上一级提示词，不做校验
+func validatePrompts(genericPrompt *string, kbPrompt **string) (bool, error) {
+	migrated := false
+	if *kbPrompt != nil && services.IsLegacyPrompt(**kbPrompt) {
+		converted := services.MigrateLegacyPrompt(**kbPrompt)
+		*kbPrompt = &converted
+		migrated = true
+	}
+	for _, p := range []struct {
+		promptType string
+		text       *string
+	}{{"generic", genericPrompt}, {"kb", *kbPrompt}} {
+		if p.text == nil || strings.TrimSpace(*p.text) == "" {
+			continue
+		}
+		if err := services.ValidatePromptTemplate(p.promptType, *p.text); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
 // UpdateSessionPrompts 更新或创建指定会话的自定义提示词
 // POST /api/prompts/:sessionId
-func UpdateSessionPrompts(c *gin.Context, db *sql.DB) {
+// genericParams / kbParams 省略时保持原有生成参数不变，传入时整体替换
+func UpdateSessionPrompts(c *gin.Context, db *sql.DB, cfg *config.Config) {
 	sessionId := c.Param("sessionId")
 	if sessionId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "sessionId is required"})
@@ -70,22 +100,347 @@ func UpdateSessionPrompts(c *gin.Context, db *sql.DB) {
 	}
 	req.SessionID = sessionId // 确保 SessionID 正确
 
-	// 使用 INSERT ... ON DUPLICATE KEY UPDATE 来简化插入或更新逻辑
-	query := `
-        INSERT INTO session_prompts (session_id, generic_prompt, kb_prompt, updated_at)
-        VALUES (?, ?, ?, NOW())
-        ON DUPLICATE KEY UPDATE
-            generic_prompt = VALUES(generic_prompt),
-            kb_prompt = VALUES(kb_prompt),
-            updated_at = NOW()
-    `
-	_, err := db.Exec(query, req.SessionID, req.GenericPrompt, req.KbPrompt)
+	// 提示词使用 text/template 语法；旧版 %s 知识库提示词自动转换为 {{.Context}}
+	migrated, err := validatePrompts(req.GenericPrompt, &req.KbPrompt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, params := range []*models.GenerationSettings{req.GenericParams, req.KbParams} {
+		if err := validateGenerationSettings(cfg, params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// 每次修改都记录为新版本，便于查看历史和回滚；引用的预设保持不变，
+	// 为空的提示词继续使用预设或默认提示词
+	version, _, err := services.SavePromptVersion(db, req.SessionID, func(s *services.PromptSnapshot) {
+		s.GenericPrompt, s.KbPrompt = req.GenericPrompt, req.KbPrompt
+	}, promptAuthor(c, req.Author), models.PromptVersionSourceUpdate, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session prompts: " + err.Error()})
 		return
 	}
+	if req.GenericParams != nil {
+		p := req.GenericParams
+		_, err = db.Exec(`UPDATE session_prompts SET generic_model = ?, generic_temperature = ?, generic_max_tokens = ?, generic_top_p = ? WHERE session_id = ?`,
+			p.Model, p.Temperature, p.MaxTokens, p.TopP, sessionId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update generic generation settings: " + err.Error()})
+			return
+		}
+	}
+	if req.KbParams != nil {
+		p := req.KbParams
+		_, err = db.Exec(`UPDATE session_prompts SET kb_model = ?, kb_temperature = ?, kb_max_tokens = ?, kb_top_p = ? WHERE session_id = ?`,
+			p.Model, p.Temperature, p.MaxTokens, p.TopP, sessionId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update kb generation settings: " + err.Error()})
+			return
+		}
+	}
+	// 提示词变化后已缓存的建议不再适用
+	services.GetAnswerCache().InvalidateSession(sessionId)
+
+	// 旧版提示词被自动转换时返回转换后的内容，便于前端同步显示
+	if migrated {
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "prompts updated successfully", "version": version, "migrated": true, "kbPrompt": *req.KbPrompt})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "prompts updated successfully", "version": version})
+}
+
+// validateGenerationSettings 校验生成参数的取值范围，以及模型是否在允许列表中
+func validateGenerationSettings(cfg *config.Config, p *models.GenerationSettings) error {
+	if p == nil {
+		return nil
+	}
+	if p.Model != nil {
+		model := strings.TrimSpace(*p.Model)
+		if model == "" {
+			p.Model = nil
+		} else {
+			p.Model = &model
+			if allowed := cfg.AllowedChatModels; allowed != "" {
+				ok := false
+				for _, m := range strings.Split(allowed, ",") {
+					if strings.TrimSpace(m) == model {
+						ok = true
+						break
+					}
+				}
+				if !ok {
+					return fmt.Errorf("model %q is not allowed", model)
+				}
+			}
+		}
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return fmt.Errorf("topP must be greater than 0 and at most 1")
+	}
+	if p.MaxTokens != nil && (*p.MaxTokens < 1 || *p.MaxTokens > 128000) {
+		return fmt.Errorf("maxTokens must be between 1 and 128000")
+	}
+	return nil
+}
+
+// promptAuthorMaxRunes 版本历史中作者名称的最大长度
+const promptAuthorMaxRunes = 100
+
+// promptAuthor 版本历史中记录的作者：优先使用请求中填写的名称，否则按凭证类型记为 admin 或 presenter
+func promptAuthor(c *gin.Context, name string) string {
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > promptAuthorMaxRunes {
+		name = string(runes[:promptAuthorMaxRunes])
+	}
+	if name != "" {
+		return name
+	}
+	if c.GetBool(ctxPresenterAdmin) {
+		return "admin"
+	}
+	return "presenter"
+}
+
+// parsePromptVersion 解析路由或查询参数中的版本号，失败时写入 400 并返回 false
+func parsePromptVersion(c *gin.Context, name string, raw string) (int, bool) {
+	version, err := strconv.Atoi(raw)
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a positive integer"})
+		return 0, false
+	}
+	return version, true
+}
+
+// loadPromptVersion 读取版本并处理不存在和查询失败的情况，失败时写入响应并返回 nil
+func loadPromptVersion(c *gin.Context, db *sql.DB, sessionId string, version int) *models.PromptVersion {
+	v, err := services.GetPromptVersion(db, sessionId, version)
+	if err == services.ErrPromptVersionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("prompt version %d not found", version)})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	return v
+}
+
+// ListPromptVersions 列出会话提示词的历史版本（从新到旧）
+// GET /api/prompts/:sessionId/versions
+func ListPromptVersions(c *gin.Context, db *sql.DB) {
+	versions, err := services.ListPromptVersions(db, c.Param("sessionId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
 
-	// 返回更新后的提示词（可选，或者只返回成功状态）
-	// 为了简单起见，只返回成功状态
-	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "prompts updated successfully"})
+// GetPromptVersion 获取会话提示词的某个历史版本
+// GET /api/prompts/:sessionId/versions/:version
+func GetPromptVersion(c *gin.Context, db *sql.DB) {
+	version, ok := parsePromptVersion(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	if v := loadPromptVersion(c, db, c.Param("sessionId"), version); v != nil {
+		c.JSON(http.StatusOK, v)
+	}
+}
+
+// DiffPromptVersions 按行比较两个提示词版本
+// GET /api/prompts/:sessionId/diff?from=1&to=2
+// to 省略时与当前版本比较
+func DiffPromptVersions(c *gin.Context, db *sql.DB) {
+	sessionId := c.Param("sessionId")
+	from, ok := parsePromptVersion(c, "from", c.Query("from"))
+	if !ok {
+		return
+	}
+	var to int
+	if raw := c.Query("to"); raw != "" {
+		if to, ok = parsePromptVersion(c, "to", raw); !ok {
+			return
+		}
+	} else {
+		current, err := services.CurrentPromptVersion(db, sessionId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if current == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session has no saved prompt versions"})
+			return
+		}
+		to = current
+	}
+
+	fromVersion := loadPromptVersion(c, db, sessionId, from)
+	if fromVersion == nil {
+		return
+	}
+	toVersion := loadPromptVersion(c, db, sessionId, to)
+	if toVersion == nil {
+		return
+	}
+	text := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	genericDiff := services.DiffLines(text(fromVersion.GenericPrompt), text(toVersion.GenericPrompt))
+	kbDiff := services.DiffLines(text(fromVersion.KbPrompt), text(toVersion.KbPrompt))
+	c.JSON(http.StatusOK, gin.H{
+		"from":           from,
+		"to":             to,
+		"fromPresetId":   fromVersion.PresetID,
+		"toPresetId":     toVersion.PresetID,
+		"genericChanged": text(fromVersion.GenericPrompt) != text(toVersion.GenericPrompt),
+		"kbChanged":      text(fromVersion.KbPrompt) != text(toVersion.KbPrompt),
+		"genericPrompt":  genericDiff,
+		"kbPrompt":       kbDiff,
+	})
+}
+
+// RestorePromptVersion 回滚到某个历史版本：以该版本的内容新建一个版本并立即生效，生成参数不受影响
+// POST /api/prompts/:sessionId/versions/:version/restore
+func RestorePromptVersion(c *gin.Context, db *sql.DB) {
+	sessionId := c.Param("sessionId")
+	version, ok := parsePromptVersion(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	var req struct {
+		Author string `json:"author"`
+	}
+	// 请求体可选
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	v := loadPromptVersion(c, db, sessionId, version)
+	if v == nil {
+		return
+	}
+	// 校验前写入的旧版本可能仍是 %s 格式，回滚时一并转换
+	if v.KbPrompt != nil {
+		converted := services.MigrateLegacyPrompt(*v.KbPrompt)
+		v.KbPrompt = &converted
+	}
+	// 版本引用的预设可能已被删除，此时只恢复会话自己的提示词
+	presetMissing := false
+	if v.PresetID != nil {
+		if _, err := services.GetPromptPreset(db, *v.PresetID); err == services.ErrPromptPresetNotFound {
+			v.PresetID = nil
+			presetMissing = true
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	newVersion, _, err := services.SavePromptVersion(db, sessionId, func(s *services.PromptSnapshot) {
+		*s = services.PromptSnapshot{GenericPrompt: v.GenericPrompt, KbPrompt: v.KbPrompt, PresetID: v.PresetID}
+	}, promptAuthor(c, req.Author), models.PromptVersionSourceRestore, &version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore prompt version: " + err.Error()})
+		return
+	}
+	services.GetAnswerCache().InvalidateSession(sessionId)
+	fmt.Printf("会话 %s 的提示词已回滚到版本 %d（新版本 %d）。\n", sessionId, version, newVersion)
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "prompts restored successfully", "version": newVersion, "restoredFrom": version, "presetMissing": presetMissing})
+}
+
+// dryRunMaxTopK 试运行允许检索的最大文档块数
+const dryRunMaxTopK = 20
+
+// DryRunPrompt 用候选提示词和示例问题试运行一次生成，返回渲染后的提示词、参考资料、模型输出和用量。
+// 不保存提示词，也不写入 questions 表；模型调用照常计费并计入会话预算
+// POST /api/prompts/:sessionId/dry-run
+func DryRunPrompt(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	sessionId := c.Param("sessionId")
+	var req struct {
+		Type     string `json:"type"`     // generic 或 kb
+		Prompt   string `json:"prompt"`   // 候选提示词，为空时使用会话当前生效的提示词
+		Question string `json:"question"` // 示例问题
+		TopK     int    `json:"topK"`     // 知识库检索的文档块数，默认使用会话的检索设置
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return
+	}
+	if req.Type != "generic" && req.Type != "kb" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be generic or kb"})
+		return
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "question is required"})
+		return
+	}
+	if req.TopK < 0 || req.TopK > dryRunMaxTopK {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("topK must be between 0 and %d", dryRunMaxTopK)})
+		return
+	}
+	if strings.TrimSpace(req.Prompt) != "" {
+		if req.Type == "kb" {
+			req.Prompt = services.MigrateLegacyPrompt(req.Prompt)
+		}
+		if err := services.ValidatePromptTemplate(req.Type, req.Prompt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	aiClient, err := services.NewAIClient(cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	aiClient = aiClient.WithUsage(db, services.UsageScope{SessionID: sessionId})
+
+	// 与真实问题一样遵守会话预算
+	budget, err := services.GetSessionBudgetStatus(db, cfg, sessionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if budget.Exceeded {
+		if budget.FallbackModel == "" {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "session budget exceeded"})
+			return
+		}
+		aiClient = aiClient.WithModel(budget.FallbackModel)
+	}
+
+	// 客户端断开或超时后中止生成
+	ctx := c.Request.Context()
+	if cfg.QuestionTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.QuestionTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	result, err := services.DryRunPrompt(ctx, db, cfg, aiClient, services.PromptDryRun{
+		SessionID:  sessionId,
+		PromptType: req.Type,
+		Prompt:     req.Prompt,
+		Question:   req.Question,
+		TopK:       req.TopK,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "dry run failed: " + err.Error()})
+		return
+	}
+	fmt.Printf("会话 %s 试运行 %s 提示词完成（模型 %s，%d tokens）。\n", sessionId, req.Type, result.Model, result.Usage.TotalTokens)
+	c.JSON(http.StatusOK, result)
 }
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/soaringjerry/AnyQA/backend/models"
+	"github.com/soaringjerry/AnyQA/backend/services"
+)
+
+// promptPresetNameMaxRunes 预设名称的最大长度
+const promptPresetNameMaxRunes = 100
+
+// promptPresetRequest 创建或修改预设的请求体
+type promptPresetRequest struct {
+	Name          string  `json:"name"`
+	Description   string  `json:"description"`
+	GenericPrompt *string `json:"genericPrompt"`
+	KbPrompt      *string `json:"kbPrompt"`
+	Author        string  `json:"author"` // 创建者名称，省略时按凭证类型记录
+}
+
+// requireAdmin 预设由所有会话共享，只允许管理员令牌修改；失败时写入 403 并返回 false
+func requireAdmin(c *gin.Context) bool {
+	if c.GetBool(ctxPresenterAdmin) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "admin token is required"})
+	return false
+}
+
+// bindPromptPreset 解析并校验预设请求体，失败时写入 400 并返回 nil
+func bindPromptPreset(c *gin.Context) *models.PromptPreset {
+	var req promptPresetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return nil
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return nil
+	}
+	if len([]rune(req.Name)) > promptPresetNameMaxRunes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be at most %d characters", promptPresetNameMaxRunes)})
+		return nil
+	}
+	if _, err := validatePrompts(req.GenericPrompt, &req.KbPrompt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil
+	}
+	return &models.PromptPreset{
+		Name:          req.Name,
+		Description:   strings.TrimSpace(req.Description),
+		GenericPrompt: req.GenericPrompt,
+		KbPrompt:      req.KbPrompt,
+		CreatedBy:     promptAuthor(c, req.Author),
+	}
+}
+
+// parsePresetID 解析路由中的预设 ID，失败时写入 400 并返回 false
+func parsePresetID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid preset id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// writePresetError 把预设相关的错误转换为对应的状态码
+func writePresetError(c *gin.Context, err error) {
+	switch err {
+	case services.ErrPromptPresetNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case services.ErrPromptPresetNameTaken, services.ErrPromptPresetInUse:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// invalidatePresetSessions 预设内容变化后清理引用它的会话的回答缓存
+func invalidatePresetSessions(db *sql.DB, id int) {
+	sessionIDs, err := services.PresetSessionIDs(db, id)
+	if err != nil {
+		fmt.Printf("查询引用预设 %d 的会话失败: %v\n", id, err)
+		return
+	}
+	for _, sessionId := range sessionIDs {
+		services.GetAnswerCache().InvalidateSession(sessionId)
+	}
+}
+
+// ListPromptPresets 列出所有提示词预设
+// GET /api/prompt-presets
+func ListPromptPresets(c *gin.Context, db *sql.DB) {
+	presets, err := services.ListPromptPresets(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, presets)
+}
+
+// GetPromptPreset 获取单个提示词预设
+// GET /api/prompt-presets/:id
+func GetPromptPreset(c *gin.Context, db *sql.DB) {
+	id, ok := parsePresetID(c)
+	if !ok {
+		return
+	}
+	preset, err := services.GetPromptPreset(db, id)
+	if err != nil {
+		writePresetError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, preset)
+}
+
+// CreatePromptPreset 新建提示词预设（仅管理员令牌）
+// POST /api/prompt-presets
+func CreatePromptPreset(c *gin.Context, db *sql.DB) {
+	if !requireAdmin(c) {
+		return
+	}
+	preset := bindPromptPreset(c)
+	if preset == nil {
+		return
+	}
+	id, err := services.CreatePromptPreset(db, preset)
+	if err != nil {
+		writePresetError(c, err)
+		return
+	}
+	created, err := services.GetPromptPreset(db, id)
+	if err != nil {
+		writePresetError(c, err)
+		return
+	}
+	fmt.Printf("已创建提示词预设 %d (%s)。\n", id, preset.Name)
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdatePromptPreset 修改提示词预设（仅管理员令牌），引用它的会话立即使用新内容
+// PUT /api/prompt-presets/:id
+func UpdatePromptPreset(c *gin.Context, db *sql.DB) {
+	if !requireAdmin(c) {
+		return
+	}
+	id, ok := parsePresetID(c)
+	if !ok {
+		return
+	}
+	preset := bindPromptPreset(c)
+	if preset == nil {
+		return
+	}
+	preset.ID = id
+	if err := services.UpdatePromptPreset(db, preset, promptAuthor(c, "")); err != nil {
+		writePresetError(c, err)
+		return
+	}
+	invalidatePresetSessions(db, id)
+	updated, err := services.GetPromptPreset(db, id)
+	if err != nil {
+		writePresetError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeletePromptPreset 删除提示词预设（仅管理员令牌）
+// DELETE /api/prompt-presets/:id?force=true
+// 仍有会话引用时返回 409；force=true 时先解除引用，这些会话改用自己的提示词或默认提示词
+func DeletePromptPreset(c *gin.Context, db *sql.DB) {
+	if !requireAdmin(c) {
+		return
+	}
+	id, ok := parsePresetID(c)
+	if !ok {
+		return
+	}
+	force := c.Query("force") == "true"
+	sessionIDs, err := services.DeletePromptPreset(db, id, force, promptAuthor(c, ""))
+	if err != nil {
+		writePresetError(c, err)
+		return
+	}
+	for _, sessionId := range sessionIDs {
+		services.GetAnswerCache().InvalidateSession(sessionId)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "prompt preset deleted", "detachedSessions": len(sessionIDs)})
+}
+
+// SetSessionPromptPreset 设置或取消会话引用的提示词预设，并记录为新的提示词版本
+// PUT /api/prompts/:sessionId/preset
+// 请求体 {"presetId": 3}，presetId 为 null 时取消引用；会话自定义的提示词仍优先于预设
+func SetSessionPromptPreset(c *gin.Context, db *sql.DB) {
+	sessionId := c.Param("sessionId")
+	var req struct {
+		PresetID *int   `json:"presetId"`
+		Author   string `json:"author"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return
+	}
+	if req.PresetID != nil {
+		if _, err := services.GetPromptPreset(db, *req.PresetID); err != nil {
+			writePresetError(c, err)
+			return
+		}
+	}
+
+	version, _, err := services.SavePromptVersion(db, sessionId, func(s *services.PromptSnapshot) {
+		s.PresetID = req.PresetID
+	}, promptAuthor(c, req.Author), models.PromptVersionSourceUpdate, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session preset: " + err.Error()})
+		return
+	}
+	services.GetAnswerCache().InvalidateSession(sessionId)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "session preset updated", "presetId": req.PresetID, "version": version})
+}
@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
 	"github.com/soaringjerry/AnyQA/backend/services"
 )
 
@@ -23,10 +28,15 @@ func HandleQuestion(c *gin.Context, db *sql.DB, cfg *config.Config) { // 添加
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if requireWritableSession(c, db, question.SessionID, true) == nil {
+		return
+	}
 
 	// 首先插入问题内容到数据库，AI和知识库回答先留空
-	result, err := db.Exec(`INSERT INTO questions (session_id, content, ai_suggestion, kb_suggestion) VALUES (?, ?, ?, ?)`,
-		question.SessionID, question.Content, "", "") // 初始化 kb_suggestion 为空
+	// 同时记录此刻生效的提示词版本（未自定义过提示词时为 NULL）
+	result, err := db.Exec(`INSERT INTO questions (session_id, content, ai_suggestion, kb_suggestion, prompt_version)
+		VALUES (?, ?, ?, ?, (SELECT NULLIF(prompt_version, 0) FROM session_prompts WHERE session_id = ?))`,
+		question.SessionID, question.Content, "", "", question.SessionID) // 初始化 kb_suggestion 为空
 	if err != nil {
 		fmt.Printf("SQL执行错误: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -39,79 +49,397 @@ func HandleQuestion(c *gin.Context, db *sql.DB, cfg *config.Config) { // 添加
 	// 立即返回给用户成功响应，不阻塞用户请求
 	c.JSON(http.StatusOK, gin.H{"status": "success", "questionId": id})
 
+	services.GetEventHub().Publish(question.SessionID, services.EventQuestionCreated, gin.H{
+		"id":      id,
+		"content": question.Content,
+		"status":  "pending",
+	})
+
 	// 异步处理AI回复和知识库检索逻辑（完全并行执行）
+	// 删除问题、关闭会话或服务停机时 ctx 被取消，正在进行的请求随之中止，结果也不再写回
+	ctx, done := services.GetBackgroundTasks().StartQuestion(question.SessionID, id, time.Duration(cfg.QuestionTimeoutSeconds)*time.Second)
 	go func(questionID int64, qSessionID string, qContent string) {
-		openaiClient := services.NewOpenAIClient(cfg)
+		defer done()
+		// cancelled 判断任务是否被主动取消；超时不算取消，仍按失败写回结果
+		cancelled := func() bool { return errors.Is(ctx.Err(), context.Canceled) }
+
+		aiClient, err := services.NewAIClient(cfg)
+		if err != nil {
+			fmt.Printf("创建 AI 客户端失败 (问题ID %d): %v\n", questionID, err)
+			return
+		}
+		// 每次调用聊天模型前重新检查预算，并行生成的其他问题可能已经用完预算
+		aiClient = aiClient.WithUsage(db, services.UsageScope{SessionID: qSessionID, QuestionID: questionID}).WithBudget(cfg)
+
+		// 语义缓存：与之前的问题足够相似且提示词、文档未变时，直接复用已生成的建议。
+		// 查找缓存时算出的问题向量（或失败的错误）会留给知识库检索，每个问题只请求一次向量
+		var questionEmbedding []float32
+		var embedErr error
+		embedded := false
+		var fingerprint string
+		answerCache := services.GetAnswerCache()
+		if cfg.AnswerCacheThreshold > 0 {
+			embedded = true
+			questionEmbedding, embedErr = aiClient.EmbedQuestion(ctx, qContent)
+			if embedErr != nil {
+				fmt.Printf("获取问题向量失败，跳过回答缓存 (问题ID %d): %v\n", questionID, embedErr)
+			} else {
+				var err error
+				fingerprint, err = services.AnswerFingerprint(db, cfg, qSessionID)
+				if err != nil {
+					fmt.Printf("计算会话 %s 的缓存指纹失败，跳过回答缓存: %v\n", qSessionID, err)
+					fingerprint = ""
+				} else if hit, score := answerCache.Lookup(qSessionID, fingerprint, questionEmbedding, cfg.AnswerCacheThreshold); hit != nil {
+					fmt.Printf("问题ID %d 与问题ID %d 的相似度为 %.4f，复用已生成的建议。\n", questionID, hit.QuestionID, score)
+					saveSuggestion(db, qSessionID, questionID, "ai_suggestion", hit.AISuggestion, hit.AIModel)
+					if hit.KBNoMatch {
+						markKBNoMatch(db, qSessionID, questionID)
+					}
+					if hit.KBSuggestion != "" {
+						saveKBAnswer(db, qSessionID, questionID, &services.KBAnswer{
+							Answer:     hit.KBSuggestion,
+							Confidence: hit.KBConfidence,
+							ChunkIDs:   hit.KBChunkIDs,
+							Model:      hit.KBModel,
+						})
+					}
+					for i := range hit.Assistants {
+						answer := hit.Assistants[i]
+						saveAssistantAnswer(db, qSessionID, questionID, &answer)
+					}
+					return
+				}
+			}
+		}
+
+		if cancelled() {
+			fmt.Printf("问题ID %d 的建议生成已取消。\n", questionID)
+			return
+		}
+
+		// 预算检查：超出后改用便宜模型，未配置便宜模型则不再生成建议
+		budget, err := services.GetSessionBudgetStatus(db, cfg, qSessionID)
+		if err != nil {
+			fmt.Printf("查询会话 %s 预算失败，继续生成建议: %v\n", qSessionID, err)
+		} else if budget.Exceeded {
+			services.NotifyBudget(db, budget)
+			if budget.FallbackModel == "" {
+				fmt.Printf("会话 %s 已超出预算，问题ID %d 不再生成 AI 建议。\n", qSessionID, questionID)
+				markBudgetExceeded(db, qSessionID, questionID)
+				return
+			}
+			fmt.Printf("会话 %s 已超出预算，问题ID %d 改用模型 %s。\n", qSessionID, questionID, budget.FallbackModel)
+			aiClient = aiClient.WithModel(budget.FallbackModel)
+		}
+		// 会话自定义的助手与内置的两路建议并行生成
+		assistants, err := services.ListSessionAssistants(db, qSessionID, true)
+		if err != nil {
+			fmt.Printf("查询会话 %s 的助手失败，本次只生成内置建议: %v\n", qSessionID, err)
+			assistants = nil
+		}
+
+		hub := services.GetEventHub()
+		// 生成过程中超出预算的任务不再写回结果，问题只标记一次
+		budgetExceeded := sync.OnceFunc(func() {
+			fmt.Printf("会话 %s 在生成过程中超出预算，问题ID %d 的部分建议未生成。\n", qSessionID, questionID)
+			markBudgetExceeded(db, qSessionID, questionID)
+		})
 		var wg sync.WaitGroup
-		var aiResponse string
-		var kbSuggestion string
+		// 所有任务都成功时才写入回答缓存
+		var aiSuggestion, aiModel string
+		var kbAnswer *services.KBAnswer
+		aiOK, kbOK, kbNoMatch := false, false, false
+
+		// streamTo 返回把增量推送给演讲者的回调；未开启流式时返回 nil
+		streamTo := func(field string) services.StreamHandler {
+			if !cfg.OpenAIStream {
+				return nil
+			}
+			return func(delta string) {
+				hub.Publish(qSessionID, services.EventQuestionSuggestionDelta, gin.H{
+					"id":    questionID,
+					"field": field,
+					"delta": delta,
+				})
+			}
+		}
+		// streamToAssistant 同 streamTo，增量中带上助手 ID
+		streamToAssistant := func(assistantID int) services.StreamHandler {
+			if !cfg.OpenAIStream {
+				return nil
+			}
+			return func(delta string) {
+				hub.Publish(qSessionID, services.EventQuestionSuggestionDelta, gin.H{
+					"id":          questionID,
+					"field":       "assistant",
+					"assistantId": assistantID,
+					"delta":       delta,
+				})
+			}
+		}
+
+		// 知识库只检索一次，知识库回答和使用知识库的助手共用检索结果
+		retrieve := sync.OnceValues(func() ([]models.DocumentChunk, error) {
+			retrieval := services.SessionRetrievalSettings(db, cfg, qSessionID)
+			if embedded {
+				return services.RetrieveWithQuestionEmbedding(ctx, db, cfg, qSessionID, qContent, questionEmbedding, embedErr, retrieval)
+			}
+			return services.RetrieveRelevantChunks(ctx, db, cfg, qContent, qSessionID, questionID, retrieval)
+		})
 
 		// 并行任务1: 获取通用 AI 建议
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			var err error
-			aiResponse, err = openaiClient.GetGenericAIResponse(db, cfg, qSessionID, qContent)
+			result, err := aiClient.StreamGenericAnswer(ctx, db, cfg, qSessionID, qContent, streamTo("ai_suggestion"))
+			if cancelled() {
+				fmt.Printf("问题ID %d 的通用 AI 建议已取消。\n", questionID)
+				return
+			}
+			if errors.Is(err, services.ErrBudgetExceeded) {
+				budgetExceeded()
+				return
+			}
 			if err != nil {
 				fmt.Printf("获取通用 AI 建议错误 (问题ID %d): %v\n", questionID, err)
-				aiResponse = ""
-			} else {
-				fmt.Printf("问题ID %d 的通用 AI 建议获取成功。\n", questionID)
+				saveSuggestion(db, qSessionID, questionID, "ai_suggestion", "", "")
+				return
 			}
+			fmt.Printf("问题ID %d 的通用 AI 建议获取成功（模型 %s）。\n", questionID, result.Model)
+			aiSuggestion, aiModel, aiOK = result.Content, result.Model, true
+			saveSuggestion(db, qSessionID, questionID, "ai_suggestion", result.Content, result.Model)
 		}()
 
 		// 并行任务2: 知识库检索 + 生成回答（串联但与通用AI并行）
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			topK := 3
-			relevantChunks, err := services.RetrieveRelevantChunks(db, cfg, qContent, qSessionID, topK)
+			relevantChunks, err := retrieve()
 			if err != nil {
 				fmt.Printf("知识库检索错误 (问题ID %d): %v\n", questionID, err)
 				return
 			}
 			if len(relevantChunks) == 0 {
+				// 没有达到相似度阈值的内容，不用无关的参考资料调用模型
 				fmt.Printf("问题ID %d 未在知识库中检索到相关内容。\n", questionID)
+				kbOK, kbNoMatch = true, true
+				if !cancelled() {
+					markKBNoMatch(db, qSessionID, questionID)
+				}
 				return
 			}
 			fmt.Printf("问题ID %d 检索到 %d 个相关文档块。\n", questionID, len(relevantChunks))
 
 			// 检索完成后立即生成知识库回答（与通用AI并行）
-			generatedKbAnswer, genErr := openaiClient.GenerateAnswerWithContext(db, cfg, qSessionID, qContent, relevantChunks)
+			generated, genErr := aiClient.StreamKBAnswer(ctx, db, cfg, qSessionID, qContent, relevantChunks, streamTo("kb_suggestion"))
+			if cancelled() {
+				fmt.Printf("问题ID %d 的知识库回答已取消。\n", questionID)
+				return
+			}
+			if errors.Is(genErr, services.ErrBudgetExceeded) {
+				budgetExceeded()
+				return
+			}
 			if genErr != nil {
 				fmt.Printf("生成知识库回答错误 (问题ID %d): %v\n", questionID, genErr)
-				kbSuggestion = "【知识库参考】:\n（生成回答时出错，仅列出部分参考）\n"
+				fallback := "【知识库参考】:\n（生成回答时出错，仅列出部分参考）\n"
+				chunkIDs := make([]int, 0, len(relevantChunks))
 				for _, chunk := range relevantChunks {
-					kbSuggestion += fmt.Sprintf("- %s...\n", chunk.Content[:minLocal(100, len(chunk.Content))])
+					fallback += fmt.Sprintf("- %s...\n", chunk.Content[:minLocal(100, len(chunk.Content))])
+					chunkIDs = append(chunkIDs, chunk.ID)
 				}
-			} else {
-				kbSuggestion = generatedKbAnswer
-				fmt.Printf("问题ID %d 的知识库回答生成成功。\n", questionID)
+				saveKBAnswer(db, qSessionID, questionID, &services.KBAnswer{Answer: fallback, ChunkIDs: chunkIDs})
+				return
 			}
+			kbAnswer, kbOK = generated, true
+			fmt.Printf("问题ID %d 的知识库回答生成成功（引用 %d 个文档块）。\n", questionID, len(generated.ChunkIDs))
+			saveKBAnswer(db, qSessionID, questionID, generated)
 		}()
 
-		// 等待两个并行任务都完成
+		// 并行任务3..N: 会话自定义的助手，各自使用自己的提示词和模型
+		assistantAnswers := make([]*models.AssistantAnswer, len(assistants))
+		for i, assistant := range assistants {
+			wg.Add(1)
+			go func(i int, assistant models.SessionAssistant) {
+				defer wg.Done()
+				answer := &models.AssistantAnswer{AssistantID: assistant.ID, Name: assistant.Name, Status: models.AssistantAnswerFailed}
+				var chunks []models.DocumentChunk
+				if assistant.UseKB {
+					var err error
+					if chunks, err = retrieve(); err != nil {
+						fmt.Printf("助手 %s 的知识库检索错误 (问题ID %d): %v\n", assistant.Name, questionID, err)
+						if !cancelled() {
+							saveAssistantAnswer(db, qSessionID, questionID, answer)
+						}
+						return
+					}
+					if len(chunks) == 0 {
+						// 与知识库回答一致：没有相关内容时不用空的参考资料调用模型
+						fmt.Printf("问题ID %d 未检索到相关内容，跳过助手 %s。\n", questionID, assistant.Name)
+						answer.Status = models.AssistantAnswerNoMatch
+						assistantAnswers[i] = answer
+						if !cancelled() {
+							saveAssistantAnswer(db, qSessionID, questionID, answer)
+						}
+						return
+					}
+				}
+				result, err := aiClient.StreamAssistantAnswer(ctx, db, qSessionID, assistant, qContent, chunks, streamToAssistant(assistant.ID))
+				if cancelled() {
+					fmt.Printf("问题ID %d 的助手 %s 建议已取消。\n", questionID, assistant.Name)
+					return
+				}
+				if errors.Is(err, services.ErrBudgetExceeded) {
+					budgetExceeded()
+					return
+				}
+				if err != nil {
+					fmt.Printf("获取助手 %s 的建议错误 (问题ID %d): %v\n", assistant.Name, questionID, err)
+				} else {
+					fmt.Printf("问题ID %d 的助手 %s 建议获取成功（模型 %s）。\n", questionID, assistant.Name, result.Model)
+					answer.Content, answer.Model, answer.Status = result.Content, result.Model, models.AssistantAnswerDone
+					assistantAnswers[i] = answer
+				}
+				saveAssistantAnswer(db, qSessionID, questionID, answer)
+			}(i, assistant)
+		}
+
+		// 等待所有并行任务完成
 		wg.Wait()
+		fmt.Printf("问题 %d 的 AI、知识库和助手建议处理完成。\n", questionID)
 
-		// 更新数据库记录
-		_, updateErr := db.Exec(`UPDATE questions SET ai_suggestion = ?, kb_suggestion = ? WHERE id = ?`,
-			aiResponse, kbSuggestion, questionID)
-		if updateErr != nil {
-			fmt.Printf("更新问题 %d 的 AI 和知识库建议时出错: %v\n", questionID, updateErr)
-		} else {
-			fmt.Printf("问题 %d 的 AI 和知识库建议已更新。\n", questionID)
+		assistantsOK := true
+		cachedAssistants := make([]models.AssistantAnswer, 0, len(assistantAnswers))
+		for _, answer := range assistantAnswers {
+			if answer == nil {
+				assistantsOK = false
+				break
+			}
+			cachedAssistants = append(cachedAssistants, *answer)
+		}
+		if fingerprint != "" && aiOK && kbOK && assistantsOK {
+			entry := &services.CachedAnswer{
+				QuestionID:   questionID,
+				Question:     qContent,
+				Embedding:    questionEmbedding,
+				AISuggestion: aiSuggestion,
+				AIModel:      aiModel,
+				KBNoMatch:    kbNoMatch,
+				Assistants:   cachedAssistants,
+				Fingerprint:  fingerprint,
+				CreatedAt:    time.Now(),
+			}
+			if kbAnswer != nil {
+				entry.KBSuggestion = kbAnswer.Answer
+				entry.KBConfidence = kbAnswer.Confidence
+				entry.KBChunkIDs = kbAnswer.ChunkIDs
+				entry.KBModel = kbAnswer.Model
+			}
+			answerCache.Store(qSessionID, entry)
+		}
+
+		// 本次花费可能越过预警阈值或预算
+		if budget, err := services.GetSessionBudgetStatus(db, cfg, qSessionID); err == nil {
+			services.NotifyBudget(db, budget)
 		}
 
 	}(id, question.SessionID, question.Content)
 }
 
+// saveSuggestion 持久化某一列的最终建议文本及生成它的模型，并通知会话内的客户端
+// column 只能是 ai_suggestion 或 kb_suggestion
+func saveSuggestion(db *sql.DB, sessionId string, questionID int64, column string, text string, model string) {
+	var query, modelColumn string
+	switch column {
+	case "ai_suggestion":
+		query = `UPDATE questions SET ai_suggestion = ?, ai_model = ? WHERE id = ?`
+		modelColumn = "ai_model"
+	case "kb_suggestion":
+		query = `UPDATE questions SET kb_suggestion = ?, kb_model = ? WHERE id = ?`
+		modelColumn = "kb_model"
+	default:
+		fmt.Printf("警告：无效的建议列 '%s'\n", column)
+		return
+	}
+
+	if _, err := db.Exec(query, text, model, questionID); err != nil {
+		fmt.Printf("更新问题 %d 的 %s 时出错: %v\n", questionID, column, err)
+		return
+	}
+	fmt.Printf("问题 %d 的 %s 已更新。\n", questionID, column)
+	services.GetEventHub().Publish(sessionId, services.EventQuestionSuggestion, gin.H{
+		"id":        questionID,
+		column:      text,
+		modelColumn: model,
+	})
+}
+
+// saveKBAnswer 持久化知识库回答、置信度及引用的文档块，并通知会话内的客户端
+func saveKBAnswer(db *sql.DB, sessionId string, questionID int64, answer *services.KBAnswer) {
+	if _, err := db.Exec(`UPDATE questions SET kb_suggestion = ?, kb_confidence = ?, kb_model = ? WHERE id = ?`,
+		answer.Answer, answer.Confidence, answer.Model, questionID); err != nil {
+		fmt.Printf("更新问题 %d 的知识库回答时出错: %v\n", questionID, err)
+		return
+	}
+	if err := services.SaveQuestionCitations(db, questionID, answer.ChunkIDs); err != nil {
+		fmt.Printf("保存问题 %d 的引用时出错: %v\n", questionID, err)
+	}
+	citations, err := services.GetQuestionCitations(db, questionID)
+	if err != nil {
+		fmt.Printf("读取问题 %d 的引用时出错: %v\n", questionID, err)
+	}
+	if citations == nil {
+		citations = []models.Citation{}
+	}
+	fmt.Printf("问题 %d 的 kb_suggestion 已更新。\n", questionID)
+	services.GetEventHub().Publish(sessionId, services.EventQuestionSuggestion, gin.H{
+		"id":            questionID,
+		"kb_suggestion": answer.Answer,
+		"kb_confidence": answer.Confidence,
+		"kb_citations":  citations,
+		"kb_model":      answer.Model,
+	})
+}
+
+// saveAssistantAnswer 持久化助手为问题生成的建议，并通知会话内的客户端
+func saveAssistantAnswer(db *sql.DB, sessionId string, questionID int64, answer *models.AssistantAnswer) {
+	if err := services.SaveAssistantAnswer(db, questionID, answer); err != nil {
+		fmt.Printf("保存问题 %d 的助手 %s 建议时出错: %v\n", questionID, answer.Name, err)
+		return
+	}
+	answer.CreatedAt = time.Now()
+	fmt.Printf("问题 %d 的助手 %s 建议已更新。\n", questionID, answer.Name)
+	services.GetEventHub().Publish(sessionId, services.EventQuestionAssistant, gin.H{
+		"id":        questionID,
+		"assistant": answer,
+	})
+}
+
+// markBudgetExceeded 标记问题因预算用完而未生成建议，并通知会话内的客户端
+func markBudgetExceeded(db *sql.DB, sessionId string, questionID int64) {
+	if _, err := db.Exec(`UPDATE questions SET budget_exceeded = TRUE WHERE id = ?`, questionID); err != nil {
+		fmt.Printf("标记问题 %d 预算超限时出错: %v\n", questionID, err)
+		return
+	}
+	services.GetEventHub().Publish(sessionId, services.EventQuestionBudgetExceeded, gin.H{"id": questionID})
+}
+
+// markKBNoMatch 标记问题在知识库中没有相关内容（未生成知识库回答），并通知会话内的客户端
+func markKBNoMatch(db *sql.DB, sessionId string, questionID int64) {
+	if _, err := db.Exec(`UPDATE questions SET kb_no_match = TRUE WHERE id = ?`, questionID); err != nil {
+		fmt.Printf("标记问题 %d 无知识库匹配时出错: %v\n", questionID, err)
+		return
+	}
+	services.GetEventHub().Publish(sessionId, services.EventQuestionKBNoMatch, gin.H{"id": questionID})
+}
+
 // GetQuestions 获取指定会话的所有问题
 // GET /api/questions/:sessionId
 func GetQuestions(c *gin.Context, db *sql.DB) {
 	sessionId := c.Param("sessionId")
 	// 更新查询以包含 kb_suggestion
 	rows, err := db.Query(`
-	   SELECT id, content, status, ai_suggestion, kb_suggestion, created_at
+	   SELECT id, content, status, ai_suggestion, kb_suggestion, kb_confidence, ai_model, kb_model, prompt_version, budget_exceeded, kb_no_match, created_at
 	   FROM questions
 	   WHERE session_id = ?
 	   ORDER BY created_at DESC
@@ -123,13 +451,30 @@ func GetQuestions(c *gin.Context, db *sql.DB) {
 	}
 	defer rows.Close()
 
+	citations, err := services.GetSessionCitations(db, sessionId)
+	if err != nil {
+		fmt.Printf("查询引用错误: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	assistantAnswers, err := services.GetSessionAssistantAnswers(db, sessionId)
+	if err != nil {
+		fmt.Printf("查询助手建议错误: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	var questions []map[string]interface{}
 	for rows.Next() {
 		q := make(map[string]interface{})
 		var id int
 		var content, status, createdAt string
-		var aiSuggestion, kbSuggestion sql.NullString                                                       // 添加 kbSuggestion
-		if err := rows.Scan(&id, &content, &status, &aiSuggestion, &kbSuggestion, &createdAt); err != nil { // 更新 Scan
+		var aiSuggestion, kbSuggestion sql.NullString // 添加 kbSuggestion
+		var kbConfidence sql.NullFloat64
+		var aiModel, kbModel sql.NullString
+		var promptVersion sql.NullInt64
+		var budgetExceeded, kbNoMatch bool
+		if err := rows.Scan(&id, &content, &status, &aiSuggestion, &kbSuggestion, &kbConfidence, &aiModel, &kbModel, &promptVersion, &budgetExceeded, &kbNoMatch, &createdAt); err != nil { // 更新 Scan
 			fmt.Printf("Scan错误: %v\n", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -139,6 +484,26 @@ func GetQuestions(c *gin.Context, db *sql.DB) {
 		q["status"] = status
 		q["ai_suggestion"] = aiSuggestion.String
 		q["kb_suggestion"] = kbSuggestion.String // 添加 kb_suggestion 到响应
+		q["kb_confidence"] = nil
+		if kbConfidence.Valid {
+			q["kb_confidence"] = kbConfidence.Float64
+		}
+		q["ai_model"] = aiModel.String
+		q["kb_model"] = kbModel.String
+		q["kb_citations"] = citations[id]
+		if citations[id] == nil {
+			q["kb_citations"] = []models.Citation{}
+		}
+		q["prompt_version"] = nil
+		if promptVersion.Valid {
+			q["prompt_version"] = promptVersion.Int64
+		}
+		q["budget_exceeded"] = budgetExceeded
+		q["kb_no_match"] = kbNoMatch
+		q["assistants"] = assistantAnswers[id]
+		if assistantAnswers[id] == nil {
+			q["assistants"] = []models.AssistantAnswer{}
+		}
 		q["created_at"] = createdAt
 		questions = append(questions, q)
 	}
@@ -150,8 +515,26 @@ func GetQuestions(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, questions)
 }
 
+// lockSessionRow 在事务中锁定会话行。旧数据中可能只有问题没有会话记录，
+// 此时先补建会话行（插入即持有该行的锁），保证同一会话的状态修改总能串行执行
+func lockSessionRow(tx *sql.Tx, sessionId string) error {
+	var locked string
+	err := tx.QueryRow("SELECT id FROM sessions WHERE id = ? FOR UPDATE", sessionId).Scan(&locked)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := tx.Exec("INSERT IGNORE INTO sessions (id) VALUES (?)", sessionId); err != nil {
+		return err
+	}
+	fmt.Printf("会话 %s 没有会话记录，已补建以便锁定\n", sessionId)
+	// 并发请求可能已先插入同一行（INSERT IGNORE 被忽略），统一再锁定一次
+	return tx.QueryRow("SELECT id FROM sessions WHERE id = ? FOR UPDATE", sessionId).Scan(&locked)
+}
+
 // UpdateQuestionStatus 更新问题的状态
 // POST /api/question/status
+// 状态迁移受 models.CanTransitionQuestion 约束；设置为 showing 时，
+// 同一会话中原先处于 showing 的问题会在同一事务内被改为 finished
 func UpdateQuestionStatus(c *gin.Context, db *sql.DB) {
 	var req struct {
 		ID     int    `json:"id"`
@@ -161,23 +544,141 @@ func UpdateQuestionStatus(c *gin.Context, db *sql.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !models.IsValidQuestionStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid status %q", req.Status)})
+		return
+	}
 
-	// 如果设置showing状态，先把其他showing的改为finished
-	if req.Status == "showing" {
-		_, err := db.Exec("UPDATE questions SET status = 'finished' WHERE status = 'showing'")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction: " + err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// 先锁定会话行再锁定目标问题：同一会话的状态修改串行执行，
+	// 即使当前没有 showing 的问题，并发的两个请求也不会同时把各自的问题设为 showing
+	var sessionId, currentStatus string
+	err = tx.QueryRow("SELECT session_id FROM questions WHERE id = ?", req.ID).Scan(&sessionId)
+	if err == nil {
+		// 补建会话行之前先确认调用者有权操作该会话
+		if !authorizePresenter(c, sessionId) {
+			return
+		}
+		if err = lockSessionRow(tx, sessionId); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to lock session: " + err.Error()})
+			return
+		}
+		err = tx.QueryRow("SELECT session_id, status FROM questions WHERE id = ? FOR UPDATE", req.ID).Scan(&sessionId, &currentStatus)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "question not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !models.CanTransitionQuestion(currentStatus, req.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         fmt.Sprintf("cannot change question status from %q to %q", currentStatus, req.Status),
+			"currentStatus": currentStatus,
+		})
+		return
+	}
+
+	// 如果设置showing状态，先把本会话其他showing的改为finished
+	var demoted []int
+	if req.Status == models.QuestionStatusShowing {
+		rows, err := tx.Query("SELECT id FROM questions WHERE session_id = ? AND status = 'showing' AND id != ? FOR UPDATE", sessionId, req.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			demoted = append(demoted, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = tx.Exec("UPDATE questions SET status = 'finished' WHERE session_id = ? AND status = 'showing' AND id != ?", sessionId, req.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 	}
 
-	_, err := db.Exec("UPDATE questions SET status = ? WHERE id = ?", req.Status, req.ID)
+	_, err = tx.Exec("UPDATE questions SET status = ? WHERE id = ?", req.Status, req.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction: " + err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
+
+	hub := services.GetEventHub()
+	for _, id := range demoted {
+		hub.Publish(sessionId, services.EventQuestionStatus, gin.H{
+			"id":     id,
+			"status": models.QuestionStatusFinished,
+		})
+	}
+	hub.Publish(sessionId, services.EventQuestionStatus, gin.H{
+		"id":     req.ID,
+		"status": req.Status,
+	})
+}
+
+// DeleteQuestion 删除指定问题
+// DELETE /api/question/:id
+func DeleteQuestion(c *gin.Context, db *sql.DB) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid question id"})
+		return
+	}
+
+	// 先查出 sessionId，用于删除后通知该会话的客户端
+	var sessionId string
+	err = db.QueryRow("SELECT session_id FROM questions WHERE id = ?", id).Scan(&sessionId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "question not found"})
+		} else {
+			fmt.Printf("删除错误: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if !authorizePresenter(c, sessionId) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM questions WHERE id = ?", id); err != nil {
+		fmt.Printf("删除错误: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 停止仍在进行的建议生成，避免继续花费并写回已删除的问题
+	services.GetBackgroundTasks().CancelQuestion(id)
+	c.JSON(http.StatusOK, gin.H{})
+
+	services.GetEventHub().Publish(sessionId, services.EventQuestionDeleted, gin.H{"id": id})
 }
 
 // minLocal 返回两个整数中较小的一个 (本地辅助函数)
@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+	"github.com/soaringjerry/AnyQA/backend/services"
+)
+
+// errSessionNotFound 会话不存在
+var errSessionNotFound = errors.New("session not found")
+
+// sessionColumns 查询 sessions 表时使用的列，顺序与 scanSession 一致
+const sessionColumns = `id, title, owner, starts_at, ends_at, accepting_questions, status, created_at, updated_at, closed_at, budget_tokens, budget_usd, budget_fallback_model, retrieval_lexical_weight, retrieval_top_k, retrieval_min_similarity, retrieval_max_context_tokens`
+
+// rowScanner 兼容 *sql.Row 和 *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSession 将一行 sessions 记录扫描为 models.Session
+func scanSession(row rowScanner) (*models.Session, error) {
+	var s models.Session
+	var startsAt, endsAt, closedAt sql.NullTime
+	var budgetTokens sql.NullInt64
+	var budgetUSD sql.NullFloat64
+	var fallbackModel sql.NullString
+	var lexicalWeight, minSimilarity sql.NullFloat64
+	var topK, maxContextTokens sql.NullInt64
+	if err := row.Scan(&s.ID, &s.Title, &s.Owner, &startsAt, &endsAt, &s.AcceptingQuestions, &s.Status, &s.CreatedAt, &s.UpdatedAt, &closedAt,
+		&budgetTokens, &budgetUSD, &fallbackModel, &lexicalWeight, &topK, &minSimilarity, &maxContextTokens); err != nil {
+		return nil, err
+	}
+	if lexicalWeight.Valid {
+		s.RetrievalLexicalWeight = &lexicalWeight.Float64
+	}
+	if topK.Valid {
+		k := int(topK.Int64)
+		s.RetrievalTopK = &k
+	}
+	if minSimilarity.Valid {
+		s.RetrievalMinSimilarity = &minSimilarity.Float64
+	}
+	if maxContextTokens.Valid {
+		t := int(maxContextTokens.Int64)
+		s.RetrievalMaxContextTokens = &t
+	}
+	if budgetTokens.Valid {
+		s.BudgetTokens = &budgetTokens.Int64
+	}
+	if budgetUSD.Valid {
+		s.BudgetUSD = &budgetUSD.Float64
+	}
+	s.BudgetFallbackModel = fallbackModel.String
+	if startsAt.Valid {
+		s.StartsAt = &startsAt.Time
+	}
+	if endsAt.Valid {
+		s.EndsAt = &endsAt.Time
+	}
+	if closedAt.Valid {
+		s.ClosedAt = &closedAt.Time
+	}
+	return &s, nil
+}
+
+// loadSession 按 ID 读取会话，不存在时返回 errSessionNotFound
+func loadSession(db *sql.DB, sessionId string) (*models.Session, error) {
+	s, err := scanSession(db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, sessionId))
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session: %w", err)
+	}
+	return s, nil
+}
+
+// requireWritableSession 校验会话存在且未关闭；校验失败时写入错误响应并返回 nil
+// requireQuestions 为 true 时还要求会话正在接受观众提问
+func requireWritableSession(c *gin.Context, db *sql.DB, sessionId string, requireQuestions bool) *models.Session {
+	s, err := loadSession(db, sessionId)
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	if s.Status == models.SessionStatusClosed {
+		c.JSON(http.StatusConflict, gin.H{"error": "session is closed"})
+		return nil
+	}
+	if requireQuestions && !s.AcceptingQuestions {
+		c.JSON(http.StatusConflict, gin.H{"error": "session is not accepting questions"})
+		return nil
+	}
+	return s
+}
+
+// sessionRequest 创建/更新会话的请求体；指针字段为 nil 表示不修改
+type sessionRequest struct {
+	ID                 string     `json:"id"`
+	Title              *string    `json:"title"`
+	Owner              *string    `json:"owner"`
+	StartsAt           *time.Time `json:"startsAt"`
+	EndsAt             *time.Time `json:"endsAt"`
+	AcceptingQuestions *bool      `json:"acceptingQuestions"`
+
+	// 预算字段传 0 表示取消该项限制
+	BudgetTokens        *int64   `json:"budgetTokens"`
+	BudgetUSD           *float64 `json:"budgetUsd"`
+	BudgetFallbackModel *string  `json:"budgetFallbackModel"`
+
+	// 检索设置，传负数表示恢复使用全局默认值
+	RetrievalLexicalWeight    *float64 `json:"retrievalLexicalWeight"`    // 关键词检索权重（0-1）
+	RetrievalTopK             *int     `json:"retrievalTopK"`             // 最多检索的文档块数
+	RetrievalMinSimilarity    *float64 `json:"retrievalMinSimilarity"`    // 最低余弦相似度（0-1），0 表示不限制
+	RetrievalMaxContextTokens *int     `json:"retrievalMaxContextTokens"` // 参考资料的最大 token 数，0 表示不限制
+}
+
+// sessionMaxTopK 会话检索设置允许的最大文档块数
+const sessionMaxTopK = 20
+
+// applyRetrieval 将请求中的检索设置写入会话；参数非法时返回错误
+func (req *sessionRequest) applyRetrieval(s *models.Session, cfg *config.Config) error {
+	if w := req.RetrievalLexicalWeight; w != nil {
+		if *w > 1 {
+			return fmt.Errorf("retrievalLexicalWeight must be at most 1")
+		}
+		s.RetrievalLexicalWeight = w
+		if *w < 0 {
+			s.RetrievalLexicalWeight = nil
+		}
+	}
+	if k := req.RetrievalTopK; k != nil {
+		if *k == 0 || *k > sessionMaxTopK {
+			return fmt.Errorf("retrievalTopK must be between 1 and %d", sessionMaxTopK)
+		}
+		s.RetrievalTopK = k
+		if *k < 0 {
+			s.RetrievalTopK = nil
+		}
+	}
+	if m := req.RetrievalMinSimilarity; m != nil {
+		if *m > 1 {
+			return fmt.Errorf("retrievalMinSimilarity must be at most 1")
+		}
+		s.RetrievalMinSimilarity = m
+		if *m < 0 {
+			s.RetrievalMinSimilarity = nil
+		}
+	}
+	if t := req.RetrievalMaxContextTokens; t != nil {
+		s.RetrievalMaxContextTokens = t
+		if *t < 0 {
+			s.RetrievalMaxContextTokens = nil
+		}
+	}
+	// 只用关键词检索时没有问题向量，相似度阈值无法生效；会话未设置的项按全局配置判断
+	weight, minSimilarity := cfg.RetrievalLexicalWeight, cfg.RetrievalMinSimilarity
+	if s.RetrievalLexicalWeight != nil {
+		weight = *s.RetrievalLexicalWeight
+	}
+	if s.RetrievalMinSimilarity != nil {
+		minSimilarity = *s.RetrievalMinSimilarity
+	}
+	if weight >= 1 && minSimilarity > 0 {
+		return fmt.Errorf("retrievalMinSimilarity cannot be used with keyword-only retrieval (effective retrievalLexicalWeight 1)")
+	}
+	return nil
+}
+
+// applyBudget 将请求中的预算字段写入会话；返回 false 表示参数非法
+func (req *sessionRequest) applyBudget(s *models.Session) bool {
+	if req.BudgetTokens != nil {
+		if *req.BudgetTokens < 0 {
+			return false
+		}
+		s.BudgetTokens = req.BudgetTokens
+		if *req.BudgetTokens == 0 {
+			s.BudgetTokens = nil
+		}
+	}
+	if req.BudgetUSD != nil {
+		if *req.BudgetUSD < 0 {
+			return false
+		}
+		s.BudgetUSD = req.BudgetUSD
+		if *req.BudgetUSD == 0 {
+			s.BudgetUSD = nil
+		}
+	}
+	if req.BudgetFallbackModel != nil {
+		s.BudgetFallbackModel = strings.TrimSpace(*req.BudgetFallbackModel)
+	}
+	return true
+}
+
+// CreateSession 创建新会话，并签发该会话的演讲者令牌
+// POST /api/sessions
+func CreateSession(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	var req sessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return
+	}
+
+	// 未指定 ID 时生成一个短 ID，便于观众输入和二维码展示
+	sessionId := strings.TrimSpace(req.ID)
+	if sessionId == "" {
+		sessionId = strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+	}
+	if len(sessionId) > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session id must be at most 50 characters"})
+		return
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && req.EndsAt.Before(*req.StartsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endsAt must not be before startsAt"})
+		return
+	}
+
+	s := models.Session{
+		ID:                 sessionId,
+		StartsAt:           req.StartsAt,
+		EndsAt:             req.EndsAt,
+		AcceptingQuestions: true,
+		Status:             models.SessionStatusActive,
+	}
+	if req.Title != nil {
+		s.Title = *req.Title
+	}
+	if req.Owner != nil {
+		s.Owner = *req.Owner
+	}
+	if req.AcceptingQuestions != nil {
+		s.AcceptingQuestions = *req.AcceptingQuestions
+	}
+	if !req.applyBudget(&s) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "budget must not be negative"})
+		return
+	}
+	if err := req.applyRetrieval(&s, cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 签发演讲者令牌；明文只在本次响应中返回
+	presenterToken, tokenHash, err := newPresenterToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO sessions (id, title, owner, starts_at, ends_at, accepting_questions, status, presenter_token_hash, budget_tokens, budget_usd, budget_fallback_model, retrieval_lexical_weight, retrieval_top_k, retrieval_min_similarity, retrieval_max_context_tokens) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Title, s.Owner, s.StartsAt, s.EndsAt, s.AcceptingQuestions, s.Status, tokenHash, s.BudgetTokens, s.BudgetUSD, s.BudgetFallbackModel, s.RetrievalLexicalWeight,
+		s.RetrievalTopK, s.RetrievalMinSimilarity, s.RetrievalMaxContextTokens)
+	if err != nil {
+		if _, lookupErr := loadSession(db, sessionId); lookupErr == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "session already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session: " + err.Error()})
+		return
+	}
+
+	created, err := loadSession(db, sessionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "session": created, "presenterToken": presenterToken})
+}
+
+// ListSessions 列出会话，可按 owner 和 status 过滤
+// GET /api/sessions
+func ListSessions(c *gin.Context, db *sql.DB) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE 1 = 1`
+	var args []interface{}
+	if owner := c.Query("owner"); owner != "" {
+		query += ` AND owner = ?`
+		args = append(args, owner)
+	}
+	if status := c.Query("status"); status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query sessions: " + err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			fmt.Printf("扫描会话行错误: %v\n", err)
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error iterating session rows: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// GetSession 获取单个会话
+// GET /api/sessions/:sessionId
+func GetSession(c *gin.Context, db *sql.DB) {
+	s, err := loadSession(db, c.Param("sessionId"))
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// UpdateSession 更新会话的标题、负责人、时间、是否接受提问、AI 预算和检索设置
+// PUT /api/sessions/:sessionId
+func UpdateSession(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	s := requireWritableSession(c, db, c.Param("sessionId"), false)
+	if s == nil {
+		return
+	}
+
+	var req sessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+		return
+	}
+	if req.Title != nil {
+		s.Title = *req.Title
+	}
+	if req.Owner != nil {
+		s.Owner = *req.Owner
+	}
+	if req.StartsAt != nil {
+		s.StartsAt = req.StartsAt
+	}
+	if req.EndsAt != nil {
+		s.EndsAt = req.EndsAt
+	}
+	if req.AcceptingQuestions != nil {
+		s.AcceptingQuestions = *req.AcceptingQuestions
+	}
+	if !req.applyBudget(s) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "budget must not be negative"})
+		return
+	}
+	if err := req.applyRetrieval(s, cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if s.StartsAt != nil && s.EndsAt != nil && s.EndsAt.Before(*s.StartsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endsAt must not be before startsAt"})
+		return
+	}
+
+	// 预算变化时重置预警标记，以便在新预算下重新提醒
+	_, err := db.Exec(`UPDATE sessions SET title = ?, owner = ?, starts_at = ?, ends_at = ?, accepting_questions = ?,
+		budget_warned_at = IF(budget_tokens <=> ? AND budget_usd <=> ?, budget_warned_at, NULL),
+		budget_exceeded_at = IF(budget_tokens <=> ? AND budget_usd <=> ?, budget_exceeded_at, NULL),
+		budget_tokens = ?, budget_usd = ?, budget_fallback_model = ?, retrieval_lexical_weight = ?,
+		retrieval_top_k = ?, retrieval_min_similarity = ?, retrieval_max_context_tokens = ?, updated_at = NOW() WHERE id = ?`,
+		s.Title, s.Owner, s.StartsAt, s.EndsAt, s.AcceptingQuestions,
+		s.BudgetTokens, s.BudgetUSD, s.BudgetTokens, s.BudgetUSD,
+		s.BudgetTokens, s.BudgetUSD, s.BudgetFallbackModel, s.RetrievalLexicalWeight,
+		s.RetrievalTopK, s.RetrievalMinSimilarity, s.RetrievalMaxContextTokens, s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session: " + err.Error()})
+		return
+	}
+
+	updated, err := loadSession(db, s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "session": updated})
+
+	services.GetEventHub().Publish(updated.ID, services.EventSessionUpdated, updated)
+}
+
+// CloseSession 关闭会话，之后不再接受提问和文档上传
+// POST /api/sessions/:sessionId/close
+func CloseSession(c *gin.Context, db *sql.DB) {
+	s := requireWritableSession(c, db, c.Param("sessionId"), false)
+	if s == nil {
+		return
+	}
+
+	_, err := db.Exec(`UPDATE sessions SET status = ?, accepting_questions = FALSE, closed_at = NOW(), ends_at = COALESCE(ends_at, NOW()), updated_at = NOW() WHERE id = ?`,
+		models.SessionStatusClosed, s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to close session: " + err.Error()})
+		return
+	}
+	// 会话已结束，不再需要尚未生成完的建议
+	services.GetBackgroundTasks().CancelSession(s.ID)
+
+	closed, err := loadSession(db, s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "session": closed})
+
+	services.GetEventHub().Publish(closed.ID, services.EventSessionUpdated, closed)
+}
+
+// GetSessionBudget 返回会话的 AI 预算与已花费金额
+// GET /api/sessions/:sessionId/budget
+func GetSessionBudget(c *gin.Context, db *sql.DB, cfg *config.Config) {
+	if _, err := loadSession(db, c.Param("sessionId")); err != nil {
+		if err == errSessionNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status, err := services.GetSessionBudgetStatus(db, cfg, c.Param("sessionId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// usageDimensions 用量报表可以分组的维度及对应的 SQL 表达式
+var usageDimensions = map[string]string{
+	"session": "u.session_id",
+	"owner":   "COALESCE(s.owner, '')",
+	"day":     "DATE_FORMAT(u.created_at, '%Y-%m-%d')",
+	"kind":    "u.kind",
+	"model":   "u.model",
+}
+
+// usageDimensionOrder 与 scanUsageSummary 中的字段顺序一致
+var usageDimensionOrder = []string{"session", "owner", "day", "kind", "model"}
+
+// usageFilter 解析 from/to（YYYY-MM-DD，含当天）查询参数，返回 WHERE 子句和参数
+// 解析失败时写入 400 并返回 ok=false
+func usageFilter(c *gin.Context) (conds []string, args []interface{}, ok bool) {
+	if from := c.Query("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date, expected YYYY-MM-DD"})
+			return nil, nil, false
+		}
+		conds = append(conds, "u.created_at >= ?")
+		args = append(args, t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date, expected YYYY-MM-DD"})
+			return nil, nil, false
+		}
+		conds = append(conds, "u.created_at < ?")
+		args = append(args, t.AddDate(0, 0, 1))
+	}
+	return conds, args, true
+}
+
+// queryUsage 按 groupBy 中的维度汇总 ai_usage；未分组的维度在结果中为空
+func queryUsage(db *sql.DB, groupBy []string, conds []string, args []interface{}) ([]models.UsageSummary, error) {
+	grouped := make(map[string]bool, len(groupBy))
+	for _, dim := range groupBy {
+		grouped[dim] = true
+	}
+
+	var selects, groups []string
+	for _, dim := range usageDimensionOrder {
+		if grouped[dim] {
+			selects = append(selects, usageDimensions[dim])
+			groups = append(groups, usageDimensions[dim])
+		} else {
+			selects = append(selects, "''")
+		}
+	}
+
+	query := `SELECT ` + strings.Join(selects, ", ") + `,
+		COUNT(*),
+		COALESCE(SUM(CASE WHEN u.success THEN 0 ELSE 1 END), 0),
+		COALESCE(SUM(u.prompt_tokens), 0),
+		COALESCE(SUM(u.completion_tokens), 0),
+		COALESCE(SUM(u.total_tokens), 0),
+		COALESCE(SUM(u.cost_usd), 0)
+		FROM ai_usage u LEFT JOIN sessions s ON s.id = u.session_id`
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	if len(groups) > 0 {
+		query += ` GROUP BY ` + strings.Join(groups, ", ") + ` ORDER BY ` + strings.Join(groups, ", ")
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := []models.UsageSummary{}
+	for rows.Next() {
+		var s models.UsageSummary
+		if err := rows.Scan(&s.SessionID, &s.Owner, &s.Day, &s.Kind, &s.Model,
+			&s.Calls, &s.FailedCalls, &s.PromptTokens, &s.CompletionTokens, &s.TotalTokens, &s.CostUSD); err != nil {
+			return nil, fmt.Errorf("failed to scan usage row: %w", err)
+		}
+		summaries = append(summaries, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate usage rows: %w", err)
+	}
+	return summaries, nil
+}
+
+// GetSessionUsage 返回单个会话的模型用量与费用：总计、按天、按模型
+// GET /api/usage/:sessionId?from=YYYY-MM-DD&to=YYYY-MM-DD
+func GetSessionUsage(c *gin.Context, db *sql.DB) {
+	sessionId := c.Param("sessionId")
+	conds, args, ok := usageFilter(c)
+	if !ok {
+		return
+	}
+	conds = append(conds, "u.session_id = ?")
+	args = append(args, sessionId)
+
+	total, err := queryUsage(db, nil, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byDay, err := queryUsage(db, []string{"day"}, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byModel, err := queryUsage(db, []string{"kind", "model"}, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessionId": sessionId,
+		"total":     total[0],
+		"byDay":     byDay,
+		"byModel":   byModel,
+	})
+}
+
+// GetUsageReport 返回所有会话按会话和天汇总的用量，用于内部结算；仅管理员令牌可用
+// GET /api/usage?from=YYYY-MM-DD&to=YYYY-MM-DD&owner=
+func GetUsageReport(c *gin.Context, db *sql.DB) {
+	if !c.GetBool(ctxPresenterAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin token is required"})
+		return
+	}
+	conds, args, ok := usageFilter(c)
+	if !ok {
+		return
+	}
+	if owner := c.Query("owner"); owner != "" {
+		conds = append(conds, "s.owner = ?")
+		args = append(args, owner)
+	}
+
+	total, err := queryUsage(db, nil, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bySession, err := queryUsage(db, []string{"owner", "session"}, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bySessionDay, err := queryUsage(db, []string{"owner", "session", "day"}, conds, args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":        total[0],
+		"bySession":    bySession,
+		"bySessionDay": bySessionDay,
+	})
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/soaringjerry/AnyQA/backend/services"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // 跨域由外部 Nginx 处理
+	},
+}
+
+// HandleWebSocket 将客户端加入会话房间，之后服务端推送该会话的实时事件
+// GET /api/ws?sessionId=xxx
+func HandleWebSocket(c *gin.Context) {
+	sessionId := c.Query("sessionId")
+	if sessionId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sessionId is required"})
+		return
+	}
+
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		fmt.Printf("WebSocket upgrade error: %v\n", err)
+		return
+	}
+
+	services.GetEventHub().ServeClient(ws, sessionId)
+}
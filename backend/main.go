@@ -2,28 +2,26 @@ package main
 
 import (
 	// "bytes" // 移除未使用的导入
+	"context"
 	"database/sql"
 	// "encoding/json" // 移除未使用的导入
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/soaringjerry/AnyQA/backend/config"   // 替换为实际项目中的导入路径
 	"github.com/soaringjerry/AnyQA/backend/handlers" // 导入 handlers 包
-
-	// "github.com/soaringjerry/AnyQA/backend/services" // 移除未使用的导入
+	"github.com/soaringjerry/AnyQA/backend/services"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/websocket"
 )
 
 var db *sql.DB
 var cfg *config.Config // 全局配置变量
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
 
 func init() {
 	// 初始化配置
@@ -39,6 +37,17 @@ func init() {
 		panic("数据库连接失败: " + err.Error())
 	}
 	fmt.Println("数据库连接成功!")
+
+	// 启动时检查模型服务配置，避免配置错误时直到第一个问题才发现
+	if _, err := services.NewAIClient(cfg); err != nil {
+		panic("模型服务配置错误: " + err.Error())
+	}
+	if err := services.ValidateRetrievalConfig(cfg); err != nil {
+		panic("检索配置错误: " + err.Error())
+	}
+
+	// 向量缓存的近似最近邻索引参数
+	services.GetVectorCache().Configure(services.VectorIndexOptionsFromConfig(cfg))
 }
 
 func main() {
@@ -62,59 +71,79 @@ func main() {
 
 	// API routes
 	// 使用 handlers 包中的函数，并传递 db 和 cfg
+
+	// 观众路由：无需认证
+	r.POST("/api/sessions", func(c *gin.Context) { handlers.CreateSession(c, db, cfg) }) // 创建会话并签发演讲者令牌
+	r.GET("/api/sessions", func(c *gin.Context) { handlers.ListSessions(c, db) })
+	r.GET("/api/sessions/:sessionId", func(c *gin.Context) { handlers.GetSession(c, db) })
 	r.POST("/api/question", func(c *gin.Context) { handlers.HandleQuestion(c, db, cfg) })
 	r.GET("/api/questions/:sessionId", func(c *gin.Context) { handlers.GetQuestions(c, db) })
-	r.GET("/api/ws", handleWebSocket) // WebSocket 暂时保留在 main.go
-	r.POST("/api/question/status", func(c *gin.Context) { handlers.UpdateQuestionStatus(c, db) })
-	r.DELETE("/api/question/:id", func(c *gin.Context) { // 删除问题的逻辑比较简单，暂时保留匿名函数
-		id := c.Param("id")
-		_, err := db.Exec("DELETE FROM questions WHERE id = ?", id)
-		if err != nil {
-			fmt.Printf("删除错误: %v\n", err)
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(200, gin.H{})
-	})
+	r.GET("/api/ws", handlers.HandleWebSocket) // 按 sessionId 加入房间，接收实时事件推送
+
+	// 演讲者路由：需要会话的演讲者令牌（或管理员令牌）
+	presenter := r.Group("/api", handlers.RequirePresenter(db, cfg))
+	presenter.PUT("/sessions/:sessionId", func(c *gin.Context) { handlers.UpdateSession(c, db, cfg) })
+	presenter.POST("/sessions/:sessionId/close", func(c *gin.Context) { handlers.CloseSession(c, db) })
+	presenter.POST("/sessions/:sessionId/presenter-token", func(c *gin.Context) { handlers.RotatePresenterToken(c, db) })
+	presenter.GET("/sessions/:sessionId/budget", func(c *gin.Context) { handlers.GetSessionBudget(c, db, cfg) })
+	// 会话自定义的助手：每个启用的助手为新问题多生成一路建议
+	presenter.GET("/sessions/:sessionId/assistants", func(c *gin.Context) { handlers.ListSessionAssistants(c, db) })
+	presenter.POST("/sessions/:sessionId/assistants", func(c *gin.Context) { handlers.CreateSessionAssistant(c, db, cfg) })
+	presenter.PUT("/sessions/:sessionId/assistants/:assistantId", func(c *gin.Context) { handlers.UpdateSessionAssistant(c, db, cfg) })
+	presenter.DELETE("/sessions/:sessionId/assistants/:assistantId", func(c *gin.Context) { handlers.DeleteSessionAssistant(c, db) })
+	presenter.POST("/question/status", func(c *gin.Context) { handlers.UpdateQuestionStatus(c, db) })
+	presenter.DELETE("/question/:id", func(c *gin.Context) { handlers.DeleteQuestion(c, db) })
 	// 新增：文档上传路由
-	r.POST("/api/documents", func(c *gin.Context) { handlers.HandleDocumentUpload(c, db, cfg) })
+	presenter.POST("/documents", func(c *gin.Context) { handlers.HandleDocumentUpload(c, db, cfg) })
 	// 新增：获取文档列表路由
-	r.GET("/api/documents/:sessionId", func(c *gin.Context) { handlers.GetSessionDocuments(c, db) })
+	presenter.GET("/documents/:sessionId", func(c *gin.Context) { handlers.GetSessionDocuments(c, db) })
 	// 新增：删除文档路由
-	r.DELETE("/api/document/:id", func(c *gin.Context) { handlers.DeleteDocument(c, db) })
+	presenter.DELETE("/document/:id", func(c *gin.Context) { handlers.DeleteDocument(c, db) })
 	// 新增：获取会话提示词路由
-	r.GET("/api/prompts/:sessionId", func(c *gin.Context) { handlers.GetSessionPrompts(c, db, cfg) })
+	presenter.GET("/prompts/:sessionId", func(c *gin.Context) { handlers.GetSessionPrompts(c, db, cfg) })
 	// 新增：更新会话提示词路由
-	r.POST("/api/prompts/:sessionId", func(c *gin.Context) { handlers.UpdateSessionPrompts(c, db) })
-
-	r.Run(cfg.ServerPort)
-}
-
-// WebSocket 处理逻辑 (暂时保留在 main.go)
-func handleWebSocket(c *gin.Context) {
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		fmt.Printf("WebSocket upgrade error: %v\n", err)
-		return
-	}
-	defer ws.Close()
-
-	fmt.Println("WebSocket client connected")
-	// TODO: 实现更复杂的 WebSocket 逻辑，例如广播消息等
-	for {
-		_, msg, err := ws.ReadMessage()
-		if err != nil {
-			fmt.Printf("WebSocket read error: %v\n", err)
-			break // 连接关闭或出错
-		}
-		fmt.Printf("Received WebSocket message: %s\n", string(msg))
-		// 简单地将消息回显给客户端
-		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-			fmt.Printf("WebSocket write error: %v\n", err)
-			break
+	presenter.POST("/prompts/:sessionId", func(c *gin.Context) { handlers.UpdateSessionPrompts(c, db, cfg) })
+	// 提示词版本历史、差异比较与回滚
+	presenter.GET("/prompts/:sessionId/versions", func(c *gin.Context) { handlers.ListPromptVersions(c, db) })
+	presenter.GET("/prompts/:sessionId/versions/:version", func(c *gin.Context) { handlers.GetPromptVersion(c, db) })
+	presenter.POST("/prompts/:sessionId/versions/:version/restore", func(c *gin.Context) { handlers.RestorePromptVersion(c, db) })
+	presenter.GET("/prompts/:sessionId/diff", func(c *gin.Context) { handlers.DiffPromptVersions(c, db) })
+	presenter.PUT("/prompts/:sessionId/preset", func(c *gin.Context) { handlers.SetSessionPromptPreset(c, db) })
+	// 用候选提示词和示例问题试运行，不保存任何内容
+	presenter.POST("/prompts/:sessionId/dry-run", func(c *gin.Context) { handlers.DryRunPrompt(c, db, cfg) })
+	// 共享的提示词预设库：所有演讲者可查看，仅管理员令牌可修改
+	presenter.GET("/prompt-presets", func(c *gin.Context) { handlers.ListPromptPresets(c, db) })
+	presenter.GET("/prompt-presets/:id", func(c *gin.Context) { handlers.GetPromptPreset(c, db) })
+	presenter.POST("/prompt-presets", func(c *gin.Context) { handlers.CreatePromptPreset(c, db) })
+	presenter.PUT("/prompt-presets/:id", func(c *gin.Context) { handlers.UpdatePromptPreset(c, db) })
+	presenter.DELETE("/prompt-presets/:id", func(c *gin.Context) { handlers.DeletePromptPreset(c, db) })
+	// 模型用量与费用报表
+	presenter.GET("/usage/:sessionId", func(c *gin.Context) { handlers.GetSessionUsage(c, db) })
+	presenter.GET("/usage", func(c *gin.Context) { handlers.GetUsageReport(c, db) }) // 仅管理员令牌
+
+	srv := &http.Server{Addr: cfg.ServerPort, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
 		}
+	}()
+
+	// 收到 SIGINT / SIGTERM 后优雅停机：停止接收请求，取消后台生成任务并等待它们退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	fmt.Println("正在停止服务...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("HTTP 服务停止失败: %v\n", err)
+	}
+	if err := services.GetBackgroundTasks().Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("后台任务未能及时退出: %v\n", err)
 	}
-	fmt.Println("WebSocket client disconnected")
+	db.Close()
+	fmt.Println("服务已停止。")
 }
 
 // 注意：getAIResponse 函数现在应该在 services/openai_service.go 中实现或调用
@@ -0,0 +1,421 @@
+// Package mockopenai 提供一个离线的 OpenAI 兼容模拟服务，
+// 实现 /v1/chat/completions（含流式）和 /v1/embeddings，输出完全确定，
+// 既可以作为独立程序运行（见 cmd/mockopenai），也可以通过 NewTestServer 嵌入 httptest。
+package mockopenai
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// DefaultDimensions 未指定 dimensions 时返回的向量维度
+const DefaultDimensions = 256
+
+// Options 模拟服务的配置
+type Options struct {
+	APIKey      string        // 非空时要求 Authorization: Bearer <APIKey>
+	Dimensions  int           // 默认向量维度，<= 0 时使用 DefaultDimensions
+	StreamDelay time.Duration // 流式响应中每个增量之间的间隔
+	FailFirst   int           // 前 FailFirst 个请求直接返回 FailStatus，用于演练重试
+	FailStatus  int           // 注入失败时的状态码，默认 503
+	RetryAfter  time.Duration // 注入失败时附带的 Retry-After
+
+	// 请求这些聊天模型时始终返回 429，用于演练备用模型
+	OverloadedModels []string
+}
+
+// chatRequest 聊天请求中模拟服务关心的字段
+type chatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+	Stream        bool `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	ResponseFormat *struct {
+		Type string `json:"type"`
+	} `json:"response_format"`
+}
+
+// embeddingRequest 向量请求；input 可以是字符串或字符串数组
+type embeddingRequest struct {
+	Model      string          `json:"model"`
+	Input      json.RawMessage `json:"input"`
+	Dimensions int             `json:"dimensions"`
+}
+
+// usage OpenAI 格式的用量信息
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// server 模拟服务实现
+type server struct {
+	opts     Options
+	requests int64 // 已收到的请求数
+}
+
+// NewHandler 返回模拟服务的 http.Handler
+func NewHandler(opts Options) http.Handler {
+	if opts.Dimensions <= 0 {
+		opts.Dimensions = DefaultDimensions
+	}
+	if opts.FailStatus == 0 {
+		opts.FailStatus = http.StatusServiceUnavailable
+	}
+	s := &server{opts: opts}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", s.handleChat)
+	mux.HandleFunc("/v1/embeddings", s.handleEmbeddings)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+// NewTestServer 启动一个 httptest 模拟服务，调用方负责 Close
+// 服务地址加上 "/v1" 即可作为 OpenAI 兼容的 base URL
+func NewTestServer(opts Options) *httptest.Server {
+	return httptest.NewServer(NewHandler(opts))
+}
+
+// authorize 校验 API 密钥并按配置注入失败；失败时写入错误响应
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if n := atomic.AddInt64(&s.requests, 1); n <= int64(s.opts.FailFirst) {
+		if s.opts.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.opts.RetryAfter.Seconds()))))
+		}
+		writeError(w, s.opts.FailStatus, "server_error", fmt.Sprintf("injected failure %d/%d", n, s.opts.FailFirst))
+		return false
+	}
+	if s.opts.APIKey == "" {
+		return true
+	}
+	if r.Header.Get("Authorization") == "Bearer "+s.opts.APIKey || r.Header.Get("api-key") == s.opts.APIKey {
+		return true
+	}
+	writeError(w, http.StatusUnauthorized, "invalid_api_key", "Incorrect API key provided.")
+	return false
+}
+
+// handleChat 处理 POST /v1/chat/completions
+func (s *server) handleChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+		return
+	}
+	if req.Model == "" {
+		req.Model = "mock-chat"
+	}
+	for _, model := range s.opts.OverloadedModels {
+		if req.Model == model {
+			writeError(w, http.StatusTooManyRequests, "rate_limit_exceeded", fmt.Sprintf("model %s is overloaded", model))
+			return
+		}
+	}
+
+	var system, question strings.Builder
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += countTokens(msg.Content)
+		switch msg.Role {
+		case "system":
+			system.WriteString(msg.Content)
+		case "user":
+			question.Reset()
+			question.WriteString(msg.Content) // 只回应最后一条用户消息
+		}
+	}
+
+	answer := mockAnswer(req.Model, system.String(), question.String())
+	if req.ResponseFormat != nil && (req.ResponseFormat.Type == "json_schema" || req.ResponseFormat.Type == "json_object") {
+		answer = mockStructuredAnswer(answer, system.String())
+	}
+	u := usage{PromptTokens: promptTokens, CompletionTokens: countTokens(answer)}
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	id := fmt.Sprintf("chatcmpl-mock-%08x", hashString(question.String()))
+
+	if req.Stream {
+		s.streamChat(w, id, req.Model, answer, u, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": 0,
+		"model":   req.Model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       map[string]string{"role": "assistant", "content": answer},
+			"finish_reason": "stop",
+		}},
+		"usage": u,
+	})
+}
+
+// streamChat 以 SSE 形式逐词返回回答
+func (s *server) streamChat(w http.ResponseWriter, id, model, answer string, u usage, includeUsage bool) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(payload interface{}) {
+		data, _ := json.Marshal(payload)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	chunk := func(delta map[string]string, finish interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finish,
+			}},
+		}
+	}
+
+	send(chunk(map[string]string{"role": "assistant"}, nil))
+	for _, piece := range splitKeepSpaces(answer) {
+		if s.opts.StreamDelay > 0 {
+			time.Sleep(s.opts.StreamDelay)
+		}
+		send(chunk(map[string]string{"content": piece}, nil))
+	}
+	send(chunk(map[string]string{}, "stop"))
+	if includeUsage {
+		send(map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   model,
+			"choices": []interface{}{},
+			"usage":   u,
+		})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// handleEmbeddings 处理 POST /v1/embeddings
+func (s *server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	var req embeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+		return
+	}
+	var inputs []string
+	if err := json.Unmarshal(req.Input, &inputs); err != nil {
+		var single string
+		if err := json.Unmarshal(req.Input, &single); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "input must be a string or an array of strings")
+			return
+		}
+		inputs = []string{single}
+	}
+	if len(inputs) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "input must not be empty")
+		return
+	}
+	if req.Model == "" {
+		req.Model = "mock-embedding"
+	}
+	dims := req.Dimensions
+	if dims <= 0 {
+		dims = s.opts.Dimensions
+	}
+
+	data := make([]map[string]interface{}, len(inputs))
+	promptTokens := 0
+	for i, text := range inputs {
+		promptTokens += countTokens(text)
+		data[i] = map[string]interface{}{
+			"object":    "embedding",
+			"index":     i,
+			"embedding": Embed(text, dims),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  req.Model,
+		"usage":  usage{PromptTokens: promptTokens, TotalTokens: promptTokens},
+	})
+}
+
+// Embed 计算文本的确定性向量：把词（CJK 按单字）哈希到各维度后归一化。
+// 词汇重叠越多的文本余弦相似度越高，足以让检索流程产生有意义的排序
+func Embed(text string, dims int) []float32 {
+	vec := make([]float64, dims)
+	for _, token := range tokenize(text) {
+		h := hashString(token)
+		sign := 1.0
+		if h&1 == 1 {
+			sign = -1.0
+		}
+		vec[(h>>1)%uint32(dims)] += sign
+	}
+
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	out := make([]float32, dims)
+	if norm == 0 {
+		out[0] = 1 // 空文本返回固定的单位向量，避免零向量
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, v := range vec {
+		out[i] = float32(v / norm)
+	}
+	return out
+}
+
+// mockAnswer 生成确定性的回答：回显问题，并在系统提示词带有参考资料时引用第一段
+func mockAnswer(model, system, question string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Mock answer from %s.\n\n", model)
+	fmt.Fprintf(&b, "Question: %s\n\n", strings.TrimSpace(question))
+	if idx := strings.Index(system, "相关信息片段 1:"); idx >= 0 {
+		snippet := []rune(strings.TrimSpace(system[idx+len("相关信息片段 1:"):]))
+		if len(snippet) > 80 {
+			snippet = snippet[:80]
+		}
+		fmt.Fprintf(&b, "Context: %s\n\n", string(snippet))
+	}
+	fmt.Fprintf(&b, "System prompt: %d characters.", len([]rune(system)))
+	return b.String()
+}
+
+// mockStructuredAnswer 按知识库结构化回答的格式包装回答：有参考资料时引用第 1 个片段
+func mockStructuredAnswer(answer, system string) string {
+	structured := map[string]interface{}{
+		"answer":     answer,
+		"confidence": 0.2,
+		"citations":  []int{},
+	}
+	if strings.Contains(system, "相关信息片段 1:") {
+		structured["confidence"] = 0.8
+		structured["citations"] = []int{1}
+	}
+	data, _ := json.Marshal(structured)
+	return string(data)
+}
+
+// tokenize 将文本切分为小写单词，CJK 字符各自成词
+func tokenize(text string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// countTokens 粗略估算 token 数，用于模拟 usage
+func countTokens(text string) int {
+	return len(tokenize(text))
+}
+
+// splitKeepSpaces 按空白切分文本，保留分隔符，使拼接结果与原文一致
+func splitKeepSpaces(text string) []string {
+	var pieces []string
+	start := 0
+	runes := []rune(text)
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsSpace(runes[i-1]) && !unicode.IsSpace(runes[i]) {
+			pieces = append(pieces, string(runes[start:i]))
+			start = i
+		}
+	}
+	if start < len(runes) {
+		pieces = append(pieces, string(runes[start:]))
+	}
+	return pieces
+}
+
+// hashString FNV-1a 哈希
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// writeJSON 写入 JSON 响应
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError 写入 OpenAI 格式的错误响应
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// SessionAssistant 对应数据库中的 session_assistants 表：会话自定义的一路建议（如简短口播稿、反方观点、翻译），
+// 与内置的通用建议、知识库回答并行生成
+type SessionAssistant struct {
+	ID        int                `json:"id"`
+	SessionID string             `json:"sessionId"`
+	Name      string             `json:"name"`   // 会话内唯一，显示在建议标题上
+	Prompt    string             `json:"prompt"` // 系统提示词模板；useKb 时必须引用 {{.Context}}
+	UseKB     bool               `json:"useKb"`  // 是否先检索知识库，把参考资料传给提示词
+	Params    GenerationSettings `json:"params"` // 模型与生成参数，为空的字段使用全局默认值
+	Position  int                `json:"position"`
+	Enabled   bool               `json:"enabled"` // 停用的助手不再为新问题生成建议
+	CreatedAt time.Time          `json:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt"`
+}
+
+// AssistantAnswer 对应数据库中的 question_assistant_answers 表：某个助手为某个问题生成的建议
+type AssistantAnswer struct {
+	AssistantID int       `json:"assistantId"`
+	Name        string    `json:"name"` // 生成时的助手名称，助手改名或删除后保持不变
+	Content     string    `json:"content"`
+	Model       string    `json:"model"`  // 实际生成建议的模型
+	Status      string    `json:"status"` // done、failed 或 no_match
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// 助手建议的状态
+const (
+	AssistantAnswerDone   = "done"   // 生成成功
+	AssistantAnswerFailed = "failed" // 生成失败，content 为空
+
+	// 使用知识库但没有检索到相关内容，不调用模型，content 为空
+	AssistantAnswerNoMatch = "no_match"
+)
@@ -4,8 +4,65 @@ import "time"
 
 // SessionPrompt 对应数据库中的 session_prompts 表
 type SessionPrompt struct {
+	SessionID     string              `json:"sessionId" db:"session_id"`
+	GenericPrompt *string             `json:"genericPrompt" db:"generic_prompt"` // 使用指针以区分 NULL 和空字符串
+	KbPrompt      *string             `json:"kbPrompt" db:"kb_prompt"`           // 使用指针
+	GenericParams *GenerationSettings `json:"genericParams"`                     // 通用建议的生成参数；请求中省略时保持不变
+	KbParams      *GenerationSettings `json:"kbParams"`                          // 知识库回答的生成参数
+	PresetID      *int                `json:"presetId" db:"preset_id"`           // 引用的提示词预设，会话未自定义的提示词使用预设内容
+	PresetName    string              `json:"presetName,omitempty"`              // 引用的预设名称，仅响应使用
+	GenericSource string              `json:"genericSource,omitempty"`           // genericPrompt 的来源：session、preset 或 default，仅响应使用
+	KbSource      string              `json:"kbSource,omitempty"`                // kbPrompt 的来源，仅响应使用
+	Version       int                 `json:"version" db:"prompt_version"`       // 当前生效的提示词版本，0 表示从未保存过
+	Author        string              `json:"author,omitempty" db:"-"`           // 保存时记录到版本历史的作者名称，仅请求使用
+	UpdatedAt     time.Time           `json:"updatedAt" db:"updated_at"`
+}
+
+// PromptVersion 对应数据库中的 prompt_versions 表，每次修改提示词都会保存一个版本
+type PromptVersion struct {
 	SessionID     string    `json:"sessionId" db:"session_id"`
-	GenericPrompt *string   `json:"genericPrompt" db:"generic_prompt"` // 使用指针以区分 NULL 和空字符串
-	KbPrompt      *string   `json:"kbPrompt" db:"kb_prompt"`           // 使用指针
+	Version       int       `json:"version" db:"version"` // 会话内从 1 开始递增
+	GenericPrompt *string   `json:"genericPrompt" db:"generic_prompt"`
+	KbPrompt      *string   `json:"kbPrompt" db:"kb_prompt"`
+	PresetID      *int      `json:"presetId" db:"preset_id"` // 该版本引用的提示词预设
+	Author        string    `json:"author" db:"author"`
+	Source        string    `json:"source" db:"source"`              // update 或 restore
+	RestoredFrom  *int      `json:"restoredFrom" db:"restored_from"` // 回滚产生的版本记录来源版本号
+	Current       bool      `json:"current"`                         // 是否为当前生效的版本
+	CreatedAt     time.Time `json:"createdAt" db:"created_at"`
+}
+
+// 提示词版本的来源
+const (
+	PromptVersionSourceUpdate  = "update"  // 演讲者保存提示词
+	PromptVersionSourceRestore = "restore" // 回滚到历史版本
+	PromptVersionSourcePreset  = "preset"  // 引用的预设被修改，内容不变但实际生效的提示词已变化
+)
+
+// PromptPreset 对应数据库中的 prompt_presets 表：可被多个会话引用的命名提示词
+type PromptPreset struct {
+	ID            int       `json:"id" db:"id"`
+	Name          string    `json:"name" db:"name"` // 全局唯一
+	Description   string    `json:"description" db:"description"`
+	GenericPrompt *string   `json:"genericPrompt" db:"generic_prompt"` // 为空时引用该预设的会话使用系统默认提示词
+	KbPrompt      *string   `json:"kbPrompt" db:"kb_prompt"`
+	CreatedBy     string    `json:"createdBy" db:"created_by"`
+	SessionCount  int       `json:"sessionCount"` // 引用该预设的会话数，仅响应使用
+	CreatedAt     time.Time `json:"createdAt" db:"created_at"`
 	UpdatedAt     time.Time `json:"updatedAt" db:"updated_at"`
 }
+
+// 会话实际使用的提示词来源，按优先级排列
+const (
+	PromptSourceSession = "session" // 会话自定义的提示词
+	PromptSourcePreset  = "preset"  // 会话引用的预设
+	PromptSourceDefault = "default" // 配置中的默认提示词
+)
+
+// GenerationSettings 会话级的模型与生成参数，字段为 nil 表示使用全局默认值
+type GenerationSettings struct {
+	Model       *string  `json:"model"`
+	Temperature *float64 `json:"temperature"`
+	MaxTokens   *int     `json:"maxTokens"`
+	TopP        *float64 `json:"topP"`
+}
@@ -4,11 +4,63 @@ import "time"
 
 // Question 对应数据库中的 questions 表
 type Question struct {
-	ID           int       `json:"id"`
-	SessionID    string    `json:"sessionId"`
-	Content      string    `json:"content"`
-	Status       string    `json:"status"` // 'pending', 'showing', 'answered', 'finished'
-	AiSuggestion string    `json:"aiSuggestion"`
-	KbSuggestion string    `json:"kbSuggestion"` // 新增：知识库回答建议
-	CreatedAt    time.Time `json:"createdAt"`
+	ID             int               `json:"id"`
+	SessionID      string            `json:"sessionId"`
+	Content        string            `json:"content"`
+	Status         string            `json:"status"` // 'pending', 'showing', 'answered', 'finished'
+	AiSuggestion   string            `json:"aiSuggestion"`
+	KbSuggestion   string            `json:"kbSuggestion"`   // 新增：知识库回答建议
+	KbConfidence   *float64          `json:"kbConfidence"`   // 知识库回答的置信度（0-1），非结构化回答时为空
+	KbCitations    []Citation        `json:"kbCitations"`    // 知识库回答引用的文档块
+	AiModel        string            `json:"aiModel"`        // 实际生成通用建议的模型（可能是备用模型）
+	KbModel        string            `json:"kbModel"`        // 实际生成知识库回答的模型
+	PromptVersion  *int              `json:"promptVersion"`  // 提问时生效的提示词版本，为空表示使用系统默认提示词
+	BudgetExceeded bool              `json:"budgetExceeded"` // 会话预算已用完，未生成建议
+	KbNoMatch      bool              `json:"kbNoMatch"`      // 知识库中没有达到相似度阈值的内容，未生成知识库回答
+	Assistants     []AssistantAnswer `json:"assistants"`     // 会话自定义助手生成的建议
+	CreatedAt      time.Time         `json:"createdAt"`
+}
+
+// Citation 知识库回答引用的一个文档块，对应 question_citations 表
+type Citation struct {
+	ChunkID       int    `json:"chunkId"`
+	DocumentID    int    `json:"documentId"`
+	DocumentTitle string `json:"documentTitle"`
+	ChunkIndex    int    `json:"chunkIndex"`
+	Excerpt       string `json:"excerpt"` // 文档块内容的开头部分
+}
+
+// 问题状态
+const (
+	QuestionStatusPending  = "pending"  // 等待处理
+	QuestionStatusShowing  = "showing"  // 正在大屏展示（每个会话最多一个）
+	QuestionStatusAnswered = "answered" // 已回答
+	QuestionStatusFinished = "finished" // 已结束
+)
+
+// questionTransitions 允许的状态迁移：当前状态 -> 可迁移到的状态
+var questionTransitions = map[string][]string{
+	QuestionStatusPending:  {QuestionStatusShowing, QuestionStatusAnswered, QuestionStatusFinished},
+	QuestionStatusShowing:  {QuestionStatusPending, QuestionStatusAnswered, QuestionStatusFinished},
+	QuestionStatusAnswered: {QuestionStatusShowing, QuestionStatusFinished},
+	QuestionStatusFinished: {QuestionStatusPending, QuestionStatusShowing}, // 展示其他问题时被替换下来的问题可以重新展示
+}
+
+// IsValidQuestionStatus 判断 status 是否为已知的问题状态
+func IsValidQuestionStatus(status string) bool {
+	_, ok := questionTransitions[status]
+	return ok
+}
+
+// CanTransitionQuestion 判断问题能否从 from 迁移到 to；相同状态视为允许（幂等）
+func CanTransitionQuestion(from, to string) bool {
+	if from == to {
+		return IsValidQuestionStatus(to)
+	}
+	for _, next := range questionTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
 }
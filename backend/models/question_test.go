@@ -0,0 +1,53 @@
+package models
+
+import "testing"
+
+func TestCanTransitionQuestion(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{QuestionStatusPending, QuestionStatusPending, true},
+		{QuestionStatusPending, QuestionStatusShowing, true},
+		{QuestionStatusPending, QuestionStatusAnswered, true},
+		{QuestionStatusPending, QuestionStatusFinished, true},
+
+		{QuestionStatusShowing, QuestionStatusPending, true},
+		{QuestionStatusShowing, QuestionStatusShowing, true},
+		{QuestionStatusShowing, QuestionStatusAnswered, true},
+		{QuestionStatusShowing, QuestionStatusFinished, true},
+
+		{QuestionStatusAnswered, QuestionStatusPending, false},
+		{QuestionStatusAnswered, QuestionStatusShowing, true},
+		{QuestionStatusAnswered, QuestionStatusAnswered, true},
+		{QuestionStatusAnswered, QuestionStatusFinished, true},
+
+		{QuestionStatusFinished, QuestionStatusPending, true},
+		{QuestionStatusFinished, QuestionStatusShowing, true},
+		{QuestionStatusFinished, QuestionStatusAnswered, false},
+		{QuestionStatusFinished, QuestionStatusFinished, true},
+
+		{"", QuestionStatusShowing, false},
+		{"archived", QuestionStatusPending, false},
+		{QuestionStatusPending, "archived", false},
+		{"archived", "archived", false},
+	}
+	for _, tt := range tests {
+		if got := CanTransitionQuestion(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransitionQuestion(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidQuestionStatus(t *testing.T) {
+	for _, status := range []string{QuestionStatusPending, QuestionStatusShowing, QuestionStatusAnswered, QuestionStatusFinished} {
+		if !IsValidQuestionStatus(status) {
+			t.Errorf("IsValidQuestionStatus(%q) = false", status)
+		}
+	}
+	for _, status := range []string{"", "archived", "Showing"} {
+		if IsValidQuestionStatus(status) {
+			t.Errorf("IsValidQuestionStatus(%q) = true", status)
+		}
+	}
+}
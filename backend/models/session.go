@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// 会话状态
+const (
+	SessionStatusActive = "active" // 进行中
+	SessionStatusClosed = "closed" // 已关闭，不再接受任何写入
+)
+
+// Session 对应数据库中的 sessions 表
+type Session struct {
+	ID                 string     `json:"id"`
+	Title              string     `json:"title"`
+	Owner              string     `json:"owner"`
+	StartsAt           *time.Time `json:"startsAt"` // 使用指针以区分未设置
+	EndsAt             *time.Time `json:"endsAt"`
+	AcceptingQuestions bool       `json:"acceptingQuestions"` // 是否接受观众提问
+	Status             string     `json:"status"`             // 'active', 'closed'
+	CreatedAt          time.Time  `json:"createdAt"`
+	UpdatedAt          time.Time  `json:"updatedAt"`
+	ClosedAt           *time.Time `json:"closedAt"`
+
+	// AI 花费预算，均为可选；任意一项用完即视为超出预算
+	BudgetTokens        *int64   `json:"budgetTokens"`        // token 上限
+	BudgetUSD           *float64 `json:"budgetUsd"`           // 费用上限（美元）
+	BudgetFallbackModel string   `json:"budgetFallbackModel"` // 超出预算后改用的便宜模型，为空则停止生成
+
+	// 知识库检索设置，均为可选，为空时使用对应的全局配置
+	RetrievalLexicalWeight    *float64 `json:"retrievalLexicalWeight"`    // 关键词检索（BM25）的权重，0-1，默认 RETRIEVAL_LEXICAL_WEIGHT
+	RetrievalTopK             *int     `json:"retrievalTopK"`             // 最多检索的文档块数，默认 RETRIEVAL_TOP_K
+	RetrievalMinSimilarity    *float64 `json:"retrievalMinSimilarity"`    // 最低余弦相似度，默认 RETRIEVAL_MIN_SIMILARITY
+	RetrievalMaxContextTokens *int     `json:"retrievalMaxContextTokens"` // 参考资料的最大 token 数，默认 RETRIEVAL_MAX_CONTEXT_TOKENS
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// 模型调用类型
+const (
+	AIUsageKindChat      = "chat"      // 聊天补全
+	AIUsageKindEmbedding = "embedding" // 文本向量
+)
+
+// 模型调用用途，用于账单明细
+const (
+	AIUsagePurposeGeneric  = "generic"  // 通用 AI 建议
+	AIUsagePurposeKB       = "kb"       // 知识库回答
+	AIUsagePurposeQuery    = "query"    // 问题向量化（检索）
+	AIUsagePurposeDocument = "document" // 文档向量化
+)
+
+// AIUsage 对应数据库中的 ai_usage 表，每次模型调用一条记录
+type AIUsage struct {
+	ID               int64     `json:"id"`
+	SessionID        string    `json:"sessionId"`
+	QuestionID       *int64    `json:"questionId,omitempty"`
+	DocumentID       *int      `json:"documentId,omitempty"`
+	Kind             string    `json:"kind"`
+	Purpose          string    `json:"purpose"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	TotalTokens      int       `json:"totalTokens"`
+	LatencyMs        int64     `json:"latencyMs"`
+	CostUSD          float64   `json:"costUsd"` // 按调用时的价格表计算
+	Success          bool      `json:"success"`
+	Error            string    `json:"error,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// UsageSummary 用量报表中的一行汇总
+type UsageSummary struct {
+	SessionID        string  `json:"sessionId,omitempty"`
+	Owner            string  `json:"owner,omitempty"`
+	Day              string  `json:"day,omitempty"` // YYYY-MM-DD
+	Kind             string  `json:"kind,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Calls            int     `json:"calls"`
+	FailedCalls      int     `json:"failedCalls"`
+	PromptTokens     int64   `json:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	CostUSD          float64 `json:"costUsd"`
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// AIClient 封装了提示词组装以及与聊天、向量提供方的交互
+type AIClient struct {
+	chat     ChatProvider
+	embedder EmbeddingProvider
+	prices   PriceTable
+	model    string // 覆盖聊天提供方的默认模型，为空时使用默认模型
+
+	// 按用途（generic / kb）配置的备用模型，主模型超时、限流或 5xx 时依次尝试
+	fallbacks map[string][]chatTarget
+
+	// 用量记账：db 为 nil 时不记录
+	db    *sql.DB
+	scope UsageScope
+
+	budget *config.Config // 不为 nil 时每次调用聊天模型前重新检查 scope 所属会话的预算
+
+	prompts map[string]string // 按类型（generic / kb）覆盖会话的提示词模板，用于试运行
+	trace   *GenerationTrace  // 不为 nil 时记录实际发送的提示词和用量
+}
+
+// NewAIClient 根据配置创建一个新的 AIClient 实例
+func NewAIClient(cfg *config.Config) (*AIClient, error) {
+	chat, err := NewChatProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	embedder, err := NewEmbeddingProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fallbacks, err := loadFallbackChains(cfg, chat)
+	if err != nil {
+		return nil, err
+	}
+	return &AIClient{chat: chat, embedder: embedder, prices: GetPriceTable(cfg), fallbacks: fallbacks}, nil
+}
+
+// WithUsage 返回一个把每次调用的用量记到 scope 名下的客户端副本
+func (client *AIClient) WithUsage(db *sql.DB, scope UsageScope) *AIClient {
+	scoped := *client
+	scoped.db = db
+	scoped.scope = scope
+	return &scoped
+}
+
+// WithBudget 返回一个在每次调用聊天模型前重新检查会话预算的客户端副本（需要先调用 WithUsage）。
+// 同一会话的多个问题并行生成时，开始生成前的检查可能都还没超出预算，逐次检查可以减少超支
+func (client *AIClient) WithBudget(cfg *config.Config) *AIClient {
+	scoped := *client
+	scoped.budget = cfg
+	return &scoped
+}
+
+// checkBudget 重新检查会话预算：超出预算时返回会话的便宜模型，未配置便宜模型时返回 ErrBudgetExceeded；
+// 未开启检查或查询失败时返回空字符串，按原模型继续
+func (client *AIClient) checkBudget() (string, error) {
+	if client.budget == nil || client.db == nil || client.scope.SessionID == "" {
+		return "", nil
+	}
+	status, err := GetSessionBudgetStatus(client.db, client.budget, client.scope.SessionID)
+	if err != nil {
+		fmt.Printf("查询会话 %s 预算失败，继续调用模型: %v\n", client.scope.SessionID, err)
+		return "", nil
+	}
+	if !status.Exceeded {
+		return "", nil
+	}
+	NotifyBudget(client.db, status)
+	if status.FallbackModel == "" {
+		return "", ErrBudgetExceeded
+	}
+	return status.FallbackModel, nil
+}
+
+// WithModel 返回一个使用指定聊天模型的客户端副本
+func (client *AIClient) WithModel(model string) *AIClient {
+	scoped := *client
+	scoped.model = model
+	return &scoped
+}
+
+// WithPrompt 返回一个使用指定提示词模板（而不是会话保存的提示词）的客户端副本，text 为空时不覆盖
+func (client *AIClient) WithPrompt(promptType string, text string) *AIClient {
+	scoped := *client
+	scoped.prompts = make(map[string]string, len(client.prompts)+1)
+	for k, v := range client.prompts {
+		scoped.prompts[k] = v
+	}
+	scoped.prompts[promptType] = text
+	return &scoped
+}
+
+// WithTrace 返回一个把实际发送的系统提示词、模型和用量记录到 trace 的客户端副本
+func (client *AIClient) WithTrace(trace *GenerationTrace) *AIClient {
+	scoped := *client
+	scoped.trace = trace
+	return &scoped
+}
+
+// promptTemplate 返回某类提示词的模板：WithPrompt 指定的优先，否则使用会话实际生效的提示词
+func (client *AIClient) promptTemplate(db *sql.DB, sessionId string, promptType string, defaultValue string) string {
+	if text := client.prompts[promptType]; strings.TrimSpace(text) != "" {
+		return text
+	}
+	return getSessionPromptOrDefault(db, sessionId, promptType, defaultValue)
+}
+
+// recordUsage 记录一次调用的用量和费用
+func (client *AIClient) recordUsage(kind, purpose, provider, model string, usage UsageData, latency time.Duration, callErr error) {
+	if client.db == nil {
+		return
+	}
+	u := newUsageRecord(client.scope, kind, purpose, provider, model, usage, latency, callErr)
+	u.CostUSD = client.prices.Cost(model, usage)
+	RecordUsage(client.db, u)
+}
+
+// GetEmbeddings 获取一批文本的嵌入向量
+func (client *AIClient) GetEmbeddings(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("input texts cannot be empty")
+	}
+
+	start := time.Now()
+	result, err := client.embedder.Embed(ctx, texts)
+	purpose := models.AIUsagePurposeQuery
+	if client.scope.DocumentID > 0 {
+		purpose = models.AIUsagePurposeDocument
+	}
+	if err != nil {
+		client.recordUsage(models.AIUsageKindEmbedding, purpose, client.embedder.Name(), "", UsageData{}, time.Since(start), err)
+		return nil, err
+	}
+	client.recordUsage(models.AIUsageKindEmbedding, purpose, client.embedder.Name(), result.Model, result.Usage, time.Since(start), nil)
+	for i, emb := range result.Embeddings {
+		if len(emb) == 0 {
+			fmt.Printf("Warning: Received empty embedding for input index %d\n", i)
+		}
+	}
+
+	fmt.Printf("Successfully retrieved %d embeddings from %s using model %s. Usage: %d prompt tokens, %d total tokens.\n",
+		len(result.Embeddings), client.embedder.Name(), result.Model, result.Usage.PromptTokens, result.Usage.TotalTokens)
+	return result.Embeddings, nil
+}
+
+// EmbedQuestion 获取单个问题的嵌入向量，返回空向量时视为失败
+func (client *AIClient) EmbedQuestion(ctx context.Context, question string) ([]float32, error) {
+	embeddings, err := client.GetEmbeddings(ctx, []string{question})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 || len(embeddings[0]) == 0 {
+		return nil, fmt.Errorf("received empty embedding for question")
+	}
+	return embeddings[0], nil
+}
+
+// StreamGenericAnswer 生成通用建议，返回的结果中包含实际回答的模型
+func (client *AIClient) StreamGenericAnswer(ctx context.Context, db *sql.DB, cfg *config.Config, sessionId string, question string, onDelta StreamHandler) (*ChatResult, error) {
+	promptTemplate := client.promptTemplate(db, sessionId, "generic", cfg.GenericSystemPrompt)
+	systemPrompt := RenderPrompt("generic", promptTemplate, newPromptVars(db, sessionId, question, ""))
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: question},
+	}
+	return client.complete(ctx, messages, "Generic", models.AIUsagePurposeGeneric, loadGenerationSettings(db, sessionId, "generic"), nil, onDelta)
+}
+
+// complete 调用聊天提供方并记录用量
+// 模型优先级：WithModel 指定的模型（如超出预算后的便宜模型）> 会话设置 > 提供方默认模型
+// format 为 nil 时模型自由输出文本。
+// 主模型超时、限流、5xx 或熔断时依次尝试该用途的备用模型；已经开始流式输出后不再切换，
+// 避免演讲者看到两段拼接的回答。WithModel 指定了模型（预算超限）时不使用备用模型，以免花费失控。
+// ctx 取消（问题被删除、会话关闭或服务停机）后不再尝试备用模型。
+// WithBudget 开启时先重新检查预算，超出后同样改用便宜模型，或返回 ErrBudgetExceeded
+func (client *AIClient) complete(ctx context.Context, messages []ChatMessage, label string, purpose string, settings models.GenerationSettings, format *ResponseFormat, onDelta StreamHandler) (*ChatResult, error) {
+	forced := client.model
+	budgetModel, err := client.checkBudget()
+	if err != nil {
+		return nil, err
+	}
+	if budgetModel != "" {
+		forced = budgetModel
+	}
+
+	primary := chatTarget{provider: client.chat, model: forced}
+	if primary.model == "" && settings.Model != nil {
+		primary.model = *settings.Model
+	}
+	targets := []chatTarget{primary}
+	if forced == "" {
+		targets = append(targets, client.fallbacks[purpose]...)
+	}
+
+	var lastErr error
+	for i, target := range targets {
+		req := ChatRequest{
+			Messages:       messages,
+			Model:          target.model,
+			Temperature:    settings.Temperature,
+			MaxTokens:      settings.MaxTokens,
+			TopP:           settings.TopP,
+			ResponseFormat: format,
+		}
+		streamed := false
+		var handler StreamHandler
+		if onDelta != nil {
+			handler = func(delta string) {
+				streamed = true
+				onDelta(delta)
+			}
+		}
+
+		start := time.Now()
+		result, err := target.provider.Chat(ctx, req, handler)
+		latency := time.Since(start)
+		client.trace.record(client.prices, messages, target, result, latency)
+		if err == nil {
+			client.recordUsage(models.AIUsageKindChat, purpose, target.provider.Name(), result.Model, result.Usage, latency, nil)
+			if i > 0 {
+				fmt.Printf("%s 使用备用模型 %s/%s 生成成功。\n", label, target.provider.Name(), result.Model)
+			}
+			fmt.Printf("%s chat completion successful (%s, model %s). Usage: %d prompt tokens, %d total tokens.\n",
+				label, target.provider.Name(), result.Model, result.Usage.PromptTokens, result.Usage.TotalTokens)
+			return result, nil
+		}
+
+		// 流式请求中途失败时已消耗的 token 同样计入
+		var model string
+		var usage UsageData
+		if result != nil {
+			model, usage = result.Model, result.Usage
+		}
+		if model == "" {
+			model = target.model
+		}
+		client.recordUsage(models.AIUsageKindChat, purpose, target.provider.Name(), model, usage, latency, err)
+		lastErr = err
+
+		if i+1 >= len(targets) || streamed || ctx.Err() != nil || !shouldFallback(err) {
+			break
+		}
+		fmt.Printf("%s 模型 %s 请求失败，改用备用模型 %s: %v\n", label, target, targets[i+1], err)
+	}
+	return nil, lastErr
+}
+
+// getSessionPromptOrDefault 获取会话实际使用的某类提示词：会话自定义 → 引用的预设 → defaultValue
+func getSessionPromptOrDefault(db *sql.DB, sessionId string, promptType string, defaultValue string) string {
+	var query string
+	switch promptType {
+	case "generic":
+		query = `SELECT sp.generic_prompt, p.generic_prompt FROM session_prompts sp LEFT JOIN prompt_presets p ON p.id = sp.preset_id WHERE sp.session_id = ?`
+	case "kb":
+		query = `SELECT sp.kb_prompt, p.kb_prompt FROM session_prompts sp LEFT JOIN prompt_presets p ON p.id = sp.preset_id WHERE sp.session_id = ?`
+	default:
+		fmt.Printf("警告：无效的提示词类型 '%s'，将使用默认值。\n", promptType)
+		return defaultValue
+	}
+
+	var sessionValue, presetValue sql.NullString
+	err := db.QueryRow(query, sessionId).Scan(&sessionValue, &presetValue)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Printf("警告：查询会话 %s 的 %s 提示词失败: %v。将使用默认值。\n", sessionId, promptType, err)
+		}
+		return defaultValue
+	}
+
+	prompt, source := pickPrompt(sessionValue, presetValue, defaultValue)
+	switch source {
+	case models.PromptSourceSession:
+		fmt.Printf("会话 %s 使用自定义 %s 提示词。\n", sessionId, promptType)
+	case models.PromptSourcePreset:
+		fmt.Printf("会话 %s 使用预设的 %s 提示词。\n", sessionId, promptType)
+	}
+	return prompt
+}
+
+// GetSessionGenerationSettings 读取会话为通用建议和知识库回答分别设置的生成参数
+// 会话没有设置时返回两个空的 GenerationSettings
+func GetSessionGenerationSettings(db *sql.DB, sessionId string) (generic, kb models.GenerationSettings, err error) {
+	var genericModel, kbModel sql.NullString
+	var genericTemp, genericTopP, kbTemp, kbTopP sql.NullFloat64
+	var genericMax, kbMax sql.NullInt64
+	err = db.QueryRow(`SELECT generic_model, generic_temperature, generic_max_tokens, generic_top_p,
+		kb_model, kb_temperature, kb_max_tokens, kb_top_p
+		FROM session_prompts WHERE session_id = ?`, sessionId).Scan(
+		&genericModel, &genericTemp, &genericMax, &genericTopP,
+		&kbModel, &kbTemp, &kbMax, &kbTopP)
+	if err == sql.ErrNoRows {
+		return generic, kb, nil
+	}
+	if err != nil {
+		return generic, kb, fmt.Errorf("failed to query session generation settings: %w", err)
+	}
+	return toGenerationSettings(genericModel, genericTemp, genericMax, genericTopP),
+		toGenerationSettings(kbModel, kbTemp, kbMax, kbTopP), nil
+}
+
+// toGenerationSettings 将可为 NULL 的列转换为 GenerationSettings
+func toGenerationSettings(model sql.NullString, temperature sql.NullFloat64, maxTokens sql.NullInt64, topP sql.NullFloat64) models.GenerationSettings {
+	var settings models.GenerationSettings
+	if model.Valid && strings.TrimSpace(model.String) != "" {
+		settings.Model = &model.String
+	}
+	if temperature.Valid {
+		settings.Temperature = &temperature.Float64
+	}
+	if maxTokens.Valid {
+		n := int(maxTokens.Int64)
+		settings.MaxTokens = &n
+	}
+	if topP.Valid {
+		settings.TopP = &topP.Float64
+	}
+	return settings
+}
+
+// loadGenerationSettings 获取某类回答的会话生成参数，查询失败时使用全局默认值
+func loadGenerationSettings(db *sql.DB, sessionId string, promptType string) models.GenerationSettings {
+	generic, kb, err := GetSessionGenerationSettings(db, sessionId)
+	if err != nil {
+		fmt.Printf("警告：查询会话 %s 的生成参数失败: %v。将使用默认值。\n", sessionId, err)
+		return models.GenerationSettings{}
+	}
+	if promptType == "kb" {
+		return kb
+	}
+	return generic
+}
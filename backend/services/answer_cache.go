@@ -0,0 +1,193 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// CachedAnswer 一条已生成的建议，可被语义相近的问题复用
+type CachedAnswer struct {
+	QuestionID   int64
+	Question     string
+	Embedding    []float32
+	AISuggestion string
+	AIModel      string                   // 生成通用建议的模型
+	KBSuggestion string                   // 为空表示当时知识库没有检索到内容
+	KBNoMatch    bool                     // 知识库中没有达到相似度阈值的内容，未生成知识库回答
+	KBConfidence *float64                 // 知识库回答的置信度
+	KBChunkIDs   []int                    // 知识库回答引用的文档块
+	KBModel      string                   // 生成知识库回答的模型
+	Assistants   []models.AssistantAnswer // 会话自定义助手生成的建议
+	Fingerprint  string                   // 生成时的提示词与文档集指纹
+	CreatedAt    time.Time
+}
+
+// AnswerCache 按会话存放已生成建议的语义缓存
+type AnswerCache struct {
+	mu         sync.Mutex
+	sessions   map[string][]*CachedAnswer
+	ttl        time.Duration
+	maxEntries int // 每个会话最多缓存的条目数，超出时淘汰最旧的
+}
+
+var (
+	globalAnswerCache *AnswerCache
+	answerCacheOnce   sync.Once
+)
+
+// GetAnswerCache 获取全局语义回答缓存实例
+func GetAnswerCache() *AnswerCache {
+	answerCacheOnce.Do(func() {
+		globalAnswerCache = &AnswerCache{
+			sessions:   make(map[string][]*CachedAnswer),
+			ttl:        2 * time.Hour,
+			maxEntries: 500,
+		}
+	})
+	return globalAnswerCache
+}
+
+// Lookup 查找与问题向量最相似且指纹一致的缓存条目，相似度低于 threshold 时返回 nil
+func (ac *AnswerCache) Lookup(sessionId string, fingerprint string, embedding []float32, threshold float64) (*CachedAnswer, float64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	var best *CachedAnswer
+	bestScore := threshold
+	live := ac.sessions[sessionId][:0]
+	for _, entry := range ac.sessions[sessionId] {
+		// 顺便清理过期或指纹已变化的条目
+		if time.Since(entry.CreatedAt) > ac.ttl || entry.Fingerprint != fingerprint {
+			continue
+		}
+		live = append(live, entry)
+		score, err := cosineSimilarity(embedding, entry.Embedding)
+		if err != nil {
+			continue
+		}
+		if score >= bestScore {
+			best, bestScore = entry, score
+		}
+	}
+	ac.sessions[sessionId] = live
+	if best == nil {
+		return nil, 0
+	}
+	return best, bestScore
+}
+
+// Store 写入一条缓存
+func (ac *AnswerCache) Store(sessionId string, entry *CachedAnswer) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	entries := append(ac.sessions[sessionId], entry)
+	if len(entries) > ac.maxEntries {
+		entries = entries[len(entries)-ac.maxEntries:]
+	}
+	ac.sessions[sessionId] = entries
+}
+
+// InvalidateSession 清空会话的回答缓存（文档或提示词变更时调用）
+func (ac *AnswerCache) InvalidateSession(sessionId string) {
+	ac.mu.Lock()
+	delete(ac.sessions, sessionId)
+	ac.mu.Unlock()
+	fmt.Printf("回答缓存失效: session %s\n", sessionId)
+}
+
+// GetStats 获取缓存统计信息
+func (ac *AnswerCache) GetStats() map[string]interface{} {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	total := 0
+	for _, entries := range ac.sessions {
+		total += len(entries)
+	}
+	return map[string]interface{}{
+		"sessions":    len(ac.sessions),
+		"entries":     total,
+		"ttl_minutes": ac.ttl.Minutes(),
+	}
+}
+
+// AnswerFingerprint 计算会话当前的提示词、生成参数、助手设置、检索权重与文档集指纹。
+// 任何一项变化后指纹随之变化，旧的缓存条目自然失效
+func AnswerFingerprint(db *sql.DB, cfg *config.Config, sessionId string) (string, error) {
+	h := sha256.New()
+
+	// 使用解析后的提示词，会话引用的预设或默认提示词变化时指纹同样变化
+	prompts, err := ResolveSessionPrompts(db, cfg, sessionId)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "generic:%s\x00kb:%s\x00", prompts.GenericPrompt, prompts.KbPrompt)
+	genericParams, kbParams, err := GetSessionGenerationSettings(db, sessionId)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range []models.GenerationSettings{genericParams, kbParams} {
+		fmt.Fprintf(h, "model:%s\x00temperature:%s\x00max_tokens:%s\x00top_p:%s\x00",
+			derefString(p.Model), derefFloat(p.Temperature), derefInt(p.MaxTokens), derefFloat(p.TopP))
+	}
+
+	// 启用的助手及其设置，增删或修改助手后旧的缓存条目同样失效
+	assistants, err := ListSessionAssistants(db, sessionId, true)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range assistants {
+		p := a.Params
+		fmt.Fprintf(h, "assistant:%d\x00%s\x00%s\x00%t\x00model:%s\x00temperature:%s\x00max_tokens:%s\x00top_p:%s\x00",
+			a.ID, a.Name, a.Prompt, a.UseKB, derefString(p.Model), derefFloat(p.Temperature), derefInt(p.MaxTokens), derefFloat(p.TopP))
+	}
+
+	// 检索设置变化后检索到的文档块可能不同
+	retrieval := SessionRetrievalSettings(db, cfg, sessionId)
+	fmt.Fprintf(h, "lexical_weight:%s\x00top_k:%d\x00min_similarity:%s\x00max_context_tokens:%d\x00",
+		strconv.FormatFloat(retrieval.LexicalWeight, 'g', -1, 64), retrieval.TopK,
+		strconv.FormatFloat(retrieval.MinSimilarity, 'g', -1, 64), retrieval.MaxContextTokens)
+
+	chunks, err := GetVectorCache().GetSessionChunks(db, sessionId)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 8)
+	for _, chunk := range chunks {
+		binary.LittleEndian.PutUint64(buf, uint64(chunk.ID))
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// derefString 把可选参数格式化为指纹中的字符串，nil 为空串
+func derefString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// derefFloat 同 derefString
+func derefFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'g', -1, 64)
+}
+
+// derefInt 同 derefString
+func derefInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// 会话助手相关的错误
+var (
+	ErrAssistantNotFound     = errors.New("assistant not found")
+	ErrAssistantNameTaken    = errors.New("assistant name already exists in this session")
+	ErrAssistantLimitReached = errors.New("session assistant limit reached")
+)
+
+// assistantColumns 查询 session_assistants 表时使用的列，顺序与 scanAssistant 一致
+const assistantColumns = `id, session_id, name, prompt, use_kb, model, temperature, max_tokens, top_p, position, enabled, created_at, updated_at`
+
+// AssistantPromptType 助手提示词按哪类提示词校验和渲染：使用知识库的助手与知识库提示词相同，必须引用 {{.Context}}
+func AssistantPromptType(useKB bool) string {
+	if useKB {
+		return "kb"
+	}
+	return "generic"
+}
+
+// ListSessionAssistants 按 position 列出会话的助手，enabledOnly 为 true 时只返回启用的助手
+func ListSessionAssistants(db *sql.DB, sessionId string, enabledOnly bool) ([]models.SessionAssistant, error) {
+	query := `SELECT ` + assistantColumns + ` FROM session_assistants WHERE session_id = ?`
+	if enabledOnly {
+		query += ` AND enabled = TRUE`
+	}
+	rows, err := db.Query(query+` ORDER BY position, id`, sessionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session assistants: %w", err)
+	}
+	defer rows.Close()
+
+	assistants := []models.SessionAssistant{}
+	for rows.Next() {
+		a, err := scanAssistant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session assistant: %w", err)
+		}
+		assistants = append(assistants, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating session assistants: %w", err)
+	}
+	return assistants, nil
+}
+
+// GetSessionAssistant 读取会话的某个助手，不存在时返回 ErrAssistantNotFound
+func GetSessionAssistant(db *sql.DB, sessionId string, id int) (*models.SessionAssistant, error) {
+	a, err := scanAssistant(db.QueryRow(`SELECT `+assistantColumns+` FROM session_assistants WHERE session_id = ? AND id = ?`, sessionId, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrAssistantNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session assistant: %w", err)
+	}
+	return a, nil
+}
+
+// CreateSessionAssistant 为会话新建助手，返回新助手的 ID。
+// 会话已有 limit 个助手时返回 ErrAssistantLimitReached，名称重复时返回 ErrAssistantNameTaken；
+// 同一会话的并发创建通过 sessions 行锁串行执行，避免超出上限
+func CreateSessionAssistant(db *sql.DB, a *models.SessionAssistant, limit int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var locked string
+	if err := tx.QueryRow(`SELECT id FROM sessions WHERE id = ? FOR UPDATE`, a.SessionID).Scan(&locked); err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to lock session: %w", err)
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM session_assistants WHERE session_id = ?`, a.SessionID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count session assistants: %w", err)
+	}
+	if count >= limit {
+		return 0, ErrAssistantLimitReached
+	}
+
+	p := a.Params
+	result, err := tx.Exec(`INSERT INTO session_assistants (session_id, name, prompt, use_kb, model, temperature, max_tokens, top_p, position, enabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.SessionID, a.Name, a.Prompt, a.UseKB, p.Model, p.Temperature, p.MaxTokens, p.TopP, a.Position, a.Enabled)
+	if isDuplicateKeyError(err) {
+		return 0, ErrAssistantNameTaken
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert session assistant: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read session assistant id: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit session assistant: %w", err)
+	}
+	return int(id), nil
+}
+
+// UpdateSessionAssistant 整体替换助手的设置，之后的新问题使用新设置
+func UpdateSessionAssistant(db *sql.DB, a *models.SessionAssistant) error {
+	p := a.Params
+	result, err := db.Exec(`UPDATE session_assistants SET name = ?, prompt = ?, use_kb = ?, model = ?, temperature = ?, max_tokens = ?, top_p = ?,
+		position = ?, enabled = ?, updated_at = NOW() WHERE session_id = ? AND id = ?`,
+		a.Name, a.Prompt, a.UseKB, p.Model, p.Temperature, p.MaxTokens, p.TopP, a.Position, a.Enabled, a.SessionID, a.ID)
+	if isDuplicateKeyError(err) {
+		return ErrAssistantNameTaken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update session assistant: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 内容未变化时 RowsAffected 也为 0，需要再确认助手是否存在
+		if _, err := GetSessionAssistant(db, a.SessionID, a.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSessionAssistant 删除会话的助手，已生成的建议保留
+func DeleteSessionAssistant(db *sql.DB, sessionId string, id int) error {
+	result, err := db.Exec(`DELETE FROM session_assistants WHERE session_id = ? AND id = ?`, sessionId, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete session assistant: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAssistantNotFound
+	}
+	return nil
+}
+
+// scanAssistant 从一行结果中读取助手，列顺序见 assistantColumns
+func scanAssistant(row interface{ Scan(...interface{}) error }) (*models.SessionAssistant, error) {
+	var a models.SessionAssistant
+	var model sql.NullString
+	var temperature, topP sql.NullFloat64
+	var maxTokens sql.NullInt64
+	if err := row.Scan(&a.ID, &a.SessionID, &a.Name, &a.Prompt, &a.UseKB, &model, &temperature, &maxTokens, &topP,
+		&a.Position, &a.Enabled, &a.CreatedAt, &a.UpdatedAt); err != nil {
+		return nil, err
+	}
+	a.Params = toGenerationSettings(model, temperature, maxTokens, topP)
+	return &a, nil
+}
+
+// SaveAssistantAnswer 保存助手为问题生成的建议，重复保存（如缓存命中后重放）时覆盖
+func SaveAssistantAnswer(db *sql.DB, questionID int64, answer *models.AssistantAnswer) error {
+	_, err := db.Exec(`INSERT INTO question_assistant_answers (question_id, assistant_id, assistant_name, content, model, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE assistant_name = VALUES(assistant_name), content = VALUES(content), model = VALUES(model), status = VALUES(status)`,
+		questionID, answer.AssistantID, answer.Name, answer.Content, answer.Model, answer.Status)
+	if err != nil {
+		return fmt.Errorf("failed to save assistant answer: %w", err)
+	}
+	return nil
+}
+
+// GetSessionAssistantAnswers 一次性读取会话内所有问题的助手建议，按问题 ID 分组，
+// 组内按助手当前的排序排列（已删除的助手排在最后）
+func GetSessionAssistantAnswers(db *sql.DB, sessionId string) (map[int][]models.AssistantAnswer, error) {
+	rows, err := db.Query(`SELECT qa.question_id, qa.assistant_id, qa.assistant_name, COALESCE(qa.content, ''), qa.model, qa.status, qa.created_at
+		FROM question_assistant_answers qa
+		JOIN questions q ON q.id = qa.question_id
+		LEFT JOIN session_assistants sa ON sa.id = qa.assistant_id
+		WHERE q.session_id = ?
+		ORDER BY qa.question_id, sa.position IS NULL, sa.position, qa.assistant_id`, sessionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assistant answers: %w", err)
+	}
+	defer rows.Close()
+
+	answers := make(map[int][]models.AssistantAnswer)
+	for rows.Next() {
+		var questionID int
+		var a models.AssistantAnswer
+		if err := rows.Scan(&questionID, &a.AssistantID, &a.Name, &a.Content, &a.Model, &a.Status, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan assistant answer: %w", err)
+		}
+		answers[questionID] = append(answers[questionID], a)
+	}
+	return answers, rows.Err()
+}
+
+// StreamAssistantAnswer 用助手自己的提示词和生成参数回答问题。
+// 使用知识库的助手把 chunks 作为 {{.Context}} 传给提示词（调用方在没有检索到内容时不会调用它），
+// 用量和备用模型按知识库回答或通用建议的用途计算
+func (client *AIClient) StreamAssistantAnswer(ctx context.Context, db *sql.DB, sessionId string, assistant models.SessionAssistant, question string, chunks []models.DocumentChunk, onDelta StreamHandler) (*ChatResult, error) {
+	promptType := AssistantPromptType(assistant.UseKB)
+	contextStr := ""
+	purpose := models.AIUsagePurposeGeneric
+	if assistant.UseKB {
+		contextStr = kbContext(chunks)
+		purpose = models.AIUsagePurposeKB
+	}
+	client.trace.setContext(contextStr)
+	systemPrompt := RenderPrompt(promptType, assistant.Prompt, newPromptVars(db, sessionId, question, contextStr))
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: question},
+	}
+	return client.complete(ctx, messages, "Assistant "+assistant.Name, purpose, assistant.Params, nil, onDelta)
+}
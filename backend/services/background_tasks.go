@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// questionTask 一个正在为问题生成建议的后台任务
+type questionTask struct {
+	sessionID string
+	cancel    context.CancelFunc
+}
+
+// BackgroundTasks 跟踪请求返回后仍在运行的后台任务（生成建议、处理文档），
+// 以便在删除问题、关闭会话或服务停机时取消它们
+type BackgroundTasks struct {
+	ctx    context.Context // 服务停机时取消，所有任务的 context 都派生自它
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	questions map[int64]*questionTask
+	wg        sync.WaitGroup
+}
+
+var (
+	globalBackgroundTasks *BackgroundTasks
+	backgroundTasksOnce   sync.Once
+)
+
+// GetBackgroundTasks 获取全局后台任务管理器
+func GetBackgroundTasks() *BackgroundTasks {
+	backgroundTasksOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		globalBackgroundTasks = &BackgroundTasks{
+			ctx:       ctx,
+			cancel:    cancel,
+			questions: make(map[int64]*questionTask),
+		}
+	})
+	return globalBackgroundTasks
+}
+
+// StartQuestion 登记问题的建议生成任务，返回任务使用的 context 和结束时必须调用的 done。
+// timeout 大于 0 时整个任务（检索 + 两路生成）超过该时长后自动取消
+func (t *BackgroundTasks) StartQuestion(sessionId string, questionID int64, timeout time.Duration) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(t.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(t.ctx)
+	}
+
+	task := &questionTask{sessionID: sessionId, cancel: cancel}
+	t.mu.Lock()
+	t.questions[questionID] = task
+	t.mu.Unlock()
+	t.wg.Add(1)
+
+	done := func() {
+		t.mu.Lock()
+		if t.questions[questionID] == task {
+			delete(t.questions, questionID)
+		}
+		t.mu.Unlock()
+		cancel()
+		t.wg.Done()
+	}
+	return ctx, done
+}
+
+// CancelQuestion 取消问题正在进行的建议生成，返回是否有任务被取消
+func (t *BackgroundTasks) CancelQuestion(questionID int64) bool {
+	t.mu.Lock()
+	task, ok := t.questions[questionID]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	task.cancel()
+	fmt.Printf("已取消问题 %d 的建议生成。\n", questionID)
+	return true
+}
+
+// CancelSession 取消会话内所有问题的建议生成，返回取消的任务数
+func (t *BackgroundTasks) CancelSession(sessionId string) int {
+	t.mu.Lock()
+	var cancels []context.CancelFunc
+	for _, task := range t.questions {
+		if task.sessionID == sessionId {
+			cancels = append(cancels, task.cancel)
+		}
+	}
+	t.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	if len(cancels) > 0 {
+		fmt.Printf("已取消会话 %s 的 %d 个建议生成任务。\n", sessionId, len(cancels))
+	}
+	return len(cancels)
+}
+
+// Go 在后台运行一个不需要单独取消的任务（如文档向量化），服务停机时它的 context 会被取消
+func (t *BackgroundTasks) Go(fn func(ctx context.Context)) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		fn(t.ctx)
+	}()
+}
+
+// Shutdown 取消所有后台任务并等待它们退出，ctx 到期时不再等待
+func (t *BackgroundTasks) Shutdown(ctx context.Context) error {
+	t.cancel()
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background tasks did not finish: %w", ctx.Err())
+	}
+}
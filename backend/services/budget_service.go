@@ -0,0 +1,112 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// 预算事件级别
+const (
+	BudgetLevelWarning  = "warning"  // 花费达到预警阈值
+	BudgetLevelExceeded = "exceeded" // 预算已用完
+)
+
+// ErrBudgetExceeded 会话已超出预算且没有配置便宜模型，不再调用聊天模型
+var ErrBudgetExceeded = errors.New("session budget exceeded")
+
+// BudgetStatus 会话当前的预算与花费
+type BudgetStatus struct {
+	SessionID     string   `json:"sessionId"`
+	BudgetTokens  *int64   `json:"budgetTokens"`
+	BudgetUSD     *float64 `json:"budgetUsd"`
+	FallbackModel string   `json:"fallbackModel"`
+	SpentTokens   int64    `json:"spentTokens"`
+	SpentUSD      float64  `json:"spentUsd"`
+	Percent       float64  `json:"percent"` // 各项预算中使用比例的最大值，未设预算时为 0
+	Warning       bool     `json:"warning"`
+	Exceeded      bool     `json:"exceeded"`
+}
+
+// HasBudget 是否设置了任意一项预算
+func (s *BudgetStatus) HasBudget() bool {
+	return s.BudgetTokens != nil || s.BudgetUSD != nil
+}
+
+// GetSessionBudgetStatus 读取会话预算，并根据 ai_usage 汇总已花费的 token 和费用
+func GetSessionBudgetStatus(db *sql.DB, cfg *config.Config, sessionId string) (*BudgetStatus, error) {
+	status := &BudgetStatus{SessionID: sessionId}
+	var budgetTokens sql.NullInt64
+	var budgetUSD sql.NullFloat64
+	var fallbackModel sql.NullString
+	err := db.QueryRow(`SELECT budget_tokens, budget_usd, budget_fallback_model FROM sessions WHERE id = ?`, sessionId).
+		Scan(&budgetTokens, &budgetUSD, &fallbackModel)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query session budget: %w", err)
+	}
+	if budgetTokens.Valid && budgetTokens.Int64 > 0 {
+		status.BudgetTokens = &budgetTokens.Int64
+	}
+	if budgetUSD.Valid && budgetUSD.Float64 > 0 {
+		status.BudgetUSD = &budgetUSD.Float64
+	}
+	status.FallbackModel = fallbackModel.String
+
+	err = db.QueryRow(`SELECT COALESCE(SUM(total_tokens), 0), COALESCE(SUM(cost_usd), 0) FROM ai_usage WHERE session_id = ?`, sessionId).
+		Scan(&status.SpentTokens, &status.SpentUSD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session spend: %w", err)
+	}
+
+	if status.BudgetTokens != nil {
+		status.Percent = math.Max(status.Percent, float64(status.SpentTokens)/float64(*status.BudgetTokens)*100)
+	}
+	if status.BudgetUSD != nil {
+		status.Percent = math.Max(status.Percent, status.SpentUSD / *status.BudgetUSD * 100)
+	}
+	status.Percent = math.Round(status.Percent*100) / 100
+	status.Exceeded = status.HasBudget() && status.Percent >= 100
+	status.Warning = status.HasBudget() && cfg.BudgetWarnPercent > 0 && status.Percent >= float64(cfg.BudgetWarnPercent)
+	return status, nil
+}
+
+// NotifyBudget 在花费首次达到预警阈值或超出预算时通知会话房间
+// 每个级别只通知一次，修改预算后会重新计算
+func NotifyBudget(db *sql.DB, status *BudgetStatus) {
+	if status.Exceeded {
+		notifyBudgetOnce(db, status, "budget_exceeded_at", BudgetLevelExceeded)
+	}
+	if status.Warning {
+		notifyBudgetOnce(db, status, "budget_warned_at", BudgetLevelWarning)
+	}
+}
+
+// notifyBudgetOnce 通过条件更新标记列保证同一级别只推送一次
+func notifyBudgetOnce(db *sql.DB, status *BudgetStatus, column string, level string) {
+	var query string
+	switch column {
+	case "budget_warned_at":
+		query = `UPDATE sessions SET budget_warned_at = NOW() WHERE id = ? AND budget_warned_at IS NULL`
+	case "budget_exceeded_at":
+		query = `UPDATE sessions SET budget_exceeded_at = NOW() WHERE id = ? AND budget_exceeded_at IS NULL`
+	default:
+		return
+	}
+	result, err := db.Exec(query, status.SessionID)
+	if err != nil {
+		fmt.Printf("警告：更新会话 %s 的预算标记失败: %v\n", status.SessionID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	fmt.Printf("会话 %s 的 AI 花费已达到预算的 %.2f%% (%s)。\n", status.SessionID, status.Percent, level)
+	GetEventHub().Publish(status.SessionID, EventSessionBudget, map[string]interface{}{
+		"level":  level,
+		"budget": status,
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
 )
 
 // CachedChunk 缓存的文档块（已解析向量）
@@ -17,17 +19,60 @@ type CachedChunk struct {
 	Embedding  []float32
 }
 
-// SessionCache 单个 session 的向量缓存
+// SessionCache 单个 session 的向量缓存。发布后不再修改，文档增删时整体替换为新的 SessionCache
 type SessionCache struct {
 	Chunks    []CachedChunk
+	Lexical   *lexicalIndex // Chunks 的 BM25 索引，下标与 Chunks 一致
+	ANN       *hnswIndex    // Chunks 向量的近似最近邻索引，文档块较少或后台尚未构建完成时为 nil
 	UpdatedAt time.Time
+
+	positions map[int]int // 文档块 ID 到 Chunks 下标的映射
+}
+
+// Position 返回文档块在 Chunks 中的下标
+func (sc *SessionCache) Position(chunkID int) (int, bool) {
+	i, ok := sc.positions[chunkID]
+	return i, ok
+}
+
+// VectorIndexOptions 近似最近邻（HNSW）索引的参数
+type VectorIndexOptions struct {
+	MinChunks      int // 会话文档块数达到该值才建立近似索引，更小的会话使用精确搜索；<= 0 表示始终精确搜索
+	M              int // 每个节点每层的邻居数，越大召回率越高，内存占用和构建时间也越多
+	EfConstruction int // 构建时的候选列表长度，越大索引质量越好、构建越慢
+	EfSearch       int // 查询时的候选列表长度，越大召回率越高、查询越慢
+}
+
+// defaultVectorIndexOptions 未配置时使用的索引参数
+var defaultVectorIndexOptions = VectorIndexOptions{MinChunks: 1000, M: 16, EfConstruction: 200, EfSearch: 100}
+
+// VectorIndexOptionsFromConfig 从配置读取近似索引参数，无效的值使用默认值
+func VectorIndexOptionsFromConfig(cfg *config.Config) VectorIndexOptions {
+	opts := VectorIndexOptions{
+		MinChunks:      cfg.VectorIndexMinChunks,
+		M:              cfg.HNSWM,
+		EfConstruction: cfg.HNSWEfConstruction,
+		EfSearch:       cfg.HNSWEfSearch,
+	}
+	if opts.M < 2 {
+		opts.M = defaultVectorIndexOptions.M
+	}
+	if opts.EfConstruction <= 0 {
+		opts.EfConstruction = defaultVectorIndexOptions.EfConstruction
+	}
+	if opts.EfSearch <= 0 {
+		opts.EfSearch = defaultVectorIndexOptions.EfSearch
+	}
+	return opts
 }
 
 // VectorCache 向量缓存管理器
 type VectorCache struct {
 	mu       sync.RWMutex
 	sessions map[string]*SessionCache
+	building map[string]bool // 正在后台构建近似索引的 session
 	ttl      time.Duration
+	opts     VectorIndexOptions
 }
 
 var (
@@ -40,36 +85,87 @@ func GetVectorCache() *VectorCache {
 	cacheOnce.Do(func() {
 		globalCache = &VectorCache{
 			sessions: make(map[string]*SessionCache),
+			building: make(map[string]bool),
 			ttl:      30 * time.Minute, // 缓存 30 分钟
+			opts:     defaultVectorIndexOptions,
 		}
 	})
 	return globalCache
 }
 
+// Configure 设置近似索引参数，只影响之后构建的索引（查询参数 EfSearch 立即生效）
+func (vc *VectorCache) Configure(opts VectorIndexOptions) {
+	vc.mu.Lock()
+	vc.opts = opts
+	vc.mu.Unlock()
+}
+
+// Options 返回当前的近似索引参数
+func (vc *VectorCache) Options() VectorIndexOptions {
+	vc.mu.RLock()
+	defer vc.mu.RUnlock()
+	return vc.opts
+}
+
 // GetSessionChunks 获取 session 的缓存向量，如果没有或过期则从数据库加载
 func (vc *VectorCache) GetSessionChunks(db *sql.DB, sessionId string) ([]CachedChunk, error) {
+	cache, err := vc.GetSessionIndex(db, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Chunks, nil
+}
+
+// GetSessionIndex 获取 session 的缓存向量及其 BM25 和近似最近邻索引，如果没有或过期则从数据库加载
+func (vc *VectorCache) GetSessionIndex(db *sql.DB, sessionId string) (*SessionCache, error) {
 	vc.mu.RLock()
 	cache, exists := vc.sessions[sessionId]
+	vc.mu.RUnlock()
 	if exists && time.Since(cache.UpdatedAt) < vc.ttl {
-		chunks := cache.Chunks
-		vc.mu.RUnlock()
-		return chunks, nil
+		return cache, nil
 	}
-	vc.mu.RUnlock()
 
 	// 缓存不存在或过期，从数据库加载
 	return vc.refreshSessionCache(db, sessionId)
 }
 
-// refreshSessionCache 从数据库刷新缓存
-func (vc *VectorCache) refreshSessionCache(db *sql.DB, sessionId string) ([]CachedChunk, error) {
+// refreshSessionCache 从数据库刷新缓存，同时重建 BM25 索引；
+// 已有的近似索引按新数据增量更新后继续使用，没有时在后台构建
+func (vc *VectorCache) refreshSessionCache(db *sql.DB, sessionId string) (*SessionCache, error) {
+	chunks, err := loadCachedChunks(db, `d.session_id = ?`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	vc.mu.RLock()
+	old := vc.sessions[sessionId]
+	vc.mu.RUnlock()
+	var ann *hnswIndex
+	if old != nil && old.ANN != nil {
+		ann = old.ANN
+		ann.reconcile(chunks)
+	}
+	cache := newSessionCache(chunks, ann, time.Now())
+
+	// 更新缓存
+	vc.mu.Lock()
+	vc.sessions[sessionId] = cache
+	vc.scheduleIndexBuildLocked(sessionId, cache)
+	vc.mu.Unlock()
+
+	fmt.Printf("缓存刷新: session %s, %d 个向量块\n", sessionId, len(chunks))
+	return cache, nil
+}
+
+// loadCachedChunks 按条件从数据库读取已向量化的文档块
+func loadCachedChunks(db *sql.DB, where string, args ...interface{}) ([]CachedChunk, error) {
 	query := `
 		SELECT dc.id, dc.document_id, dc.content, dc.chunk_index, dc.embedding
 		FROM document_chunks dc
 		JOIN documents d ON dc.document_id = d.id
-		WHERE d.session_id = ? AND dc.embedding IS NOT NULL AND dc.embedding != ''
+		WHERE ` + where + ` AND dc.embedding IS NOT NULL AND dc.embedding != ''
 	`
-	rows, err := db.Query(query, sessionId)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query chunks for cache: %w", err)
 	}
@@ -98,20 +194,148 @@ func (vc *VectorCache) refreshSessionCache(db *sql.DB, sessionId string) ([]Cach
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating chunk rows for cache: %w", err)
 	}
+	return chunks, nil
+}
 
-	// 更新缓存
-	vc.mu.Lock()
-	vc.sessions[sessionId] = &SessionCache{
+// newSessionCache 为 chunks 建立 BM25 索引和下标映射
+func newSessionCache(chunks []CachedChunk, ann *hnswIndex, updatedAt time.Time) *SessionCache {
+	positions := make(map[int]int, len(chunks))
+	for i, chunk := range chunks {
+		positions[chunk.ID] = i
+	}
+	return &SessionCache{
 		Chunks:    chunks,
-		UpdatedAt: time.Now(),
+		Lexical:   newLexicalIndex(chunks),
+		ANN:       ann,
+		UpdatedAt: updatedAt,
+		positions: positions,
 	}
-	vc.mu.Unlock()
+}
 
-	fmt.Printf("缓存刷新: session %s, %d 个向量块\n", sessionId, len(chunks))
-	return chunks, nil
+// scheduleIndexBuildLocked 会话文档块足够多、还没有近似索引（或索引中已删除的节点过多）时在后台构建，调用方需持有 vc.mu 写锁
+func (vc *VectorCache) scheduleIndexBuildLocked(sessionId string, cache *SessionCache) {
+	if vc.opts.MinChunks <= 0 || len(cache.Chunks) < vc.opts.MinChunks || vc.building[sessionId] {
+		return
+	}
+	if cache.ANN != nil && !cache.ANN.needsRebuild() {
+		return
+	}
+	vc.building[sessionId] = true
+	go vc.buildIndex(sessionId, vc.opts)
+}
+
+// buildIndex 在后台为 session 构建近似索引，构建期间查询使用精确搜索。
+// 构建期间缓存可能被增量更新或刷新，完成后先与最新的文档块对齐再替换
+func (vc *VectorCache) buildIndex(sessionId string, opts VectorIndexOptions) {
+	defer func() {
+		vc.mu.Lock()
+		delete(vc.building, sessionId)
+		vc.mu.Unlock()
+	}()
+
+	vc.mu.RLock()
+	cache := vc.sessions[sessionId]
+	vc.mu.RUnlock()
+	if cache == nil {
+		return
+	}
+
+	start := time.Now()
+	ann := newHNSWIndex(opts.M, opts.EfConstruction)
+	ann.reconcile(cache.Chunks)
+	for {
+		vc.mu.Lock()
+		latest := vc.sessions[sessionId]
+		if latest == nil {
+			// 构建期间缓存已失效，下次加载时重新构建
+			vc.mu.Unlock()
+			return
+		}
+		if latest == cache {
+			next := *latest
+			next.ANN = ann
+			vc.sessions[sessionId] = &next
+			vc.mu.Unlock()
+			fmt.Printf("近似索引构建完成: session %s, %d 个向量块, 耗时 %v\n", sessionId, ann.size(), time.Since(start))
+			return
+		}
+		vc.mu.Unlock()
+		cache = latest
+		ann.reconcile(cache.Chunks)
+	}
+}
+
+// AddDocumentChunks 把新处理完成的文档的文档块增量加入缓存（包括 BM25 和近似索引），
+// 会话未缓存时不做任何事，下次查询时会完整加载
+func (vc *VectorCache) AddDocumentChunks(db *sql.DB, sessionId string, docId int) {
+	vc.mu.RLock()
+	_, cached := vc.sessions[sessionId]
+	vc.mu.RUnlock()
+	if !cached {
+		return
+	}
+
+	added, err := loadCachedChunks(db, `dc.document_id = ?`, docId)
+	if err != nil {
+		fmt.Printf("警告：增量加载文档 %d 的向量失败，使 session %s 缓存失效: %v\n", docId, sessionId, err)
+		vc.InvalidateSession(sessionId)
+		return
+	}
+	vc.update(sessionId, func(cache *SessionCache) []CachedChunk {
+		chunks := make([]CachedChunk, 0, len(cache.Chunks)+len(added))
+		for _, chunk := range cache.Chunks {
+			if chunk.DocumentID != docId {
+				chunks = append(chunks, chunk)
+			}
+		}
+		return append(chunks, added...)
+	})
+	fmt.Printf("缓存增量更新: session %s 加入文档 %d 的 %d 个向量块\n", sessionId, docId, len(added))
 }
 
-// InvalidateSession 使 session 缓存失效（文档上传/删除时调用）
+// RemoveDocument 从缓存中移除文档的文档块（包括 BM25 和近似索引）
+func (vc *VectorCache) RemoveDocument(sessionId string, docId int) {
+	vc.update(sessionId, func(cache *SessionCache) []CachedChunk {
+		chunks := make([]CachedChunk, 0, len(cache.Chunks))
+		for _, chunk := range cache.Chunks {
+			if chunk.DocumentID != docId {
+				chunks = append(chunks, chunk)
+			}
+		}
+		return chunks
+	})
+	fmt.Printf("缓存增量更新: session %s 移除文档 %d\n", sessionId, docId)
+}
+
+// update 用 change 计算新的文档块列表并替换会话缓存，近似索引就地增量更新；
+// 与其他更新并发时重试，保证不会丢失修改。会话未缓存时不做任何事
+func (vc *VectorCache) update(sessionId string, change func(cache *SessionCache) []CachedChunk) {
+	for {
+		vc.mu.RLock()
+		cache := vc.sessions[sessionId]
+		vc.mu.RUnlock()
+		if cache == nil {
+			return
+		}
+
+		chunks := change(cache)
+		if cache.ANN != nil {
+			cache.ANN.reconcile(chunks)
+		}
+		next := newSessionCache(chunks, cache.ANN, cache.UpdatedAt)
+
+		vc.mu.Lock()
+		if vc.sessions[sessionId] == cache {
+			vc.sessions[sessionId] = next
+			vc.scheduleIndexBuildLocked(sessionId, next)
+			vc.mu.Unlock()
+			return
+		}
+		vc.mu.Unlock()
+	}
+}
+
+// InvalidateSession 使 session 缓存失效
 func (vc *VectorCache) InvalidateSession(sessionId string) {
 	vc.mu.Lock()
 	delete(vc.sessions, sessionId)
@@ -135,14 +359,23 @@ func (vc *VectorCache) GetStats() map[string]interface{} {
 	vc.mu.RLock()
 	defer vc.mu.RUnlock()
 
-	totalChunks := 0
+	totalChunks, indexed := 0, 0
 	for _, cache := range vc.sessions {
 		totalChunks += len(cache.Chunks)
+		if cache.ANN != nil {
+			indexed++
+		}
 	}
 
 	return map[string]interface{}{
-		"sessions":     len(vc.sessions),
-		"total_chunks": totalChunks,
-		"ttl_minutes":  vc.ttl.Minutes(),
+		"sessions":             len(vc.sessions),
+		"total_chunks":         totalChunks,
+		"ttl_minutes":          vc.ttl.Minutes(),
+		"ann_sessions":         indexed,
+		"ann_building":         len(vc.building),
+		"ann_min_chunks":       vc.opts.MinChunks,
+		"hnsw_m":               vc.opts.M,
+		"hnsw_ef_construction": vc.opts.EfConstruction,
+		"hnsw_ef_search":       vc.opts.EfSearch,
 	}
 }
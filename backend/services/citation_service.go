@@ -0,0 +1,81 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// citationExcerptRunes 引用摘录保留的字符数
+const citationExcerptRunes = 200
+
+// SaveQuestionCitations 用新的引用列表替换问题原有的引用，rank 为引用顺序
+// 已被删除的文档块会被忽略
+func SaveQuestionCitations(db *sql.DB, questionID int64, chunkIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM question_citations WHERE question_id = ?`, questionID); err != nil {
+		return fmt.Errorf("failed to clear citations: %w", err)
+	}
+	for rank, chunkID := range chunkIDs {
+		_, err := tx.Exec(`INSERT IGNORE INTO question_citations (question_id, chunk_id, document_id, `+"`rank`"+`)
+			SELECT ?, id, document_id, ? FROM document_chunks WHERE id = ?`, questionID, rank, chunkID)
+		if err != nil {
+			return fmt.Errorf("failed to insert citation: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit citations: %w", err)
+	}
+	return nil
+}
+
+// GetSessionCitations 读取会话内所有问题的引用，按问题 ID 分组并按引用顺序排列
+func GetSessionCitations(db *sql.DB, sessionId string) (map[int][]models.Citation, error) {
+	return queryCitations(db, `q.session_id = ?`, sessionId)
+}
+
+// GetQuestionCitations 读取单个问题的引用
+func GetQuestionCitations(db *sql.DB, questionID int64) ([]models.Citation, error) {
+	citations, err := queryCitations(db, `qc.question_id = ?`, questionID)
+	if err != nil {
+		return nil, err
+	}
+	return citations[int(questionID)], nil
+}
+
+// queryCitations 按条件查询引用及其文档标题和摘录
+func queryCitations(db *sql.DB, where string, arg interface{}) (map[int][]models.Citation, error) {
+	rows, err := db.Query(`
+		SELECT qc.question_id, qc.chunk_id, qc.document_id, d.title, dc.chunk_index, dc.content
+		FROM question_citations qc
+		JOIN questions q ON q.id = qc.question_id
+		JOIN document_chunks dc ON dc.id = qc.chunk_id
+		JOIN documents d ON d.id = qc.document_id
+		WHERE `+where+`
+		ORDER BY qc.question_id, qc.`+"`rank`", arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query citations: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[int][]models.Citation)
+	for rows.Next() {
+		var questionID int
+		var c models.Citation
+		if err := rows.Scan(&questionID, &c.ChunkID, &c.DocumentID, &c.DocumentTitle, &c.ChunkIndex, &c.Excerpt); err != nil {
+			return nil, fmt.Errorf("failed to scan citation: %w", err)
+		}
+		c.Excerpt = truncateRunes(c.Excerpt, citationExcerptRunes)
+		result[questionID] = append(result[questionID], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate citations: %w", err)
+	}
+	return result, nil
+}
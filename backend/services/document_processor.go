@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"  // 用于处理 CSV 文件
 	"encoding/json" // 用于将向量序列化为JSON字符串
@@ -23,8 +24,8 @@ import (
 )
 
 // ProcessUploadedDocument 是处理上传文档的主函数
-// 它会提取文本、分块、向量化并存储
-func ProcessUploadedDocument(db *sql.DB, cfg *config.Config, docID int, filePath string) error { // 添加 cfg 参数
+// 它会提取文本、分块、向量化并存储；ctx 取消（服务停机）时中止向量化
+func ProcessUploadedDocument(ctx context.Context, db *sql.DB, cfg *config.Config, sessionId string, docID int, filePath string) error { // 添加 cfg 参数
 	// 1. 提取文本
 	textContent, err := ExtractTextFromFile(filePath)
 	if err != nil {
@@ -48,9 +49,13 @@ func ProcessUploadedDocument(db *sql.DB, cfg *config.Config, docID int, filePath
 		return nil
 	}
 
-	// 3. 向量化每个块 (调用OpenAI API)
-	openaiClient := NewOpenAIClient(cfg) // 创建 OpenAI 客户端
-	embeddings, err := openaiClient.GetEmbeddings(chunks)
+	// 3. 向量化每个块 (调用配置的向量提供方)
+	aiClient, err := NewAIClient(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create AI client for doc %d: %w", docID, err)
+	}
+	aiClient = aiClient.WithUsage(db, UsageScope{SessionID: sessionId, DocumentID: docID})
+	embeddings, err := aiClient.GetEmbeddingsBatched(ctx, chunks, embeddingBatchOptionsFromConfig(cfg))
 	if err != nil {
 		return fmt.Errorf("failed to get embeddings for doc %d: %w", docID, err)
 	}
@@ -103,8 +108,9 @@ func ProcessUploadedDocument(db *sql.DB, cfg *config.Config, docID int, filePath
 
 	fmt.Printf("文档 %d 所有块和向量存储完成。\n", docID)
 
-	// 使缓存失效，下次查询时会重新加载
-	GetVectorCache().InvalidateDocument(db, docID)
+	// 把新文档块增量加入向量缓存，答案缓存失效
+	GetVectorCache().AddDocumentChunks(db, sessionId, docID)
+	GetAnswerCache().InvalidateSession(sessionId)
 
 	return nil
 }
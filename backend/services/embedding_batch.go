@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"unicode"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// EmbeddingBatchOptions 控制大文档向量化时的分批与并发
+type EmbeddingBatchOptions struct {
+	MaxItems    int // 每批最多的文本数
+	MaxTokens   int // 每批估算 token 数上限
+	Concurrency int // 同时进行的批次数
+}
+
+// embeddingBatchOptionsFromConfig 从配置读取分批参数，非法值使用默认值
+func embeddingBatchOptionsFromConfig(cfg *config.Config) EmbeddingBatchOptions {
+	opts := EmbeddingBatchOptions{
+		MaxItems:    cfg.EmbeddingBatchSize,
+		MaxTokens:   cfg.EmbeddingBatchTokens,
+		Concurrency: cfg.EmbeddingConcurrency,
+	}
+	if opts.MaxItems <= 0 {
+		opts.MaxItems = 64
+	}
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = 60000
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	return opts
+}
+
+// embeddingBatch 一批待向量化的文本，start 为第一条在原列表中的下标
+type embeddingBatch struct {
+	start int
+	texts []string
+}
+
+// estimateTokens 粗略估算文本的 token 数：中日韩字符按 1 个 token，其他按 4 个字符 1 个 token
+// 只用于分批，宁可高估
+func estimateTokens(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+3)/4 + 1
+}
+
+// splitEmbeddingBatches 按条数和估算 token 数把文本切成连续的批次
+func splitEmbeddingBatches(texts []string, opts EmbeddingBatchOptions) []embeddingBatch {
+	var batches []embeddingBatch
+	current := embeddingBatch{start: 0}
+	tokens := 0
+	for i, text := range texts {
+		t := estimateTokens(text)
+		if len(current.texts) > 0 && (len(current.texts) >= opts.MaxItems || tokens+t > opts.MaxTokens) {
+			batches = append(batches, current)
+			current = embeddingBatch{start: i}
+			tokens = 0
+		}
+		current.texts = append(current.texts, text)
+		tokens += t
+	}
+	if len(current.texts) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// shouldSplitFailedBatch 判断失败的批次是否值得拆成单条重试。
+// 熔断、认证失败等与具体文本无关的错误，拆开也不会成功
+func shouldSplitFailedBatch(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return false
+		}
+	}
+	return true
+}
+
+// GetEmbeddingsBatched 分批、并发地获取大量文本的向量，返回结果与输入一一对应。
+// 某一批失败时逐条重试，仍然失败的文本对应的向量为 nil；全部失败时返回错误。
+// ctx 取消后不再发起新的批次，直接返回 ctx.Err()
+func (client *AIClient) GetEmbeddingsBatched(ctx context.Context, texts []string, opts EmbeddingBatchOptions) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("input texts cannot be empty")
+	}
+	batches := splitEmbeddingBatches(texts, opts)
+	fmt.Printf("共 %d 个文本块，分为 %d 批向量化（并发 %d）。\n", len(texts), len(batches), opts.Concurrency)
+
+	embeddings := make([][]float32, len(texts))
+	var mu sync.Mutex
+	var firstErr error
+	failed := 0
+
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	for n, batch := range batches {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n int, batch embeddingBatch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := client.GetEmbeddings(ctx, batch.texts)
+			if err == nil && len(result) == len(batch.texts) {
+				mu.Lock()
+				copy(embeddings[batch.start:], result)
+				mu.Unlock()
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("embedding count mismatch: expected %d, got %d", len(batch.texts), len(result))
+			}
+			fmt.Printf("第 %d 批向量化失败（%d 条）: %v\n", n+1, len(batch.texts), err)
+
+			if len(batch.texts) == 1 || ctx.Err() != nil || !shouldSplitFailedBatch(err) {
+				mu.Lock()
+				failed += len(batch.texts)
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			// 逐条重试，避免个别超长或异常文本拖累整批
+			for i, text := range batch.texts {
+				single, singleErr := client.GetEmbeddings(ctx, []string{text})
+				mu.Lock()
+				if singleErr == nil && len(single) == 1 {
+					embeddings[batch.start+i] = single[0]
+				} else {
+					if singleErr == nil {
+						singleErr = fmt.Errorf("no embedding returned")
+					}
+					fmt.Printf("  文本块 %d 单独向量化失败: %v\n", batch.start+i, singleErr)
+					failed++
+					if firstErr == nil {
+						firstErr = singleErr
+					}
+				}
+				mu.Unlock()
+			}
+		}(n, batch)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("embedding cancelled: %w", err)
+	}
+	if failed == len(texts) {
+		return nil, fmt.Errorf("all %d embedding requests failed: %w", len(texts), firstErr)
+	}
+	if failed > 0 {
+		fmt.Printf("警告：%d/%d 个文本块向量化失败，将跳过这些块。\n", failed, len(texts))
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/mockopenai"
+)
+
+// stubEmbedder 测试用的向量提供方：文本 "tN" 的向量为 [N]。
+// 包含 failBatch 的多条批次整批失败，failItem 单独请求时也失败
+type stubEmbedder struct {
+	failBatch string
+	failItem  string
+	batchErr  error // 整批失败时返回的错误，默认 400
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (s *stubEmbedder) Name() string { return "stub" }
+
+func (s *stubEmbedder) Embed(ctx context.Context, texts []string) (*EmbeddingResult, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, append([]string(nil), texts...))
+	s.mu.Unlock()
+	for _, text := range texts {
+		if text == s.failItem && len(texts) == 1 {
+			return nil, &APIError{Provider: "stub", StatusCode: http.StatusBadRequest, Body: "bad input"}
+		}
+		if text == s.failBatch && len(texts) > 1 {
+			if s.batchErr != nil {
+				return nil, s.batchErr
+			}
+			return nil, &APIError{Provider: "stub", StatusCode: http.StatusBadRequest, Body: "batch rejected"}
+		}
+	}
+	result := &EmbeddingResult{Model: "stub"}
+	for _, text := range texts {
+		var n int
+		fmt.Sscanf(text, "t%d", &n)
+		result.Embeddings = append(result.Embeddings, []float32{float32(n)})
+	}
+	return result, nil
+}
+
+// callSizes 返回每次请求的文本数，按第一条文本排序以消除并发带来的顺序差异
+func (s *stubEmbedder) callSizes() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := make(map[string]int)
+	for _, call := range s.calls {
+		key := call[0]
+		if len(call) > 1 {
+			key += "+"
+		}
+		sizes[key] = len(call)
+	}
+	return sizes
+}
+
+func numberedTexts(n int) []string {
+	texts := make([]string, n)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("t%d", i)
+	}
+	return texts
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 1},
+		{"abcd", 2},
+		{"abcde", 3},
+		{"中文", 3},
+		{"中文 ab", 4},
+		{"こんにちは", 6},
+	}
+	for _, tt := range tests {
+		if got := estimateTokens(tt.text); got != tt.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSplitEmbeddingBatches(t *testing.T) {
+	long := strings.Repeat("a", 40) // 估算 11 个 token
+	tests := []struct {
+		name       string
+		texts      []string
+		opts       EmbeddingBatchOptions
+		wantStarts []int
+		wantSizes  []int
+	}{
+		{"by item count", numberedTexts(5), EmbeddingBatchOptions{MaxItems: 2, MaxTokens: 1000}, []int{0, 2, 4}, []int{2, 2, 1}},
+		{"single batch", numberedTexts(3), EmbeddingBatchOptions{MaxItems: 10, MaxTokens: 1000}, []int{0}, []int{3}},
+		{"by estimated tokens", []string{long, long, long, long, long}, EmbeddingBatchOptions{MaxItems: 10, MaxTokens: 25}, []int{0, 2, 4}, []int{2, 2, 1}},
+		{"oversized text gets its own batch", []string{"t0", strings.Repeat("a", 400), "t2"}, EmbeddingBatchOptions{MaxItems: 10, MaxTokens: 50}, []int{0, 1, 2}, []int{1, 1, 1}},
+		{"count limit reached before tokens", []string{long, long, long}, EmbeddingBatchOptions{MaxItems: 1, MaxTokens: 1000}, []int{0, 1, 2}, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var starts, sizes []int
+			var joined []string
+			for _, b := range splitEmbeddingBatches(tt.texts, tt.opts) {
+				starts = append(starts, b.start)
+				sizes = append(sizes, len(b.texts))
+				joined = append(joined, b.texts...)
+			}
+			if !reflect.DeepEqual(starts, tt.wantStarts) || !reflect.DeepEqual(sizes, tt.wantSizes) {
+				t.Errorf("batches start at %v with sizes %v, want %v and %v", starts, sizes, tt.wantStarts, tt.wantSizes)
+			}
+			if !reflect.DeepEqual(joined, tt.texts) {
+				t.Errorf("batches do not cover the input in order: %v", joined)
+			}
+		})
+	}
+}
+
+func TestGetEmbeddingsBatchedFallback(t *testing.T) {
+	texts := numberedTexts(10)
+	opts := EmbeddingBatchOptions{MaxItems: 4, MaxTokens: 1000, Concurrency: 2}
+
+	t.Run("failed batch retried per item", func(t *testing.T) {
+		stub := &stubEmbedder{failBatch: "t5", failItem: "t6"}
+		embeddings, err := (&AIClient{embedder: stub}).GetEmbeddingsBatched(context.Background(), texts, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(embeddings) != len(texts) {
+			t.Fatalf("got %d embeddings, want %d", len(embeddings), len(texts))
+		}
+		// 结果与输入一一对应：失败的 t6 为 nil，其余下标不错位
+		for i, emb := range embeddings {
+			if i == 6 {
+				if emb != nil {
+					t.Errorf("embedding 6 = %v, want nil", emb)
+				}
+				continue
+			}
+			if len(emb) != 1 || emb[0] != float32(i) {
+				t.Errorf("embedding %d = %v, want [%d]", i, emb, i)
+			}
+		}
+		want := map[string]int{"t0+": 4, "t4+": 4, "t8+": 2, "t4": 1, "t5": 1, "t6": 1, "t7": 1}
+		if got := stub.callSizes(); !reflect.DeepEqual(got, want) {
+			t.Errorf("requests = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("errors unrelated to the input are not split", func(t *testing.T) {
+		stub := &stubEmbedder{failBatch: "t5", batchErr: &APIError{Provider: "stub", StatusCode: http.StatusUnauthorized}}
+		embeddings, err := (&AIClient{embedder: stub}).GetEmbeddingsBatched(context.Background(), texts, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, emb := range embeddings {
+			if (i >= 4 && i < 8) != (emb == nil) {
+				t.Errorf("embedding %d = %v", i, emb)
+			}
+		}
+		if got := len(stub.callSizes()); got != 3 {
+			t.Errorf("made %d requests, want 3 (no per-item retries)", got)
+		}
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		stub := &stubEmbedder{failBatch: "t0", failItem: "t0"}
+		if _, err := (&AIClient{embedder: stub}).GetEmbeddingsBatched(context.Background(), []string{"t0"}, opts); err == nil {
+			t.Error("want an error when every text fails")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := (&AIClient{embedder: &stubEmbedder{}}).GetEmbeddingsBatched(ctx, texts, opts); err == nil {
+			t.Error("want an error after cancellation")
+		}
+	})
+}
+
+// TestProcessUploadedDocumentKeepsChunkIndex 部分文档块向量化失败时跳过这些块，其余块保留原来的 chunk_index
+func TestProcessUploadedDocumentKeepsChunkIndex(t *testing.T) {
+	db := openTestDB(t)
+	const marker = "UNEMBEDDABLE"
+	mock := mockopenai.NewHandler(mockopenai.Options{APIKey: "test-key"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/embeddings") && bytes.Contains(body, []byte(marker)) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "input rejected"}})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := config.NewConfig()
+	cfg.LLMProvider = "openai"
+	cfg.EmbeddingProvider = ""
+	cfg.OpenAIAPIKey = "test-key"
+	cfg.OpenAIAPIUrl = srv.URL + "/v1/chat/completions"
+	cfg.OpenAIEmbeddingURL = ""
+	cfg.EmbeddingBatchSize = 2
+
+	sessionID := fmt.Sprintf("chunk-index-%d", time.Now().UnixNano())
+	if _, err := db.Exec("INSERT INTO sessions (id, title) VALUES (?, ?)", sessionID, "chunk index test"); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM document_chunks WHERE document_id IN (SELECT id FROM documents WHERE session_id = ?)", sessionID)
+		db.Exec("DELETE FROM documents WHERE session_id = ?", sessionID)
+		db.Exec("DELETE FROM ai_usage WHERE session_id = ?", sessionID)
+		db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+		GetVectorCache().InvalidateSession(sessionID)
+	})
+
+	var content strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&content, "Paragraph %d describes the venue in some detail. ", i)
+		if i == 20 {
+			content.WriteString(marker + " ")
+		}
+	}
+	path := filepath.Join(t.TempDir(), "venue.txt")
+	if err := os.WriteFile(path, []byte(content.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO documents (session_id, title, file_path, file_type) VALUES (?, ?, ?, ?)", sessionID, "venue.txt", path, "txt")
+	if err != nil {
+		t.Fatalf("insert document: %v", err)
+	}
+	docID, _ := res.LastInsertId()
+	if err := ProcessUploadedDocument(context.Background(), db, cfg, sessionID, int(docID), path); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+
+	chunks := chunkText(content.String(), 1000, 100)
+	want := make(map[int]string)
+	for i, chunk := range chunks {
+		if !strings.Contains(chunk, marker) {
+			want[i] = chunk
+		}
+	}
+	if len(want) == 0 || len(want) == len(chunks) {
+		t.Fatalf("marker should fail some but not all of the %d chunks", len(chunks))
+	}
+
+	rows, err := db.Query("SELECT chunk_index, content FROM document_chunks WHERE document_id = ?", docID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[int]string)
+	for rows.Next() {
+		var index int
+		var text string
+		if err := rows.Scan(&index, &text); err != nil {
+			t.Fatal(err)
+		}
+		got[index] = text
+	}
+	if !reflect.DeepEqual(got, want) {
+		var gotIdx, wantIdx []int
+		for i := range chunks {
+			if _, ok := got[i]; ok {
+				gotIdx = append(gotIdx, i)
+			}
+			if _, ok := want[i]; ok {
+				wantIdx = append(wantIdx, i)
+			}
+		}
+		t.Errorf("stored chunk indexes %v, want %v (or content differs)", gotIdx, wantIdx)
+	}
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 推送给客户端的事件类型
+const (
+	EventQuestionCreated         = "question_created"          // 新问题已插入
+	EventQuestionSuggestion      = "question_suggestion"       // ai_suggestion / kb_suggestion 已写入
+	EventQuestionSuggestionDelta = "question_suggestion_delta" // 流式生成中的增量文本
+	EventQuestionAssistant       = "question_assistant"        // 会话自定义助手的建议已写入
+	EventQuestionStatus          = "question_status"           // 问题状态变更
+	EventQuestionDeleted         = "question_deleted"          // 问题已删除
+	EventDocumentDeleted         = "document_deleted"          // 文档已删除
+	EventSessionUpdated          = "session_updated"           // 会话信息变更或会话已关闭
+	EventSessionBudget           = "session_budget"            // 会话 AI 花费达到预警阈值或超出预算
+	EventQuestionBudgetExceeded  = "question_budget_exceeded"  // 因预算用完未为问题生成建议
+	EventQuestionKBNoMatch       = "question_kb_no_match"      // 知识库中没有达到相似度阈值的内容，未生成知识库回答
+)
+
+const (
+	hubWriteWait      = 10 * time.Second       // 单次写入超时
+	hubPongWait       = 60 * time.Second       // 等待客户端 pong 的超时
+	hubPingPeriod     = (hubPongWait * 9) / 10 // 发送 ping 的间隔，必须小于 pongWait
+	hubSendBufferSize = 64                     // 每个客户端的待发送消息缓冲
+)
+
+// Event 推送给会话房间内所有客户端的事件
+type Event struct {
+	Type      string      `json:"type"`
+	SessionID string      `json:"sessionId"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// hubClient 单个 WebSocket 连接
+type hubClient struct {
+	sessionID string
+	conn      *websocket.Conn
+	send      chan []byte
+}
+
+// EventHub 按会话划分房间的实时事件中心
+type EventHub struct {
+	mu    sync.RWMutex
+	rooms map[string]map[*hubClient]struct{}
+}
+
+var (
+	globalHub *EventHub
+	hubOnce   sync.Once
+)
+
+// GetEventHub 获取全局事件中心实例
+func GetEventHub() *EventHub {
+	hubOnce.Do(func() {
+		globalHub = &EventHub{
+			rooms: make(map[string]map[*hubClient]struct{}),
+		}
+	})
+	return globalHub
+}
+
+// ServeClient 将连接加入 sessionId 对应的房间，并阻塞直到连接断开
+func (h *EventHub) ServeClient(conn *websocket.Conn, sessionId string) {
+	client := &hubClient{
+		sessionID: sessionId,
+		conn:      conn,
+		send:      make(chan []byte, hubSendBufferSize),
+	}
+	h.register(client)
+
+	go client.writePump()
+	client.readPump() // 读循环结束即表示连接已断开
+
+	h.unregister(client)
+}
+
+// Publish 向 sessionId 房间内的所有客户端推送事件
+// 发送缓冲已满的慢客户端会被断开，避免拖慢其他客户端
+func (h *EventHub) Publish(sessionId string, eventType string, data interface{}) {
+	if sessionId == "" {
+		return
+	}
+	payload, err := json.Marshal(Event{
+		Type:      eventType,
+		SessionID: sessionId,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		fmt.Printf("警告：序列化事件 %s 失败: %v\n", eventType, err)
+		return
+	}
+
+	var slow []*hubClient
+	h.mu.RLock()
+	for client := range h.rooms[sessionId] {
+		select {
+		case client.send <- payload:
+		default:
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		fmt.Printf("警告：会话 %s 的 WebSocket 客户端发送缓冲已满，断开连接。\n", sessionId)
+		h.unregister(client)
+	}
+}
+
+// GetStats 获取事件中心统计信息
+func (h *EventHub) GetStats() map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	totalClients := 0
+	for _, room := range h.rooms {
+		totalClients += len(room)
+	}
+	return map[string]interface{}{
+		"sessions": len(h.rooms),
+		"clients":  totalClients,
+	}
+}
+
+// register 将客户端加入房间
+func (h *EventHub) register(client *hubClient) {
+	h.mu.Lock()
+	room, ok := h.rooms[client.sessionID]
+	if !ok {
+		room = make(map[*hubClient]struct{})
+		h.rooms[client.sessionID] = room
+	}
+	room[client] = struct{}{}
+	h.mu.Unlock()
+	fmt.Printf("WebSocket 客户端加入会话 %s\n", client.sessionID)
+}
+
+// unregister 将客户端移出房间并关闭其发送通道（可重复调用）
+func (h *EventHub) unregister(client *hubClient) {
+	h.mu.Lock()
+	room, ok := h.rooms[client.sessionID]
+	if ok {
+		if _, exists := room[client]; exists {
+			delete(room, client)
+			close(client.send)
+			if len(room) == 0 {
+				delete(h.rooms, client.sessionID)
+			}
+			fmt.Printf("WebSocket 客户端离开会话 %s\n", client.sessionID)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// readPump 读取客户端消息以处理 pong 和关闭帧；客户端发来的内容被忽略
+func (c *hubClient) readPump() {
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(hubPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(hubPongWait))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				fmt.Printf("WebSocket read error: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// writePump 将事件写入连接，并定期发送 ping 保活
+func (c *hubClient) writePump() {
+	ticker := time.NewTicker(hubPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(hubWriteWait))
+			if !ok {
+				// 发送通道已关闭，通知客户端断开
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				fmt.Printf("WebSocket write error: %v\n", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(hubWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// hnswNode HNSW 图中的一个文档块
+type hnswNode struct {
+	id      int       // document_chunks.id
+	vec     []float32 // 单位化后的向量，内积即余弦相似度
+	friends [][]int32 // 每一层的邻居（节点下标），下标 0 为最底层
+	deleted bool      // 已删除的节点仍参与图的遍历，但不出现在结果中
+}
+
+// hnswIndex 会话文档块向量的 HNSW 近似最近邻索引（余弦相似度），可并发查询，插入和删除时加写锁
+type hnswIndex struct {
+	mu             sync.RWMutex
+	m              int // 每层的邻居数（最底层为 2m）
+	efConstruction int
+	levelMult      float64
+	nodes          []*hnswNode
+	byID           map[int]int32
+	entry          int32 // 入口节点，-1 表示空图
+	maxLevel       int
+	dim            int
+	deleted        int
+	rng            *rand.Rand
+}
+
+// annHit 近似搜索的一个结果
+type annHit struct {
+	id         int
+	similarity float64
+}
+
+// newHNSWIndex 创建空的 HNSW 索引
+func newHNSWIndex(m, efConstruction int) *hnswIndex {
+	if m < 2 {
+		m = 2
+	}
+	return &hnswIndex{
+		m:              m,
+		efConstruction: max(efConstruction, m),
+		levelMult:      1 / math.Log(float64(m)),
+		byID:           make(map[int]int32),
+		entry:          -1,
+		rng:            rand.New(rand.NewSource(1)),
+	}
+}
+
+// size 返回未删除的节点数
+func (h *hnswIndex) size() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.nodes) - h.deleted
+}
+
+// needsRebuild 已删除的节点超过一半时，图中无用的路由节点过多，应当重建
+func (h *hnswIndex) needsRebuild() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.deleted > 0 && h.deleted*2 > len(h.nodes)
+}
+
+// reconcile 使索引与 chunks 保持一致：插入缺少的文档块，删除已不存在的文档块
+func (h *hnswIndex) reconcile(chunks []CachedChunk) {
+	want := make(map[int]bool, len(chunks))
+	for _, chunk := range chunks {
+		want[chunk.ID] = true
+		h.insert(chunk.ID, chunk.Embedding)
+	}
+	h.mu.RLock()
+	var stale []int
+	for _, n := range h.nodes {
+		if !n.deleted && !want[n.id] {
+			stale = append(stale, n.id)
+		}
+	}
+	h.mu.RUnlock()
+	for _, id := range stale {
+		h.remove(id)
+	}
+}
+
+// insert 插入一个文档块的向量；已存在、零向量或维度与索引不一致时忽略
+func (h *hnswIndex) insert(id int, vec []float32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.byID[id]; ok || len(vec) == 0 || (h.dim != 0 && len(vec) != h.dim) {
+		return
+	}
+	unit := normalize(vec)
+	if unit == nil {
+		return
+	}
+	h.dim = len(vec)
+
+	level := int(-math.Log(1-h.rng.Float64()) * h.levelMult)
+	node := &hnswNode{id: id, vec: unit, friends: make([][]int32, level+1)}
+	idx := int32(len(h.nodes))
+	h.nodes = append(h.nodes, node)
+	h.byID[id] = idx
+	if h.entry < 0 {
+		h.entry, h.maxLevel = idx, level
+		return
+	}
+
+	// 从顶层贪心下降到新节点所在的最高层，再逐层连接邻居
+	ep := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.searchLayer(unit, []int32{ep}, 1, l)[0].node
+	}
+	eps := []int32{ep}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		candidates := h.searchLayer(unit, eps, h.efConstruction, l)
+		neighbors := h.selectNeighbors(candidates, h.m)
+		node.friends[l] = neighbors
+		for _, n := range neighbors {
+			h.link(n, idx, l)
+		}
+		eps = eps[:0]
+		for _, c := range candidates {
+			eps = append(eps, c.node)
+		}
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = idx, level
+	}
+}
+
+// remove 标记删除一个文档块
+func (h *hnswIndex) remove(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx, ok := h.byID[id]; ok && !h.nodes[idx].deleted {
+		h.nodes[idx].deleted = true
+		h.deleted++
+	}
+}
+
+// search 返回与 query 最相似的至多 k 个文档块，ef 越大召回率越高
+func (h *hnswIndex) search(query []float32, k int, ef int) []annHit {
+	unit := normalize(query)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.entry < 0 || unit == nil || len(unit) != h.dim || k <= 0 {
+		return nil
+	}
+	ep := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.searchLayer(unit, []int32{ep}, 1, l)[0].node
+	}
+	// 已删除的节点会占用候选位置，按删除比例放大候选列表
+	ef = max(ef, k) + h.deleted*max(ef, k)/max(len(h.nodes)-h.deleted, 1)
+	var hits []annHit
+	for _, c := range h.searchLayer(unit, []int32{ep}, ef, 0) {
+		if n := h.nodes[c.node]; !n.deleted {
+			hits = append(hits, annHit{id: n.id, similarity: c.similarity})
+			if len(hits) == k {
+				break
+			}
+		}
+	}
+	return hits
+}
+
+// link 把 to 加入 from 在第 level 层的邻居，超出上限时按启发式规则裁剪
+func (h *hnswIndex) link(from, to int32, level int) {
+	node := h.nodes[from]
+	node.friends[level] = append(node.friends[level], to)
+	limit := h.m
+	if level == 0 {
+		limit = 2 * h.m
+	}
+	if len(node.friends[level]) <= limit {
+		return
+	}
+	candidates := make([]hnswCandidate, 0, len(node.friends[level]))
+	for _, f := range node.friends[level] {
+		candidates = append(candidates, hnswCandidate{node: f, similarity: dot(node.vec, h.nodes[f].vec)})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].similarity > candidates[j].similarity })
+	node.friends[level] = h.selectNeighbors(candidates, limit)
+}
+
+// selectNeighbors 从按相似度降序排列的候选中选出至多 m 个邻居：优先选择彼此不太相似的节点，
+// 让图能连通到不同方向（HNSW 论文中的启发式规则），不足 m 个时用剩余最相似的候选补齐
+func (h *hnswIndex) selectNeighbors(candidates []hnswCandidate, m int) []int32 {
+	selected := make([]int32, 0, m)
+	var skipped []int32
+	for _, c := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		keep := true
+		for _, s := range selected {
+			if dot(h.nodes[c.node].vec, h.nodes[s].vec) > c.similarity {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			selected = append(selected, c.node)
+		} else {
+			skipped = append(skipped, c.node)
+		}
+	}
+	for _, s := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, s)
+	}
+	return selected
+}
+
+// searchLayer 在第 level 层从 entryPoints 出发做束搜索，返回至多 ef 个最相似的节点（按相似度降序）
+func (h *hnswIndex) searchLayer(query []float32, entryPoints []int32, ef int, level int) []hnswCandidate {
+	visited := make([]bool, len(h.nodes))
+	candidates := &candidateHeap{max: true}
+	results := &candidateHeap{}
+	for _, ep := range entryPoints {
+		if visited[ep] {
+			continue
+		}
+		visited[ep] = true
+		c := hnswCandidate{node: ep, similarity: dot(query, h.nodes[ep].vec)}
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.similarity < results.items[0].similarity {
+			break
+		}
+		node := h.nodes[c.node]
+		if level >= len(node.friends) {
+			continue
+		}
+		for _, f := range node.friends[level] {
+			if visited[f] {
+				continue
+			}
+			visited[f] = true
+			sim := dot(query, h.nodes[f].vec)
+			if results.Len() < ef || sim > results.items[0].similarity {
+				next := hnswCandidate{node: f, similarity: sim}
+				heap.Push(candidates, next)
+				heap.Push(results, next)
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	out := results.items
+	sort.Slice(out, func(i, j int) bool { return out[i].similarity > out[j].similarity })
+	return out
+}
+
+// hnswCandidate 搜索过程中的一个节点及其与查询的相似度
+type hnswCandidate struct {
+	node       int32
+	similarity float64
+}
+
+// candidateHeap 按相似度排序的堆，max 为 true 时堆顶为最相似的节点，否则为最不相似的节点
+type candidateHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (q *candidateHeap) Len() int { return len(q.items) }
+func (q *candidateHeap) Less(i, j int) bool {
+	if q.max {
+		return q.items[i].similarity > q.items[j].similarity
+	}
+	return q.items[i].similarity < q.items[j].similarity
+}
+func (q *candidateHeap) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *candidateHeap) Push(x interface{}) { q.items = append(q.items, x.(hnswCandidate)) }
+func (q *candidateHeap) Pop() interface{} {
+	last := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return last
+}
+
+// normalize 返回单位化后的向量副本，零向量返回 nil
+func normalize(vec []float32) []float32 {
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return nil
+	}
+	norm = math.Sqrt(norm)
+	unit := make([]float32, len(vec))
+	for i, v := range vec {
+		unit[i] = float32(float64(v) / norm)
+	}
+	return unit
+}
+
+// dot 计算两个等长向量的内积
+func dot(a, b []float32) float64 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return float64(sum)
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// randomVectors 生成 n 个 dim 维的随机向量
+func randomVectors(rng *rand.Rand, n, dim int) [][]float32 {
+	vecs := make([][]float32, n)
+	for i := range vecs {
+		vecs[i] = make([]float32, dim)
+		for j := range vecs[i] {
+			vecs[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	return vecs
+}
+
+// bruteForceTopK 精确计算与 query 余弦相似度最高的 k 个 ID，跳过 deleted 中的 ID
+func bruteForceTopK(vecs [][]float32, query []float32, k int, deleted map[int]bool) []int {
+	type scored struct {
+		id  int
+		sim float64
+	}
+	var all []scored
+	for id, v := range vecs {
+		if deleted[id] {
+			continue
+		}
+		sim, _ := cosineSimilarity(query, v)
+		all = append(all, scored{id, sim})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].sim > all[j].sim })
+	ids := make([]int, 0, k)
+	for i := 0; i < k && i < len(all); i++ {
+		ids = append(ids, all[i].id)
+	}
+	return ids
+}
+
+// recallAtK 对 queries 逐个比较近似结果和精确结果，返回平均召回率；同时检查结果中没有已删除的 ID 且按相似度降序
+func recallAtK(t *testing.T, search func(query []float32) []annHit, vecs [][]float32, queries [][]float32, k int, deleted map[int]bool) float64 {
+	t.Helper()
+	found, total := 0, 0
+	for _, q := range queries {
+		hits := search(q)
+		want := make(map[int]bool, k)
+		for _, id := range bruteForceTopK(vecs, q, k, deleted) {
+			want[id] = true
+		}
+		for i, hit := range hits {
+			if deleted[hit.id] {
+				t.Fatalf("search returned deleted id %d", hit.id)
+			}
+			if i > 0 && hit.similarity > hits[i-1].similarity {
+				t.Fatalf("hits not sorted by similarity: %v", hits)
+			}
+			if want[hit.id] {
+				found++
+			}
+		}
+		total += len(want)
+	}
+	return float64(found) / float64(total)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	vecs := randomVectors(rng, 2000, 32)
+	queries := randomVectors(rng, 50, 32)
+
+	h := newHNSWIndex(16, 100)
+	for id, v := range vecs {
+		h.insert(id, v)
+	}
+	if got := h.size(); got != len(vecs) {
+		t.Fatalf("size = %d, want %d", got, len(vecs))
+	}
+
+	const k = 10
+	recall := recallAtK(t, func(q []float32) []annHit { return h.search(q, k, 100) }, vecs, queries, k, nil)
+	if recall < 0.9 {
+		t.Errorf("recall@%d = %.3f, want >= 0.9", k, recall)
+	}
+}
+
+func TestHNSWInsertIgnoresInvalidVectors(t *testing.T) {
+	h := newHNSWIndex(8, 50)
+	h.insert(1, []float32{1, 0, 0})
+	h.insert(1, []float32{0, 1, 0}) // 重复 ID
+	h.insert(2, []float32{0, 0, 0}) // 零向量
+	h.insert(3, []float32{1, 0})    // 维度不一致
+	h.insert(4, nil)
+	if got := h.size(); got != 1 {
+		t.Fatalf("size = %d, want 1", got)
+	}
+	if hits := h.search([]float32{1, 0}, 1, 10); hits != nil {
+		t.Errorf("search with wrong dimension = %v, want nil", hits)
+	}
+}
+
+func TestHNSWSoftDelete(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	vecs := randomVectors(rng, 1500, 32)
+	queries := randomVectors(rng, 40, 32)
+
+	h := newHNSWIndex(16, 100)
+	for id, v := range vecs {
+		h.insert(id, v)
+	}
+
+	const k = 10
+	search := func(q []float32) []annHit { return h.search(q, k, 100) }
+	deleted := make(map[int]bool)
+	for _, step := range []struct {
+		name        string
+		deleteUntil int // 删除 ID 小于该值的节点
+		rebuild     bool
+	}{
+		{"30% deleted", 450, false},
+		{"60% deleted", 900, true},
+	} {
+		for id := 0; id < step.deleteUntil; id++ {
+			h.remove(id)
+			deleted[id] = true
+		}
+		h.remove(step.deleteUntil - 1) // 重复删除不影响计数
+
+		if got, want := h.size(), len(vecs)-len(deleted); got != want {
+			t.Fatalf("%s: size = %d, want %d", step.name, got, want)
+		}
+		if got := h.needsRebuild(); got != step.rebuild {
+			t.Errorf("%s: needsRebuild = %v, want %v", step.name, got, step.rebuild)
+		}
+		recall := recallAtK(t, search, vecs, queries, k, deleted)
+		if recall < 0.85 {
+			t.Errorf("%s: recall@%d = %.3f, want >= 0.85", step.name, k, recall)
+		}
+		for _, q := range queries {
+			if got := len(search(q)); got != k {
+				t.Fatalf("%s: got %d hits, want %d", step.name, got, k)
+			}
+		}
+	}
+}
+
+func TestHNSWReconcile(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	vecs := randomVectors(rng, 200, 16)
+	chunks := make([]CachedChunk, len(vecs))
+	for id, v := range vecs {
+		chunks[id] = CachedChunk{ID: id, Embedding: v}
+	}
+
+	h := newHNSWIndex(8, 50)
+	h.reconcile(chunks)
+	h.reconcile(chunks[50:]) // 前 50 个被删除
+	if got := h.size(); got != 150 {
+		t.Fatalf("size = %d, want 150", got)
+	}
+	for _, hit := range h.search(vecs[10], 150, 200) {
+		if hit.id < 50 {
+			t.Fatalf("reconcile kept removed chunk %d", hit.id)
+		}
+	}
+}
+
+// TestVectorCacheRebuildAfterDeletes 删除过半文档块后，向量缓存在后台用剩余文档块重建近似索引
+func TestVectorCacheRebuildAfterDeletes(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	vecs := randomVectors(rng, 600, 32)
+	queries := randomVectors(rng, 30, 32)
+	chunks := make([]CachedChunk, len(vecs))
+	for id, v := range vecs {
+		chunks[id] = CachedChunk{ID: id, DocumentID: id / 60, Embedding: v}
+	}
+
+	opts := VectorIndexOptions{MinChunks: 100, M: 16, EfConstruction: 100, EfSearch: 100}
+	ann := newHNSWIndex(opts.M, opts.EfConstruction)
+	ann.reconcile(chunks)
+	const sessionId = "rebuild-test"
+	vc := &VectorCache{
+		sessions: map[string]*SessionCache{sessionId: newSessionCache(chunks, ann, time.Now())},
+		building: make(map[string]bool),
+		ttl:      time.Hour,
+		opts:     opts,
+	}
+
+	// 删除 10 个文档中的 6 个（360 个文档块），超过一半后触发重建
+	deleted := make(map[int]bool)
+	for doc := 0; doc < 6; doc++ {
+		vc.RemoveDocument(sessionId, doc)
+		for id := doc * 60; id < (doc+1)*60; id++ {
+			deleted[id] = true
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var cache *SessionCache
+	for {
+		vc.mu.RLock()
+		cache = vc.sessions[sessionId]
+		building := vc.building[sessionId]
+		vc.mu.RUnlock()
+		if cache.ANN != ann && !building {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("index was not rebuilt after more than half of the chunks were removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := len(cache.Chunks); got != 240 {
+		t.Fatalf("cached chunks = %d, want 240", got)
+	}
+	if got := cache.ANN.size(); got != 240 {
+		t.Errorf("rebuilt index size = %d, want 240", got)
+	}
+	if cache.ANN.needsRebuild() {
+		t.Error("rebuilt index still needs a rebuild")
+	}
+	const k = 10
+	search := func(q []float32) []annHit { return cache.ANN.search(q, k, opts.EfSearch) }
+	if recall := recallAtK(t, search, vecs, queries, k, deleted); recall < 0.9 {
+		t.Errorf("recall@%d after rebuild = %.3f, want >= 0.9", k, recall)
+	}
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// maxRetryAfter 服务端要求的等待时间上限，避免一个请求被挂起过久
+const maxRetryAfter = 60 * time.Second
+
+// ErrCircuitOpen 熔断器打开期间直接拒绝请求
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// APIError 模型服务返回的非 2xx 响应
+type APIError struct {
+	Provider   string
+	Label      string // Chat、Embeddings 等，用于日志
+	StatusCode int
+	Body       interface{}   // 解析后的错误响应体（若能解析）
+	RetryAfter time.Duration // 服务端通过 Retry-After 要求的等待时间
+}
+
+func (e *APIError) Error() string {
+	if e.Body != nil {
+		return fmt.Sprintf("%s %s API request failed with status %d: %v", e.Provider, e.Label, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("%s %s API request failed with status %d", e.Provider, e.Label, e.StatusCode)
+}
+
+// Retryable 判断该状态码是否值得重试：超时、限流和服务端错误可以重试，
+// 请求本身有误（400/401/403/404/409/422 等）重试也不会成功
+func (e *APIError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// RetryPolicy 指数退避重试策略
+type RetryPolicy struct {
+	MaxRetries int           // 首次请求之外的最大重试次数
+	BaseDelay  time.Duration // 第一次重试的退避上限
+	MaxDelay   time.Duration // 单次退避的最大值
+}
+
+// backoff 返回第 attempt 次重试（从 0 开始）前的等待时间，使用 full jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << uint(attempt)
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"    // 正常放行
+	breakerOpen     = "open"      // 拒绝所有请求直到冷却结束
+	breakerHalfOpen = "half_open" // 冷却结束，放行一个探测请求
+)
+
+// CircuitBreaker 连续失败达到阈值后短暂停止请求，避免在服务宕机时持续冲击
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool // half_open 时是否已有探测请求在进行
+	threshold int
+	cooldown  time.Duration
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*CircuitBreaker)
+)
+
+// GetCircuitBreaker 获取 key（通常由 breakerKey 生成）对应的全局熔断器
+func GetCircuitBreaker(key string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[key]
+	if !ok {
+		b = &CircuitBreaker{state: breakerClosed, threshold: threshold, cooldown: cooldown}
+		breakers[key] = b
+	}
+	return b
+}
+
+// Allow 判断当前是否允许发出请求
+func (b *CircuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true // 阈值为 0 表示禁用熔断
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// RecordSuccess 请求成功，关闭熔断器
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// RecordFailure 记录一次服务端故障；探测失败或连续失败达到阈值时打开熔断器
+func (b *CircuitBreaker) RecordFailure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			fmt.Printf("警告：连续 %d 次请求失败，熔断器打开 %v。\n", b.failures, b.cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// RecordCancel 请求被调用方取消（不代表服务状态）；若它是半开状态下的探测请求，
+// 释放探测名额，让下一个请求重新探测，否则熔断器会一直拒绝请求
+func (b *CircuitBreaker) RecordCancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// State 返回熔断器当前状态
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// apiClient 所有模型服务共用的 HTTP 层：重试、退避、Retry-After 与熔断
+type apiClient struct {
+	provider   string
+	httpClient *http.Client
+	policy     RetryPolicy
+	breaker    *CircuitBreaker
+}
+
+// breakerKey 熔断器按提供方和服务地址（scheme://host）区分，
+// 同一提供方的不同网关（例如聊天和向量走不同的兼容服务）互不影响
+func breakerKey(provider string, apiURL string) string {
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Host == "" {
+		return provider + " " + apiURL
+	}
+	return provider + " " + u.Scheme + "://" + u.Host
+}
+
+// newAPIClient 创建 provider 访问 apiURL 使用的 HTTP 客户端
+func newAPIClient(cfg *config.Config, provider string, apiURL string, timeout time.Duration) *apiClient {
+	return &apiClient{
+		provider:   provider,
+		httpClient: &http.Client{Timeout: timeout},
+		policy: RetryPolicy{
+			MaxRetries: cfg.LLMMaxRetries,
+			BaseDelay:  time.Duration(cfg.LLMRetryBaseDelayMs) * time.Millisecond,
+			MaxDelay:   time.Duration(cfg.LLMRetryMaxDelayMs) * time.Millisecond,
+		},
+		breaker: GetCircuitBreaker(breakerKey(provider, apiURL), cfg.LLMBreakerThreshold, time.Duration(cfg.LLMBreakerCooldownSeconds)*time.Second),
+	}
+}
+
+// Do 发送请求，对网络错误和可重试状态码按策略重试。
+// 返回的响应状态码一定是 2xx；否则返回 *APIError、ErrCircuitOpen 或网络错误。
+// 请求体必须可以通过 GetBody 重新获取（http.NewRequest 搭配 bytes.Buffer 即可）。
+// 请求的 context 取消后不再重试，也不计入熔断（只释放半开状态的探测名额）
+func (c *apiClient) Do(req *http.Request, label string) (*http.Response, error) {
+	ctx := req.Context()
+	var lastErr error
+	for attempt := 0; attempt <= c.policy.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := c.policy.backoff(attempt - 1)
+			var apiErr *APIError
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > wait {
+				wait = apiErr.RetryAfter
+			}
+			fmt.Printf("%s %s 请求失败，%v 后第 %d 次重试: %v\n", c.provider, label, wait.Round(time.Millisecond), attempt, lastErr)
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, fmt.Errorf("%s %s API: %w", c.provider, label, err)
+			}
+
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, fmt.Errorf("failed to rewind request body: %w", err)
+				}
+				req.Body = body
+			}
+		}
+
+		if !c.breaker.Allow() {
+			return nil, fmt.Errorf("%s %s API: %w", c.provider, label, ErrCircuitOpen)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.breaker.RecordCancel()
+				return nil, fmt.Errorf("%s %s API: %w", c.provider, label, ctx.Err())
+			}
+			c.breaker.RecordFailure()
+			lastErr = fmt.Errorf("failed to send %s request to %s API: %w", label, c.provider, err)
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			c.breaker.RecordSuccess()
+			return resp, nil
+		}
+
+		apiErr := c.readAPIError(resp, label)
+		if apiErr.StatusCode >= 500 {
+			c.breaker.RecordFailure()
+		} else {
+			// 4xx 说明服务本身可用
+			c.breaker.RecordSuccess()
+		}
+		if !apiErr.Retryable() {
+			return nil, apiErr
+		}
+		lastErr = apiErr
+	}
+	return nil, lastErr
+}
+
+// sleepContext 等待 d，ctx 取消时提前返回 ctx.Err()
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// readAPIError 读取并关闭非 2xx 响应，构造 APIError
+func (c *apiClient) readAPIError(resp *http.Response, label string) *APIError {
+	defer resp.Body.Close()
+	apiErr := &APIError{
+		Provider:   c.provider,
+		Label:      label,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err == nil {
+		apiErr.Body = body
+	} else if text := strings.TrimSpace(string(data)); text != "" {
+		apiErr.Body = text
+	}
+	return apiErr
+}
+
+// parseRetryAfter 解析 retry-after-ms（OpenAI/Azure）和标准 Retry-After（秒或 HTTP 日期）
+func parseRetryAfter(h http.Header) time.Duration {
+	var d time.Duration
+	if ms, err := strconv.ParseFloat(h.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		d = time.Duration(ms * float64(time.Millisecond))
+	} else if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			d = time.Duration(secs * float64(time.Second))
+		} else if t, err := http.ParseTime(v); err == nil {
+			d = time.Until(t)
+		}
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// statusServer 依次返回 statuses 中的状态码（用完后一直返回最后一个），记录收到的请求数
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *int64) {
+	t.Helper()
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		status := statuses[min(int(n), len(statuses))-1]
+		if status != http.StatusOK {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"message":"test"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// testAPIClient 创建访问 srv 的 apiClient；每个测试服务的地址不同，熔断器互不影响
+func testAPIClient(srv *httptest.Server, maxRetries, threshold int, cooldown time.Duration) *apiClient {
+	c := newAPIClient(&config.Config{LLMMaxRetries: maxRetries, LLMRetryBaseDelayMs: 1, LLMRetryMaxDelayMs: 5, LLMBreakerThreshold: threshold}, "test", srv.URL, 5*time.Second)
+	c.breaker.cooldown = cooldown
+	return c
+}
+
+func doGet(t *testing.T, ctx context.Context, c *apiClient, url string) error {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req, "Test")
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusConflict, false},
+		{http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		if got := (&APIError{StatusCode: tt.status}).Retryable(); got != tt.want {
+			t.Errorf("Retryable(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 50; i++ {
+			if d := p.backoff(attempt); d < 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, ceiling)
+			}
+		}
+	}
+	if d := (RetryPolicy{}).backoff(3); d != 0 {
+		t.Errorf("backoff without delays = %v, want 0", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{"none", nil, 0},
+		{"seconds", map[string]string{"Retry-After": "2"}, 2 * time.Second},
+		{"fractional seconds", map[string]string{"Retry-After": "0.5"}, 500 * time.Millisecond},
+		{"milliseconds take precedence", map[string]string{"retry-after-ms": "250", "Retry-After": "9"}, 250 * time.Millisecond},
+		{"seconds capped at 60s", map[string]string{"Retry-After": "3600"}, maxRetryAfter},
+		{"milliseconds capped at 60s", map[string]string{"retry-after-ms": "900000"}, maxRetryAfter},
+		{"date capped at 60s", map[string]string{"Retry-After": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, maxRetryAfter},
+		{"past date", map[string]string{"Retry-After": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, 0},
+		{"garbage", map[string]string{"Retry-After": "soon"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			if got := parseRetryAfter(h); got != tt.want {
+				t.Errorf("parseRetryAfter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIClientHonoursRetryAfter(t *testing.T) {
+	srv, hits := statusServer(t, http.Header{"Retry-After": {"0.3"}}, http.StatusTooManyRequests, http.StatusOK)
+	c := testAPIClient(srv, 3, 5, time.Minute)
+
+	start := time.Now()
+	if err := doGet(t, context.Background(), c, srv.URL); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("retried after %v, want at least the 300ms Retry-After", elapsed)
+	}
+	if got := atomic.LoadInt64(hits); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
+
+func TestAPIClientCapsRetryAfter(t *testing.T) {
+	srv, _ := statusServer(t, http.Header{"Retry-After": {"3600"}}, http.StatusTooManyRequests)
+	c := testAPIClient(srv, 0, 5, time.Minute)
+
+	err := doGet(t, context.Background(), c, srv.URL)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("err = %v, want a 429 APIError", err)
+	}
+	if apiErr.RetryAfter != maxRetryAfter {
+		t.Errorf("RetryAfter = %v, want %v", apiErr.RetryAfter, maxRetryAfter)
+	}
+}
+
+func TestAPIClientDoesNotRetryConflict(t *testing.T) {
+	srv, hits := statusServer(t, nil, http.StatusConflict)
+	c := testAPIClient(srv, 3, 5, time.Minute)
+
+	err := doGet(t, context.Background(), c, srv.URL)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("err = %v, want a 409 APIError", err)
+	}
+	if got := atomic.LoadInt64(hits); got != 1 {
+		t.Errorf("requests = %d, want 1 (409 must not be retried)", got)
+	}
+	if got := c.breaker.State(); got != breakerClosed {
+		t.Errorf("breaker = %s after a 4xx, want closed", got)
+	}
+}
+
+func TestAPIClientBreakerOpensAndRecovers(t *testing.T) {
+	srv, hits := statusServer(t, nil, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	c := testAPIClient(srv, 0, 2, 100*time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := doGet(t, ctx, c, srv.URL); err == nil {
+			t.Fatalf("request %d succeeded, want a 500", i+1)
+		}
+	}
+	if got := c.breaker.State(); got != breakerOpen {
+		t.Fatalf("breaker = %s after 2 failures, want open", got)
+	}
+	if err := doGet(t, ctx, c, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v while open, want ErrCircuitOpen", err)
+	}
+	if got := atomic.LoadInt64(hits); got != 2 {
+		t.Fatalf("requests = %d, the open breaker must not reach the server", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	// 冷却结束后只放行一个探测请求
+	if !c.breaker.Allow() {
+		t.Fatal("breaker rejected the half-open probe")
+	}
+	if got := c.breaker.State(); got != breakerHalfOpen {
+		t.Fatalf("breaker = %s, want half_open", got)
+	}
+	if c.breaker.Allow() {
+		t.Fatal("breaker admitted a second probe while half-open")
+	}
+	c.breaker.RecordCancel() // 释放上面手动占用的探测名额
+
+	if err := doGet(t, ctx, c, srv.URL); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if got := c.breaker.State(); got != breakerClosed {
+		t.Errorf("breaker = %s after a successful probe, want closed", got)
+	}
+	if err := doGet(t, ctx, c, srv.URL); err != nil {
+		t.Errorf("request after recovery: %v", err)
+	}
+}
+
+func TestAPIClientFailedProbeReopens(t *testing.T) {
+	srv, _ := statusServer(t, nil, http.StatusInternalServerError)
+	c := testAPIClient(srv, 0, 1, 50*time.Millisecond)
+	ctx := context.Background()
+
+	doGet(t, ctx, c, srv.URL)
+	time.Sleep(80 * time.Millisecond)
+	if err := doGet(t, ctx, c, srv.URL); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("probe err = %v, want the server's 500", err)
+	}
+	if got := c.breaker.State(); got != breakerOpen {
+		t.Errorf("breaker = %s after a failed probe, want open", got)
+	}
+}
+
+func TestAPIClientCancelledProbeReleasesSlot(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			// 第一个请求（探测）一直挂起，直到客户端取消
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	c := testAPIClient(srv, 0, 1, 10*time.Millisecond)
+	c.breaker.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := doGet(t, ctx, c, srv.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("probe err = %v, want context.DeadlineExceeded", err)
+	}
+	if got := c.breaker.State(); got != breakerHalfOpen {
+		t.Fatalf("breaker = %s after a cancelled probe, want half_open", got)
+	}
+	// 被取消的探测释放了名额，下一个请求可以重新探测并关闭熔断器
+	if err := doGet(t, context.Background(), c, srv.URL); err != nil {
+		t.Fatalf("next probe: %v", err)
+	}
+	if got := c.breaker.State(); got != breakerClosed {
+		t.Errorf("breaker = %s, want closed", got)
+	}
+}
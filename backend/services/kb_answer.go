@@ -0,0 +1,306 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// kbAnswerInstruction 追加在知识库系统提示词之后，要求模型按结构化格式作答
+const kbAnswerInstruction = `
+
+## 输出格式
+只输出一个 JSON 对象，不要输出其他内容：
+{"answer": "使用 Markdown 的回答", "confidence": 0 到 1 之间的数字，表示资料对回答的支持程度, "citations": [回答中引用的相关信息片段编号]}
+如果资料不足以回答，answer 中说明原因，confidence 给出较低的值，citations 为空数组。`
+
+// kbAnswerSchema 知识库回答的 JSON Schema，answer 放在最前面以便流式提取
+var kbAnswerSchema = &ResponseFormat{
+	Type: "json_schema",
+	JSONSchema: &JSONSchemaSpec{
+		Name:   "kb_answer",
+		Strict: true,
+		Schema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"answer":     map[string]interface{}{"type": "string"},
+				"confidence": map[string]interface{}{"type": "number"},
+				"citations": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "integer"},
+				},
+			},
+			"required":             []string{"answer", "confidence", "citations"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// KBAnswer 知识库回答及其引用来源
+type KBAnswer struct {
+	Answer     string
+	Confidence *float64 // 非结构化回答时为 nil
+	ChunkIDs   []int    // 引用的 document_chunks.id，按引用顺序
+	Structured bool     // 是否成功解析为结构化回答
+	Model      string   // 实际生成回答的模型（可能是备用模型）
+}
+
+// StreamKBAnswer 基于检索到的片段生成知识库回答，并给出置信度和引用的片段。
+// 开启 KB_STRUCTURED_ANSWERS 时要求模型输出 JSON，流式回调只收到其中的 answer 文本；
+// 提供方不支持 response_format 时退回到仅靠提示词约束，解析失败时整段文本作为回答并引用全部片段
+func (client *AIClient) StreamKBAnswer(ctx context.Context, db *sql.DB, cfg *config.Config, sessionId string, question string, chunks []models.DocumentChunk, onDelta StreamHandler) (*KBAnswer, error) {
+	if len(chunks) == 0 {
+		return &KBAnswer{Answer: "知识库中没有找到相关信息来回答这个问题。"}, nil
+	}
+
+	contextStr := kbContext(chunks)
+	client.trace.setContext(contextStr)
+	kbPromptTemplate := client.promptTemplate(db, sessionId, "kb", cfg.KnowledgeBaseSystemPrompt)
+	systemPrompt := RenderPrompt("kb", kbPromptTemplate, newPromptVars(db, sessionId, question, contextStr))
+	settings := loadGenerationSettings(db, sessionId, "kb")
+
+	if !cfg.KBStructuredAnswers {
+		messages := []ChatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: question},
+		}
+		result, err := client.complete(ctx, messages, "KB", models.AIUsagePurposeKB, settings, nil, onDelta)
+		if err != nil {
+			return nil, err
+		}
+		return &KBAnswer{Answer: result.Content, ChunkIDs: allChunkIDs(chunks), Model: result.Model}, nil
+	}
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt + kbAnswerInstruction},
+		{Role: "user", Content: question},
+	}
+	result, err := client.complete(ctx, messages, "KB", models.AIUsagePurposeKB, settings, kbAnswerSchema, newJSONFieldStreamer("answer", onDelta))
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+		// 部分兼容服务或模型不支持 json_schema，去掉 response_format 重试一次
+		fmt.Printf("KB 结构化输出请求被拒绝，改为仅通过提示词约束格式: %v\n", err)
+		result, err = client.complete(ctx, messages, "KB", models.AIUsagePurposeKB, settings, nil, newJSONFieldStreamer("answer", onDelta))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	answer := parseKBAnswer(result.Content, chunks)
+	answer.Model = result.Model
+	if !answer.Structured {
+		fmt.Printf("警告：KB 回答不是有效的 JSON，按纯文本处理。\n")
+		answer.ChunkIDs = allChunkIDs(chunks)
+	}
+	return answer, nil
+}
+
+// kbContext 把检索到的片段拼接为提示词中的参考资料，片段编号从 1 开始
+func kbContext(chunks []models.DocumentChunk) string {
+	contextStr := ""
+	for i, chunk := range chunks {
+		contextStr += fmt.Sprintf("相关信息片段 %d:\n\"%s\"\n\n", i+1, chunk.Content)
+	}
+	return contextStr
+}
+
+// parseKBAnswer 解析模型输出的结构化回答；无法解析时把整段文本当作回答
+func parseKBAnswer(text string, chunks []models.DocumentChunk) *KBAnswer {
+	raw := strings.TrimSpace(text)
+	start, end := strings.Index(raw, "{"), strings.LastIndex(raw, "}")
+	if start >= 0 && end > start {
+		var parsed struct {
+			Answer     string   `json:"answer"`
+			Confidence *float64 `json:"confidence"`
+			Citations  []int    `json:"citations"`
+		}
+		if err := json.Unmarshal([]byte(raw[start:end+1]), &parsed); err == nil && strings.TrimSpace(parsed.Answer) != "" {
+			answer := &KBAnswer{Answer: parsed.Answer, Structured: true}
+			if parsed.Confidence != nil {
+				c := *parsed.Confidence
+				if c < 0 {
+					c = 0
+				} else if c > 1 {
+					c = 1
+				}
+				answer.Confidence = &c
+			}
+			answer.ChunkIDs = citedChunkIDs(parsed.Citations, chunks)
+			return answer
+		}
+	}
+	return &KBAnswer{Answer: text}
+}
+
+// citedChunkIDs 将片段编号（从 1 开始）映射为文档块 ID，忽略越界和重复的编号
+func citedChunkIDs(citations []int, chunks []models.DocumentChunk) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, n := range citations {
+		if n < 1 || n > len(chunks) || seen[n] {
+			continue
+		}
+		seen[n] = true
+		ids = append(ids, chunks[n-1].ID)
+	}
+	return ids
+}
+
+// allChunkIDs 非结构化回答无法确定具体引用，把提供给模型的全部片段作为来源
+func allChunkIDs(chunks []models.DocumentChunk) []int {
+	ids := make([]int, 0, len(chunks))
+	for _, chunk := range chunks {
+		ids = append(ids, chunk.ID)
+	}
+	return ids
+}
+
+// jsonFieldStreamer 从流式输出的 JSON 中实时提取某个字符串字段的内容并转发，
+// 让演讲者在结构化模式下仍能看到逐字生成的回答。
+// 如果输出不是以 JSON 开头（模型未遵守格式），则原样转发
+type jsonFieldStreamer struct {
+	key     string
+	onDelta StreamHandler
+
+	buf           strings.Builder // 找到字段开头之前的输出
+	mode          int
+	escape        bool
+	unicode       []byte // 正在读取的 \uXXXX 十六进制位
+	partial       string // 被增量截断的不完整 UTF-8 字符
+	highSurrogate rune
+}
+
+// jsonFieldStreamer 的状态
+const (
+	streamUndecided   = iota // 尚未看到第一个非空白字符
+	streamPassthrough        // 非 JSON 输出，原样转发
+	streamSeeking            // JSON 输出，寻找字段开头
+	streamInField            // 正在输出字段内容
+	streamDone               // 字段已结束
+)
+
+// newJSONFieldStreamer 创建提取 key 字段的流式回调；onDelta 为 nil 时返回 nil
+func newJSONFieldStreamer(key string, onDelta StreamHandler) StreamHandler {
+	if onDelta == nil {
+		return nil
+	}
+	s := &jsonFieldStreamer{key: key, onDelta: onDelta}
+	return s.write
+}
+
+// write 处理一段增量
+func (s *jsonFieldStreamer) write(delta string) {
+	switch s.mode {
+	case streamUndecided:
+		trimmed := strings.TrimLeft(delta, " \t\r\n")
+		if trimmed == "" {
+			return
+		}
+		if trimmed[0] == '{' || trimmed[0] == '`' {
+			s.mode = streamSeeking
+		} else {
+			s.mode = streamPassthrough
+		}
+		s.write(trimmed)
+	case streamPassthrough:
+		s.onDelta(delta)
+	case streamSeeking:
+		s.buf.WriteString(delta)
+		buffered := s.buf.String()
+		idx := strings.Index(buffered, strconv.Quote(s.key))
+		if idx < 0 {
+			return
+		}
+		rest := buffered[idx+len(s.key)+2:]
+		colon := strings.Index(rest, ":")
+		if colon < 0 {
+			return
+		}
+		afterColon := strings.TrimLeft(rest[colon+1:], " \t\r\n")
+		if afterColon == "" {
+			return
+		}
+		if afterColon[0] != '"' {
+			s.mode = streamDone // 字段不是字符串，放弃流式提取
+			return
+		}
+		s.mode = streamInField
+		s.buf.Reset()
+		s.write(afterColon[1:])
+	case streamInField:
+		if text := s.decode(delta); text != "" {
+			s.onDelta(text)
+		}
+	}
+}
+
+// decode 解码字段内容中的 JSON 转义，遇到未转义的引号时结束
+func (s *jsonFieldStreamer) decode(delta string) string {
+	var out strings.Builder
+	delta, s.partial = s.partial+delta, ""
+	for i := 0; i < len(delta) && s.mode == streamInField; {
+		r, size := utf8.DecodeRuneInString(delta[i:])
+		if r == utf8.RuneError && !utf8.FullRuneInString(delta[i:]) {
+			s.partial = delta[i:]
+			break
+		}
+		i += size
+		switch {
+		case s.unicode != nil:
+			s.unicode = append(s.unicode, byte(r))
+			if len(s.unicode) < 4 {
+				continue
+			}
+			code, err := strconv.ParseUint(string(s.unicode), 16, 32)
+			s.unicode = nil
+			if err != nil {
+				continue
+			}
+			cr := rune(code)
+			if utf16.IsSurrogate(cr) {
+				if s.highSurrogate == 0 {
+					s.highSurrogate = cr
+					continue
+				}
+				cr = utf16.DecodeRune(s.highSurrogate, cr)
+				s.highSurrogate = 0
+			}
+			out.WriteRune(cr)
+		case s.escape:
+			s.escape = false
+			switch r {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case 'r':
+				out.WriteByte('\r')
+			case 'b':
+				out.WriteByte('\b')
+			case 'f':
+				out.WriteByte('\f')
+			case 'u':
+				s.unicode = make([]byte, 0, 4)
+			default: // \" \\ \/
+				out.WriteRune(r)
+			}
+		case r == '\\':
+			s.escape = true
+		case r == '"':
+			s.mode = streamDone
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
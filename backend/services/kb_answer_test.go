@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+func TestJSONFieldStreamer(t *testing.T) {
+	smile := "\U0001F600"
+	zhong := "中"
+	tests := []struct {
+		name   string
+		deltas []string
+		want   string
+	}{
+		{"split value", []string{`{"answer": "Hel`, `lo", "confidence": 1}`}, "Hello"},
+		{"split key", []string{`{"ans`, `wer"`, ` `, `:`, ` "Hi"}`}, "Hi"},
+		{"answer after other keys", []string{`{"confidence": 0.9, "citations": [1, 2], `, `"answer": "late`, ` answer"}`}, "late answer"},
+		{"leading whitespace", []string{"  \n", `{"answer":"x"}`}, "x"},
+		{"code fence", []string{"```json\n", `{"answer":"fenced"}`, "\n```"}, "fenced"},
+		{"escapes split across deltas", []string{`{"answer":"a\`, `nb \`, `"q\" c\\`, `\d\t\/"}`}, "a\nb \"q\" c\\d\t/"},
+		{"unicode escape split", []string{`{"answer":"caf\u00`, `e9 \u`, `4e2d`, `"}`}, "café 中"},
+		{"surrogate pair split", []string{`{"answer":"\ud83d`, `\ude00!"}`}, smile + "!"},
+		{"utf-8 bytes split", []string{`{"answer":"` + zhong[:2], zhong[2:] + `文"}`}, "中文"},
+		{"stops at closing quote", []string{`{"answer":"done"`, `, "note": "ignored"}`}, "done"},
+		{"non-string answer", []string{`{"answer": 42, "note": "x"}`}, ""},
+		{"plain text passthrough", []string{"Plain ", "text {not json}"}, "Plain text {not json}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			write := newJSONFieldStreamer("answer", func(delta string) { got.WriteString(delta) })
+			for _, d := range tt.deltas {
+				write(d)
+			}
+			if got.String() != tt.want {
+				t.Errorf("streamed %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+	if newJSONFieldStreamer("answer", nil) != nil {
+		t.Error("newJSONFieldStreamer with a nil handler should return nil")
+	}
+}
+
+func TestParseKBAnswer(t *testing.T) {
+	chunks := []models.DocumentChunk{{ID: 10}, {ID: 20}, {ID: 30}}
+	conf := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name string
+		text string
+		want KBAnswer
+	}{
+		{
+			name: "structured",
+			text: `{"answer": "A", "confidence": 0.7, "citations": [2]}`,
+			want: KBAnswer{Answer: "A", Confidence: conf(0.7), ChunkIDs: []int{20}, Structured: true},
+		},
+		{
+			name: "citations out of range or repeated",
+			text: `{"answer": "A", "confidence": 0.5, "citations": [3, 0, 1, 3, 4, -1, 1]}`,
+			want: KBAnswer{Answer: "A", Confidence: conf(0.5), ChunkIDs: []int{30, 10}, Structured: true},
+		},
+		{
+			name: "no valid citations",
+			text: `{"answer": "A", "confidence": 0.1, "citations": [9]}`,
+			want: KBAnswer{Answer: "A", Confidence: conf(0.1), Structured: true},
+		},
+		{
+			name: "confidence clamped high",
+			text: `{"answer": "A", "confidence": 1.5, "citations": []}`,
+			want: KBAnswer{Answer: "A", Confidence: conf(1), Structured: true},
+		},
+		{
+			name: "confidence clamped low",
+			text: `{"answer": "A", "confidence": -0.2, "citations": []}`,
+			want: KBAnswer{Answer: "A", Confidence: conf(0), Structured: true},
+		},
+		{
+			name: "missing confidence",
+			text: `{"answer": "A", "citations": [1]}`,
+			want: KBAnswer{Answer: "A", ChunkIDs: []int{10}, Structured: true},
+		},
+		{
+			name: "answer after other keys in a code fence",
+			text: "```json\n{\"citations\": [1], \"confidence\": 0.9, \"answer\": \"A\"}\n```",
+			want: KBAnswer{Answer: "A", Confidence: conf(0.9), ChunkIDs: []int{10}, Structured: true},
+		},
+		{
+			name: "plain text",
+			text: "Just an answer.",
+			want: KBAnswer{Answer: "Just an answer."},
+		},
+		{
+			name: "invalid json",
+			text: `{"answer": "A", "citations": [1,}`,
+			want: KBAnswer{Answer: `{"answer": "A", "citations": [1,}`},
+		},
+		{
+			name: "empty answer",
+			text: `{"answer": " ", "confidence": 0.9, "citations": [1]}`,
+			want: KBAnswer{Answer: `{"answer": " ", "confidence": 0.9, "citations": [1]}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseKBAnswer(tt.text, chunks)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseKBAnswer = %+v (confidence %v), want %+v (confidence %v)", *got, deref(got.Confidence), tt.want, deref(tt.want.Confidence))
+			}
+		})
+	}
+}
+
+func deref(f *float64) interface{} {
+	if f == nil {
+		return nil
+	}
+	return *f
+}
+
+// unreachableDB 返回一个连不上的数据库：查询都会失败，提示词和生成参数退回默认值
+func unreachableDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/anyqa?timeout=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestStreamKBAnswerRetriesWithoutResponseFormat 提供方以 400 拒绝 response_format 时去掉它重试一次
+func TestStreamKBAnswerRetriesWithoutResponseFormat(t *testing.T) {
+	var withFormat, withoutFormat int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResponseFormat json.RawMessage `json:"response_format"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if len(req.ResponseFormat) > 0 && string(req.ResponseFormat) != "null" {
+			atomic.AddInt64(&withFormat, 1)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"response_format json_schema is not supported"}}`))
+			return
+		}
+		atomic.AddInt64(&withoutFormat, 1)
+		content := `{"answer": "Garage B.", "confidence": 0.8, "citations": [2, 2, 5]}`
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"model":   "test-model",
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	defer srv.Close()
+
+	cfg := config.NewConfig()
+	cfg.LLMProvider = "openai"
+	cfg.OpenAIAPIKey = "test-key"
+	cfg.OpenAIAPIUrl = srv.URL + "/v1/chat/completions"
+	cfg.OpenAIModel = "test-model"
+	cfg.OpenAIStream = false
+	cfg.KBStructuredAnswers = true
+	cfg.LLMMaxRetries = 2
+	client, err := NewAIClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := []models.DocumentChunk{{ID: 7, Content: "Parking is in garage A."}, {ID: 8, Content: "Visitors park in garage B."}}
+	answer, err := client.StreamKBAnswer(context.Background(), unreachableDB(t), cfg, "s1", "Where do visitors park?", chunks, nil)
+	if err != nil {
+		t.Fatalf("StreamKBAnswer: %v", err)
+	}
+	if atomic.LoadInt64(&withFormat) != 1 || atomic.LoadInt64(&withoutFormat) != 1 {
+		t.Errorf("requests with/without response_format = %d/%d, want 1/1 (400 must not be retried as is)", withFormat, withoutFormat)
+	}
+	if !answer.Structured || answer.Answer != "Garage B." || !reflect.DeepEqual(answer.ChunkIDs, []int{8}) {
+		t.Errorf("answer = %+v, want the structured answer citing chunk 8", answer)
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 参数
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// lexicalDoc 一个文档块的词频统计
+type lexicalDoc struct {
+	tf     map[string]int
+	length int
+}
+
+// lexicalIndex 会话文档块的 BM25 倒排统计，与 CachedChunk 一一对应，随向量缓存一起构建和失效
+type lexicalIndex struct {
+	docs   []lexicalDoc
+	df     map[string]int // 包含该词的文档块数
+	avgLen float64
+}
+
+// lexicalHit 一个文档块的 BM25 得分，index 为它在会话缓存中的下标
+type lexicalHit struct {
+	index int
+	score float64
+}
+
+// newLexicalIndex 为会话的文档块建立 BM25 索引
+func newLexicalIndex(chunks []CachedChunk) *lexicalIndex {
+	idx := &lexicalIndex{docs: make([]lexicalDoc, len(chunks)), df: make(map[string]int)}
+	total := 0
+	for i, chunk := range chunks {
+		tokens := tokenize(chunk.Content)
+		tf := make(map[string]int, len(tokens))
+		for _, tok := range tokens {
+			tf[tok]++
+		}
+		for tok := range tf {
+			idx.df[tok]++
+		}
+		idx.docs[i] = lexicalDoc{tf: tf, length: len(tokens)}
+		total += len(tokens)
+	}
+	if len(chunks) > 0 {
+		idx.avgLen = float64(total) / float64(len(chunks))
+	}
+	return idx
+}
+
+// search 返回与查询至少有一个共同词的文档块，按 BM25 得分降序排列
+func (idx *lexicalIndex) search(query string) []lexicalHit {
+	if idx == nil || len(idx.docs) == 0 || idx.avgLen == 0 {
+		return nil
+	}
+	// 查询中重复的词只计一次，避免长问题里反复出现的词压过其他词
+	seen := make(map[string]bool)
+	var terms []string
+	for _, tok := range tokenize(query) {
+		if !seen[tok] && idx.df[tok] > 0 {
+			seen[tok] = true
+			terms = append(terms, tok)
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+
+	n := float64(len(idx.docs))
+	var hits []lexicalHit
+	for i, doc := range idx.docs {
+		score := 0.0
+		for _, term := range terms {
+			f := float64(doc.tf[term])
+			if f == 0 {
+				continue
+			}
+			df := float64(idx.df[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(doc.length)/idx.avgLen))
+		}
+		if score > 0 {
+			hits = append(hits, lexicalHit{index: i, score: score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+	return hits
+}
+
+// tokenize 把文本切分为检索用的词：字母和数字按连续片段成词（转为小写，全角转半角），
+// 中日韩文字没有空格分词，按相邻两字切分（单个字单独成词），例如 "张三的AB-12" 切分为 张三、三的、ab、12
+func tokenize(text string) []string {
+	var tokens []string
+	var word, cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) == 1 {
+			tokens = append(tokens, string(cjk))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		// 全角字母数字（Ａ、１）折算为半角，与半角写法匹配
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r = unicode.ToLower(r - 0xFEE0)
+		}
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+// isCJK 判断是否为需要按字切分的中日韩文字
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"ascii words are lowercased and split on punctuation", "Hello, World! AB-12", []string{"hello", "world", "ab", "12"}},
+		{"cjk bigrams", "知识库检索", []string{"知识", "识库", "库检", "检索"}},
+		{"single cjk character", "我", []string{"我"}},
+		{"mixed cjk and ascii", "张三的AB-12", []string{"张三", "三的", "ab", "12"}},
+		{"cjk run between ascii words", "iPhone15和华为Mate60", []string{"iphone15", "和华", "华为", "mate60"}},
+		{"full-width letters and digits fold to half-width", "ＡＢＣ１２３", []string{"abc123"}},
+		{"full-width punctuation separates tokens", "（测试）ＧＰＴ－４", []string{"测试", "gpt", "4"}},
+		{"hangul and hiragana", "한국어 test ひらがな", []string{"한국", "국어", "test", "ひら", "らが", "がな"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexicalIndexScore(t *testing.T) {
+	// 两个文档块："a b"（长度 2）和 "c"（长度 1），平均长度 1.5；
+	// 查询 "a"：idf = ln(1 + (2-1+0.5)/(1+0.5)) = ln 2，tf = 1，
+	// score = ln2 * 1*(k1+1) / (1 + k1*(1-b+b*2/1.5)) = ln2 * 2.2 / 2.5
+	idx := newLexicalIndex([]CachedChunk{{Content: "a b"}, {Content: "c"}})
+	hits := idx.search("a")
+	if len(hits) != 1 || hits[0].index != 0 {
+		t.Fatalf("hits = %+v, want only chunk 0", hits)
+	}
+	if want := math.Ln2 * 2.2 / 2.5; math.Abs(hits[0].score-want) > 1e-9 {
+		t.Errorf("score = %v, want %v", hits[0].score, want)
+	}
+}
+
+func TestLexicalIndexRanking(t *testing.T) {
+	chunks := []CachedChunk{
+		{Content: "the quick brown fox"},
+		{Content: "quick quick fox the"},
+		{Content: "a lazy dog sleeps all day"},
+		{Content: "产品型号 AB-12 的保修期为两年"},
+		{Content: "产品说明书"},
+		{Content: "quick fox"},
+	}
+	idx := newLexicalIndex(chunks)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		// 较短的文档块长度归一化后得分更高；词频更高的排在只出现一次的前面
+		{"term frequency and length normalization", "quick fox", []int{5, 1, 0}},
+		{"rare term outweighs common term", "lazy the", []int{2, 0, 1}},
+		{"exact model number and cjk", "AB-12 保修多久", []int{3}},
+		{"shared cjk bigram", "产品", []int{4, 3}},
+		{"repeated query terms count once", "fox fox fox", []int{5, 0, 1}},
+		{"no matching terms", "elephant", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, hit := range idx.search(tt.query) {
+				got = append(got, hit.index)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// 支持的模型服务提供方
+const (
+	ProviderOpenAI    = "openai"    // OpenAI 官方 API
+	ProviderAzure     = "azure"     // Azure OpenAI 部署
+	ProviderAnthropic = "anthropic" // Anthropic Messages API（不提供向量接口）
+	ProviderOllama    = "ollama"    // 本地 Ollama / llama.cpp 等 OpenAI 兼容服务
+	ProviderLocal     = "local"     // 本地 OpenAI 兼容向量服务（仅向量）
+)
+
+// ChatRequest 提供方无关的聊天请求
+type ChatRequest struct {
+	Messages []ChatMessage
+	Model    string // 为空时使用提供方的默认模型
+
+	// 生成参数，nil 表示使用服务端默认值
+	Temperature *float64
+	MaxTokens   *int
+	TopP        *float64
+
+	// 结构化输出格式，仅 OpenAI 兼容提供方使用；Anthropic 依靠提示词约束格式
+	ResponseFormat *ResponseFormat
+}
+
+// ChatResult 聊天请求的结果
+type ChatResult struct {
+	Content string
+	Model   string
+	Usage   UsageData
+}
+
+// EmbeddingResult 向量请求的结果
+type EmbeddingResult struct {
+	Embeddings [][]float32 // 与输入文本一一对应
+	Model      string
+	Usage      UsageData
+}
+
+// ChatProvider 聊天补全提供方
+type ChatProvider interface {
+	// Name 返回提供方名称，用于日志
+	Name() string
+	// Chat 发送聊天请求；onDelta 不为 nil 时以流式方式请求并逐段回调。
+	// ctx 取消后请求（包括正在读取的流）立即中止
+	Chat(ctx context.Context, req ChatRequest, onDelta StreamHandler) (*ChatResult, error)
+}
+
+// EmbeddingProvider 文本向量提供方
+type EmbeddingProvider interface {
+	// Name 返回提供方名称，用于日志
+	Name() string
+	// Embed 获取一批文本的向量
+	Embed(ctx context.Context, texts []string) (*EmbeddingResult, error)
+}
+
+// NewChatProvider 根据 cfg.LLMProvider 创建聊天提供方
+func NewChatProvider(cfg *config.Config) (ChatProvider, error) {
+	return newChatProviderByName(cfg, cfg.LLMProvider)
+}
+
+// newChatProviderByName 创建指定名称的聊天提供方，备用模型列表也通过它创建
+func newChatProviderByName(cfg *config.Config, name string) (ChatProvider, error) {
+	switch strings.ToLower(name) {
+	case "", ProviderOpenAI:
+		return newOpenAIProvider(cfg), nil
+	case ProviderAzure:
+		return newAzureOpenAIProvider(cfg), nil
+	case ProviderAnthropic:
+		return newAnthropicProvider(cfg), nil
+	case ProviderOllama:
+		return newOllamaProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported LLM provider %q", name)
+	}
+}
+
+// NewEmbeddingProvider 根据 cfg.EmbeddingProvider 创建向量提供方，未配置时沿用 cfg.LLMProvider。
+// Anthropic 没有向量接口，此时必须显式配置 EMBEDDING_PROVIDER，不会悄悄把文档发给 OpenAI
+func NewEmbeddingProvider(cfg *config.Config) (EmbeddingProvider, error) {
+	name := strings.ToLower(cfg.EmbeddingProvider)
+	if name == "" {
+		name = strings.ToLower(cfg.LLMProvider)
+		if name == ProviderAnthropic {
+			return nil, fmt.Errorf("LLM_PROVIDER=anthropic has no embeddings API; set EMBEDDING_PROVIDER explicitly (openai, azure, ollama or local)")
+		}
+	}
+
+	switch name {
+	case "", ProviderOpenAI:
+		return newOpenAIEmbeddingProvider(cfg)
+	case ProviderAzure:
+		return newAzureOpenAIProvider(cfg), nil
+	case ProviderOllama:
+		return newOllamaProvider(cfg), nil
+	case ProviderLocal:
+		return newLocalEmbeddingProvider(cfg), nil
+	case ProviderAnthropic:
+		return nil, fmt.Errorf("provider %q does not support embeddings", name)
+	default:
+		return nil, fmt.Errorf("unsupported embedding provider %q", name)
+	}
+}
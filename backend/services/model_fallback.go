@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// chatTarget 一个可以发送聊天请求的提供方与模型组合
+type chatTarget struct {
+	provider ChatProvider
+	model    string // 为空时使用提供方默认模型或会话设置的模型
+}
+
+// String 返回用于日志的 "provider/model"
+func (t chatTarget) String() string {
+	if t.model == "" {
+		return t.provider.Name() + "/default"
+	}
+	return t.provider.Name() + "/" + t.model
+}
+
+// parseFallbackChain 解析备用模型列表，格式为逗号分隔的 "provider:model" 或 "model"，
+// 省略提供方时使用 LLM_PROVIDER。同一提供方共用一个实例（以及熔断器）
+func parseFallbackChain(cfg *config.Config, spec string, primary ChatProvider) ([]chatTarget, error) {
+	providers := map[string]ChatProvider{primary.Name(): primary}
+	var chain []chatTarget
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, model := primary.Name(), entry
+		if i := strings.Index(entry, ":"); i > 0 {
+			if candidate := strings.ToLower(entry[:i]); isChatProviderName(candidate) {
+				name, model = candidate, strings.TrimSpace(entry[i+1:])
+			}
+		}
+		provider, ok := providers[name]
+		if !ok {
+			var err error
+			provider, err = newChatProviderByName(cfg, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fallback model %q: %w", entry, err)
+			}
+			providers[name] = provider
+		}
+		chain = append(chain, chatTarget{provider: provider, model: model})
+	}
+	return chain, nil
+}
+
+// isChatProviderName 判断是否为支持聊天的提供方名称（用于区分 "ollama:llama3" 与带冒号的模型名）
+func isChatProviderName(name string) bool {
+	switch name {
+	case ProviderOpenAI, ProviderAzure, ProviderAnthropic, ProviderOllama:
+		return true
+	}
+	return false
+}
+
+// loadFallbackChains 读取通用建议和知识库回答各自的备用模型列表
+func loadFallbackChains(cfg *config.Config, primary ChatProvider) (map[string][]chatTarget, error) {
+	generic, err := parseFallbackChain(cfg, cfg.GenericFallbackModels, primary)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := parseFallbackChain(cfg, cfg.KBFallbackModels, primary)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]chatTarget{
+		models.AIUsagePurposeGeneric: generic,
+		models.AIUsagePurposeKB:      kb,
+	}, nil
+}
+
+// shouldFallback 判断失败是否值得换下一个模型：超时、网络错误、限流、5xx 和熔断。
+// 请求本身有误（400/401/404 等）换模型通常也无济于事
+func shouldFallback(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/mockopenai"
+)
+
+// 集成测试使用的 MySQL DSN，例如 root:root@tcp(127.0.0.1:3306)/anyqa_test?parseTime=true
+const testDSNEnv = "ANYQA_TEST_DSN"
+
+// openTestDB 连接 ANYQA_TEST_DSN 指定的数据库并执行 schema.sql，未设置时跳过测试
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s 未设置，跳过需要 MySQL 的测试", testDSNEnv)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping db: %v", err)
+	}
+
+	schema, err := os.ReadFile(filepath.Join("..", "..", "schema.sql"))
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(schema), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("apply schema: %v\n%s", err, stmt)
+		}
+	}
+	return db
+}
+
+// TestDocumentPipeline 针对模拟 OpenAI 服务走完整个知识库流程：上传文档 -> 检索 -> 生成回答
+func TestDocumentPipeline(t *testing.T) {
+	db := openTestDB(t)
+	srv := mockopenai.NewTestServer(mockopenai.Options{APIKey: "test-key"})
+	defer srv.Close()
+
+	cfg := config.NewConfig()
+	cfg.LLMProvider = "openai"
+	cfg.EmbeddingProvider = ""
+	cfg.OpenAIAPIKey = "test-key"
+	cfg.OpenAIAPIUrl = srv.URL + "/v1/chat/completions"
+	cfg.OpenAIEmbeddingURL = ""
+	cfg.OpenAIStream = true
+
+	sessionID := fmt.Sprintf("pipeline-%d", time.Now().UnixNano())
+	if _, err := db.Exec("INSERT INTO sessions (id, title) VALUES (?, ?)", sessionID, "pipeline test"); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM document_chunks WHERE document_id IN (SELECT id FROM documents WHERE session_id = ?)", sessionID)
+		db.Exec("DELETE FROM documents WHERE session_id = ?", sessionID)
+		db.Exec("DELETE FROM ai_usage WHERE session_id = ?", sessionID)
+		db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+		GetVectorCache().InvalidateSession(sessionID)
+	})
+
+	docs := map[string]string{
+		"parking.txt": "Visitor parking is available in garage B on level two. The parking garage opens at seven in the morning.",
+		"wifi.txt":    "The conference wifi network is AnyQA-Guest and the wifi password is printed on the back of every badge.",
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	for name, content := range docs {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		res, err := db.Exec("INSERT INTO documents (session_id, title, file_path, file_type) VALUES (?, ?, ?, ?)", sessionID, name, path, "txt")
+		if err != nil {
+			t.Fatalf("insert document %s: %v", name, err)
+		}
+		docID, _ := res.LastInsertId()
+		if err := ProcessUploadedDocument(ctx, db, cfg, sessionID, int(docID), path); err != nil {
+			t.Fatalf("process %s: %v", name, err)
+		}
+	}
+
+	question := "What is the wifi password?"
+	settings := RetrievalSettings{TopK: 1}
+	chunks, err := RetrieveRelevantChunks(ctx, db, cfg, question, sessionID, 0, settings)
+	if err != nil {
+		t.Fatalf("retrieve: %v", err)
+	}
+	if len(chunks) != 1 || !strings.Contains(chunks[0].Content, "wifi password") {
+		t.Fatalf("retrieved %+v, want the wifi chunk", chunks)
+	}
+
+	client, err := NewAIClient(cfg)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	var streamed strings.Builder
+	answer, err := client.WithUsage(db, UsageScope{SessionID: sessionID}).StreamKBAnswer(ctx, db, cfg, sessionID, question, chunks, func(delta string) {
+		streamed.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	if strings.TrimSpace(answer.Answer) == "" {
+		t.Fatal("empty KB answer")
+	}
+	if streamed.String() != answer.Answer {
+		t.Errorf("streamed %q, answer %q", streamed.String(), answer.Answer)
+	}
+	if len(answer.ChunkIDs) == 0 || answer.ChunkIDs[0] != chunks[0].ID {
+		t.Errorf("answer cites %v, want chunk %d", answer.ChunkIDs, chunks[0].ID)
+	}
+}
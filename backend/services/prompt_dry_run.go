@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// GenerationTrace 记录一次生成实际发送的系统提示词、参考资料、模型和用量，供试运行展示
+type GenerationTrace struct {
+	SystemPrompt string    // 最后一次请求的系统提示词（知识库回答包含结构化输出要求）
+	Context      string    // 知识库回答使用的参考资料
+	Provider     string    // 最后一次请求的提供方
+	Model        string    // 最后一次请求的模型
+	Attempts     int       // 请求次数（包括备用模型和去掉 response_format 的重试）
+	Usage        UsageData // 所有请求的用量之和
+	CostUSD      float64
+	Latency      time.Duration
+}
+
+// record 累计一次聊天请求；trace 为 nil 时什么也不做
+func (t *GenerationTrace) record(prices PriceTable, messages []ChatMessage, target chatTarget, result *ChatResult, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	t.Attempts++
+	t.Latency += latency
+	t.Provider = target.provider.Name()
+	t.Model = target.model
+	for _, m := range messages {
+		if m.Role == "system" {
+			t.SystemPrompt = m.Content
+			break
+		}
+	}
+	if result != nil {
+		if result.Model != "" {
+			t.Model = result.Model
+		}
+		t.Usage.PromptTokens += result.Usage.PromptTokens
+		t.Usage.CompletionTokens += result.Usage.CompletionTokens
+		t.Usage.TotalTokens += result.Usage.TotalTokens
+		t.CostUSD += prices.Cost(t.Model, result.Usage)
+	}
+}
+
+// setContext 记录知识库回答使用的参考资料；trace 为 nil 时什么也不做
+func (t *GenerationTrace) setContext(contextStr string) {
+	if t != nil {
+		t.Context = contextStr
+	}
+}
+
+// PromptDryRun 一次提示词试运行的输入
+type PromptDryRun struct {
+	SessionID  string
+	PromptType string // generic 或 kb
+	Prompt     string // 候选提示词模板，为空时使用会话当前生效的提示词
+	Question   string // 示例问题
+	TopK       int    // 知识库检索的文档块数，0 表示使用会话的检索设置
+}
+
+// DryRunChunk 试运行检索到的一个文档块
+type DryRunChunk struct {
+	ChunkID    int    `json:"chunkId"`
+	DocumentID int    `json:"documentId"`
+	ChunkIndex int    `json:"chunkIndex"`
+	Content    string `json:"content"`
+}
+
+// DryRunUsage 试运行的 token 用量
+type DryRunUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+// PromptDryRunResult 提示词试运行的结果
+type PromptDryRunResult struct {
+	PromptType    string        `json:"type"`
+	Question      string        `json:"question"`
+	SystemPrompt  string        `json:"systemPrompt"` // 渲染后实际发送的系统提示词
+	Context       string        `json:"context"`      // 知识库参考资料，通用提示词为空
+	Chunks        []DryRunChunk `json:"chunks"`
+	Output        string        `json:"output"`
+	Confidence    *float64      `json:"confidence"`    // 仅结构化知识库回答
+	CitedChunkIDs []int         `json:"citedChunkIds"` // 仅知识库回答
+	NoKBMatch     bool          `json:"noKbMatch"`     // 没有达到相似度阈值的文档块，未调用模型
+	Provider      string        `json:"provider"`
+	Model         string        `json:"model"`
+	Attempts      int           `json:"attempts"`
+	Usage         DryRunUsage   `json:"usage"`
+	CostUSD       float64       `json:"costUsd"`
+	LatencyMs     int64         `json:"latencyMs"`
+}
+
+// DryRunPrompt 用候选提示词和示例问题走一遍真实的生成流程（知识库提示词先检索文档），
+// 返回渲染后的提示词、参考资料、模型输出和用量。不写入 questions 表，也不推送事件；
+// 模型调用仍会记入 ai_usage，计入会话预算
+func DryRunPrompt(ctx context.Context, db *sql.DB, cfg *config.Config, client *AIClient, run PromptDryRun) (*PromptDryRunResult, error) {
+	trace := &GenerationTrace{}
+	client = client.WithPrompt(run.PromptType, run.Prompt).WithTrace(trace)
+	result := &PromptDryRunResult{PromptType: run.PromptType, Question: run.Question, Chunks: []DryRunChunk{}, CitedChunkIDs: []int{}}
+
+	switch run.PromptType {
+	case "generic":
+		chat, err := client.StreamGenericAnswer(ctx, db, cfg, run.SessionID, run.Question, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Output = chat.Content
+	case "kb":
+		retrieval := SessionRetrievalSettings(db, cfg, run.SessionID)
+		if run.TopK > 0 {
+			retrieval.TopK = run.TopK
+		}
+		chunks, err := RetrieveRelevantChunks(ctx, db, cfg, run.Question, run.SessionID, 0, retrieval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve chunks: %w", err)
+		}
+		result.NoKBMatch = len(chunks) == 0
+		for _, chunk := range chunks {
+			result.Chunks = append(result.Chunks, DryRunChunk{ChunkID: chunk.ID, DocumentID: chunk.DocumentID, ChunkIndex: chunk.ChunkIndex, Content: chunk.Content})
+		}
+		answer, err := client.StreamKBAnswer(ctx, db, cfg, run.SessionID, run.Question, chunks, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Output = answer.Answer
+		result.Confidence = answer.Confidence
+		if answer.ChunkIDs != nil {
+			result.CitedChunkIDs = answer.ChunkIDs
+		}
+	default:
+		return nil, fmt.Errorf("unknown prompt type %q", run.PromptType)
+	}
+
+	result.SystemPrompt = trace.SystemPrompt
+	if result.SystemPrompt == "" {
+		// 没有检索到文档时不会调用模型，仍然展示渲染后的提示词
+		defaults := map[string]string{"generic": cfg.GenericSystemPrompt, "kb": cfg.KnowledgeBaseSystemPrompt}
+		promptText := client.promptTemplate(db, run.SessionID, run.PromptType, defaults[run.PromptType])
+		result.SystemPrompt = RenderPrompt(run.PromptType, promptText, newPromptVars(db, run.SessionID, run.Question, trace.Context))
+	}
+	result.Context = trace.Context
+	result.Provider = trace.Provider
+	result.Model = trace.Model
+	result.Attempts = trace.Attempts
+	result.Usage = DryRunUsage{
+		PromptTokens:     trace.Usage.PromptTokens,
+		CompletionTokens: trace.Usage.CompletionTokens,
+		TotalTokens:      trace.Usage.TotalTokens,
+	}
+	result.CostUSD = trace.CostUSD
+	result.LatencyMs = trace.Latency.Milliseconds()
+	return result, nil
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// 提示词预设相关的错误
+var (
+	ErrPromptPresetNotFound  = errors.New("prompt preset not found")
+	ErrPromptPresetNameTaken = errors.New("prompt preset name already exists")
+	ErrPromptPresetInUse     = errors.New("prompt preset is used by sessions")
+)
+
+// promptPresetColumns 查询 prompt_presets 表时使用的列，顺序与 scanPromptPreset 一致
+const promptPresetColumns = `p.id, p.name, p.description, p.generic_prompt, p.kb_prompt, p.created_by, p.created_at, p.updated_at,
+	(SELECT COUNT(*) FROM session_prompts sp WHERE sp.preset_id = p.id)`
+
+// ListPromptPresets 按名称列出所有提示词预设
+func ListPromptPresets(db *sql.DB) ([]models.PromptPreset, error) {
+	rows, err := db.Query(`SELECT ` + promptPresetColumns + ` FROM prompt_presets p ORDER BY p.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt presets: %w", err)
+	}
+	defer rows.Close()
+
+	presets := []models.PromptPreset{}
+	for rows.Next() {
+		p, err := scanPromptPreset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan prompt preset: %w", err)
+		}
+		presets = append(presets, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating prompt presets: %w", err)
+	}
+	return presets, nil
+}
+
+// GetPromptPreset 按 ID 读取提示词预设，不存在时返回 ErrPromptPresetNotFound
+func GetPromptPreset(db *sql.DB, id int) (*models.PromptPreset, error) {
+	p, err := scanPromptPreset(db.QueryRow(`SELECT `+promptPresetColumns+` FROM prompt_presets p WHERE p.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrPromptPresetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt preset: %w", err)
+	}
+	return p, nil
+}
+
+// CreatePromptPreset 新建提示词预设，返回新预设的 ID；名称重复时返回 ErrPromptPresetNameTaken
+func CreatePromptPreset(db *sql.DB, p *models.PromptPreset) (int, error) {
+	result, err := db.Exec(`INSERT INTO prompt_presets (name, description, generic_prompt, kb_prompt, created_by) VALUES (?, ?, ?, ?, ?)`,
+		p.Name, p.Description, p.GenericPrompt, p.KbPrompt, p.CreatedBy)
+	if isDuplicateKeyError(err) {
+		return 0, ErrPromptPresetNameTaken
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert prompt preset: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read prompt preset id: %w", err)
+	}
+	return int(id), nil
+}
+
+// UpdatePromptPreset 整体替换提示词预设的名称、说明和提示词，引用它的会话随即使用新内容。
+// 提示词有变化时，为每个引用它的会话记录一个新的提示词版本，之后提交的问题记录新的版本号
+func UpdatePromptPreset(db *sql.DB, p *models.PromptPreset, author string) error {
+	old, err := GetPromptPreset(db, p.ID)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(`UPDATE prompt_presets SET name = ?, description = ?, generic_prompt = ?, kb_prompt = ?, updated_at = NOW() WHERE id = ?`,
+		p.Name, p.Description, p.GenericPrompt, p.KbPrompt, p.ID)
+	if isDuplicateKeyError(err) {
+		return ErrPromptPresetNameTaken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update prompt preset: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 内容未变化时 RowsAffected 也为 0，需要再确认预设是否存在
+		if _, err := GetPromptPreset(db, p.ID); err != nil {
+			return err
+		}
+	}
+	if sameText(old.GenericPrompt, p.GenericPrompt) && sameText(old.KbPrompt, p.KbPrompt) {
+		return nil
+	}
+
+	sessionIDs, err := PresetSessionIDs(db, p.ID)
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIDs {
+		_, _, err := SavePromptVersion(db, sessionId, func(*PromptSnapshot) {}, author, models.PromptVersionSourcePreset, nil)
+		if err != nil {
+			return fmt.Errorf("failed to record prompt version for session %s: %w", sessionId, err)
+		}
+	}
+	return nil
+}
+
+// DeletePromptPreset 删除提示词预设，返回原先引用它的会话。仍有会话引用时返回 ErrPromptPresetInUse；
+// force 为 true 时先解除这些会话的引用（各自记录一个新的提示词版本）再删除
+func DeletePromptPreset(db *sql.DB, id int, force bool, author string) ([]string, error) {
+	if _, err := GetPromptPreset(db, id); err != nil {
+		return nil, err
+	}
+	sessionIDs, err := PresetSessionIDs(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessionIDs) > 0 && !force {
+		return nil, ErrPromptPresetInUse
+	}
+	for _, sessionId := range sessionIDs {
+		_, _, err := SavePromptVersion(db, sessionId, func(s *PromptSnapshot) { s.PresetID = nil },
+			author, models.PromptVersionSourceUpdate, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detach preset from session %s: %w", sessionId, err)
+		}
+	}
+	if _, err := db.Exec(`DELETE FROM prompt_presets WHERE id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete prompt preset: %w", err)
+	}
+	return sessionIDs, nil
+}
+
+// PresetSessionIDs 返回引用了某个预设的会话，预设修改或删除后用于清理回答缓存
+func PresetSessionIDs(db *sql.DB, id int) ([]string, error) {
+	rows, err := db.Query(`SELECT session_id FROM session_prompts WHERE preset_id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preset sessions: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var sessionId string
+		if err := rows.Scan(&sessionId); err != nil {
+			return nil, fmt.Errorf("failed to scan preset session: %w", err)
+		}
+		ids = append(ids, sessionId)
+	}
+	return ids, rows.Err()
+}
+
+// scanPromptPreset 从一行结果中读取提示词预设，列顺序见 promptPresetColumns
+func scanPromptPreset(row interface{ Scan(...interface{}) error }) (*models.PromptPreset, error) {
+	var p models.PromptPreset
+	var genericPrompt, kbPrompt sql.NullString
+	if err := row.Scan(&p.ID, &p.Name, &p.Description, &genericPrompt, &kbPrompt, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt, &p.SessionCount); err != nil {
+		return nil, err
+	}
+	p.GenericPrompt = nullStringPtr(genericPrompt)
+	p.KbPrompt = nullStringPtr(kbPrompt)
+	return &p, nil
+}
+
+// isDuplicateKeyError 判断是否为 MySQL 唯一键冲突（错误码 1062）
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// ResolvedPrompts 会话实际使用的提示词及其来源
+type ResolvedPrompts struct {
+	GenericPrompt string
+	GenericSource string // models.PromptSourceSession / PromptSourcePreset / PromptSourceDefault
+	KbPrompt      string
+	KbSource      string
+	PresetID      *int
+	PresetName    string
+}
+
+// ResolveSessionPrompts 按 会话自定义 → 引用的预设 → 配置默认值 的顺序确定会话实际使用的提示词。
+// 为空或只含空白的提示词视为未设置
+func ResolveSessionPrompts(db *sql.DB, cfg *config.Config, sessionId string) (*ResolvedPrompts, error) {
+	var sessionGeneric, sessionKb, presetGeneric, presetKb, presetName sql.NullString
+	var presetID sql.NullInt64
+	err := db.QueryRow(`SELECT sp.generic_prompt, sp.kb_prompt, p.id, p.name, p.generic_prompt, p.kb_prompt
+		FROM session_prompts sp LEFT JOIN prompt_presets p ON p.id = sp.preset_id
+		WHERE sp.session_id = ?`, sessionId).Scan(
+		&sessionGeneric, &sessionKb, &presetID, &presetName, &presetGeneric, &presetKb)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query session prompts: %w", err)
+	}
+
+	r := &ResolvedPrompts{PresetID: nullIntPtr(presetID), PresetName: presetName.String}
+	r.GenericPrompt, r.GenericSource = pickPrompt(sessionGeneric, presetGeneric, cfg.GenericSystemPrompt)
+	r.KbPrompt, r.KbSource = pickPrompt(sessionKb, presetKb, cfg.KnowledgeBaseSystemPrompt)
+	return r, nil
+}
+
+// pickPrompt 返回第一个非空的提示词及其来源
+func pickPrompt(session, preset sql.NullString, defaultValue string) (string, string) {
+	if session.Valid && strings.TrimSpace(session.String) != "" {
+		return session.String, models.PromptSourceSession
+	}
+	if preset.Valid && strings.TrimSpace(preset.String) != "" {
+		return preset.String, models.PromptSourcePreset
+	}
+	return defaultValue, models.PromptSourceDefault
+}
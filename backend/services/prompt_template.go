@@ -0,0 +1,171 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+)
+
+// PromptVars 系统提示词模板可以使用的变量，例如 {{.Context}}、{{.SessionTitle}}
+type PromptVars struct {
+	Context      string // 检索到的参考资料（仅知识库提示词有内容）
+	Question     string // 观众的问题
+	SessionTitle string // 会话标题
+	Language     string // 问题的语言：中文问题为 "zh"，其他为 "en"
+	Now          string // 当前时间，格式 2006-01-02 15:04 MST
+}
+
+// promptRequiredVars 各类提示词必须引用的变量
+var promptRequiredVars = map[string][]string{
+	"generic": nil,
+	"kb":      {"Context"},
+}
+
+// IsLegacyPrompt 判断是否为旧版 fmt.Sprintf 风格的知识库提示词（用 %s 插入参考资料）
+func IsLegacyPrompt(text string) bool {
+	return strings.Contains(text, "%s") && !strings.Contains(text, "{{")
+}
+
+// MigrateLegacyPrompt 把旧版 %s 提示词转换为模板：%s 换成 {{.Context}}，%% 还原为 %。
+// 只适用于知识库提示词，通用提示词从未经过 Sprintf，其中的 %s 是字面文本
+func MigrateLegacyPrompt(text string) string {
+	if !IsLegacyPrompt(text) {
+		return text
+	}
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '%' && i+1 < len(text) {
+			switch text[i+1] {
+			case 's':
+				b.WriteString("{{.Context}}")
+				i++
+				continue
+			case '%':
+				b.WriteByte('%')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// parsePromptTemplate 解析提示词模板；引用不存在的变量会在执行时报错
+func parsePromptTemplate(promptType string, text string) (*template.Template, error) {
+	return template.New(promptType).Option("missingkey=error").Parse(text)
+}
+
+// ValidatePromptTemplate 校验提示词模板：语法正确、只引用已知变量、包含该类型必需的变量
+func ValidatePromptTemplate(promptType string, text string) error {
+	tmpl, err := parsePromptTemplate(promptType, text)
+	if err != nil {
+		return fmt.Errorf("invalid %s prompt template: %w", promptType, err)
+	}
+	used := make(map[string]bool)
+	if tmpl.Tree != nil {
+		collectTemplateFields(tmpl.Tree.Root, used)
+	}
+	for _, name := range promptRequiredVars[promptType] {
+		if !used[name] {
+			return fmt.Errorf("%s prompt must reference {{.%s}}", promptType, name)
+		}
+	}
+	// 用示例数据执行一次，发现未知变量等运行时错误
+	sample := PromptVars{Context: "context", Question: "question", SessionTitle: "title", Language: "en", Now: "now"}
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return fmt.Errorf("invalid %s prompt template: %w", promptType, err)
+	}
+	return nil
+}
+
+// collectTemplateFields 遍历模板语法树，收集引用到的顶层字段名
+func collectTemplateFields(node parse.Node, used map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectTemplateFields(child, used)
+		}
+	case *parse.ActionNode:
+		collectTemplateFields(n.Pipe, used)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectTemplateFields(cmd, used)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectTemplateFields(arg, used)
+		}
+	case *parse.FieldNode:
+		if len(n.Ident) > 0 {
+			used[n.Ident[0]] = true
+		}
+	case *parse.IfNode:
+		collectTemplateFields(n.Pipe, used)
+		collectTemplateFields(n.List, used)
+		collectTemplateFields(n.ElseList, used)
+	case *parse.RangeNode:
+		collectTemplateFields(n.Pipe, used)
+		collectTemplateFields(n.List, used)
+		collectTemplateFields(n.ElseList, used)
+	case *parse.WithNode:
+		collectTemplateFields(n.Pipe, used)
+		collectTemplateFields(n.List, used)
+		collectTemplateFields(n.ElseList, used)
+	}
+}
+
+// RenderPrompt 用变量渲染提示词。知识库提示词若仍是旧版 %s 格式会先自动转换。
+// 渲染失败（例如数据库里存有校验前写入的非法模板）时退回原文，知识库提示词再在末尾附上参考资料，
+// 保证模型始终能拿到上下文
+func RenderPrompt(promptType string, text string, vars PromptVars) string {
+	if promptType == "kb" {
+		text = MigrateLegacyPrompt(text)
+	}
+	tmpl, err := parsePromptTemplate(promptType, text)
+	if err == nil {
+		var b strings.Builder
+		if err = tmpl.Execute(&b, vars); err == nil {
+			return b.String()
+		}
+	}
+	fmt.Printf("警告：%s 提示词模板渲染失败，使用原文: %v\n", promptType, err)
+	if promptType == "kb" && vars.Context != "" {
+		return text + "\n\n" + vars.Context
+	}
+	return text
+}
+
+// newPromptVars 准备渲染提示词所需的变量
+func newPromptVars(db *sql.DB, sessionId string, question string, contextStr string) PromptVars {
+	vars := PromptVars{
+		Context:  contextStr,
+		Question: question,
+		Language: detectLanguage(question),
+		Now:      time.Now().Format("2006-01-02 15:04 MST"),
+	}
+	if err := db.QueryRow(`SELECT title FROM sessions WHERE id = ?`, sessionId).Scan(&vars.SessionTitle); err != nil && err != sql.ErrNoRows {
+		fmt.Printf("警告：查询会话 %s 标题失败: %v\n", sessionId, err)
+	}
+	return vars
+}
+
+// detectLanguage 粗略判断问题语言：含有汉字即视为中文
+func detectLanguage(text string) string {
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			return "zh"
+		}
+	}
+	return "en"
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateLegacyPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"placeholder", "Answer using:\n%s", "Answer using:\n{{.Context}}"},
+		{"escaped percent", "100%% sure: %s", "100% sure: {{.Context}}"},
+		{"escaped percent before s", "%%s means %s", "%s means {{.Context}}"},
+		{"escaped percent then placeholder", "%%%s", "%{{.Context}}"},
+		{"other verbs untouched", "%d items: %s", "%d items: {{.Context}}"},
+		{"trailing percent", "%s 100%", "{{.Context}} 100%"},
+		{"no placeholder", "100%% sure", "100%% sure"},
+		{"already a template", "%s {{.Context}}", "%s {{.Context}}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MigrateLegacyPrompt(tt.in); got != tt.want {
+				t.Errorf("MigrateLegacyPrompt(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePromptTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		promptType string
+		text       string
+		wantErr    string // 为空表示应通过校验
+	}{
+		{"kb with context", "kb", "Use {{.Context}} to answer {{.Question}}", ""},
+		{"kb with context in if", "kb", "{{if .Context}}{{.Context}}{{end}}", ""},
+		{"kb without context", "kb", "Answer {{.Question}} in {{.Language}}", "must reference {{.Context}}"},
+		{"kb legacy placeholder", "kb", "Answer using %s", "must reference {{.Context}}"},
+		{"generic without variables", "generic", "You are a helpful assistant.", ""},
+		{"generic literal percent", "generic", "Reply with %s and 100%%", ""},
+		{"unknown variable", "generic", "Hello {{.Audience}}", "Audience"},
+		{"unknown variable in kb", "kb", "{{.Context}} {{.Speaker}}", "Speaker"},
+		{"syntax error", "generic", "Hello {{.Question", "invalid generic prompt template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePromptTemplate(tt.promptType, tt.text)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidatePromptTemplate(%q) = %v, want nil", tt.text, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ValidatePromptTemplate(%q) = %v, want error containing %q", tt.text, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenderPromptMigratesLegacyKB(t *testing.T) {
+	vars := PromptVars{Context: "CTX", Question: "Q"}
+	if got := RenderPrompt("kb", "100%% from %s", vars); got != "100% from CTX" {
+		t.Errorf("kb = %q", got)
+	}
+	// 通用提示词从未经过 Sprintf，其中的 %s 保持原样
+	if got := RenderPrompt("generic", "literal %s for {{.Question}}", vars); got != "literal %s for Q" {
+		t.Errorf("generic = %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// ErrPromptVersionNotFound 提示词版本不存在
+var ErrPromptVersionNotFound = errors.New("prompt version not found")
+
+// promptVersionColumns 查询 prompt_versions 表时使用的列，顺序与 scanPromptVersion 一致
+const promptVersionColumns = `session_id, version, generic_prompt, kb_prompt, preset_id, author, source, restored_from, created_at`
+
+// PromptSnapshot 会话提示词设置的快照：自定义提示词与引用的预设，每个版本保存一份
+type PromptSnapshot struct {
+	GenericPrompt *string
+	KbPrompt      *string
+	PresetID      *int
+}
+
+// equal 判断两个快照的内容是否相同
+func (s PromptSnapshot) equal(other PromptSnapshot) bool {
+	return sameText(s.GenericPrompt, other.GenericPrompt) && sameText(s.KbPrompt, other.KbPrompt) &&
+		((s.PresetID == nil && other.PresetID == nil) || (s.PresetID != nil && other.PresetID != nil && *s.PresetID == *other.PresetID))
+}
+
+// sameText 比较两段可空文本
+func sameText(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// SavePromptVersion 在会话当前提示词设置上应用 update，并把结果记录为新版本，返回生效的版本号以及是否新建了版本。
+// 普通保存时内容与当前版本相同则不新建版本；回滚（source 为 restore）和预设修改（source 为 preset）总会新建一个版本，
+// 这样历史记录中能看到回滚本身，问题记录的版本号也能区分预设修改前后。同一会话的并发保存通过 session_prompts 行锁串行执行
+func SavePromptVersion(db *sql.DB, sessionId string, update func(*PromptSnapshot), author string, source string, restoredFrom *int) (int, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 先确保行存在，再加锁读取当前内容
+	if _, err := tx.Exec(`INSERT IGNORE INTO session_prompts (session_id) VALUES (?)`, sessionId); err != nil {
+		return 0, false, fmt.Errorf("failed to create session prompts: %w", err)
+	}
+	var curGeneric, curKb sql.NullString
+	var curPreset sql.NullInt64
+	var current int
+	err = tx.QueryRow(`SELECT generic_prompt, kb_prompt, preset_id, prompt_version FROM session_prompts WHERE session_id = ? FOR UPDATE`, sessionId).Scan(
+		&curGeneric, &curKb, &curPreset, &current)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to lock session prompts: %w", err)
+	}
+	before := PromptSnapshot{GenericPrompt: nullStringPtr(curGeneric), KbPrompt: nullStringPtr(curKb), PresetID: nullIntPtr(curPreset)}
+	after := before
+	update(&after)
+	if source == models.PromptVersionSourceUpdate && current > 0 && after.equal(before) {
+		return current, false, nil
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM prompt_versions WHERE session_id = ?`, sessionId).Scan(&version); err != nil {
+		return 0, false, fmt.Errorf("failed to allocate prompt version: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO prompt_versions (session_id, version, generic_prompt, kb_prompt, preset_id, author, source, restored_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, sessionId, version, after.GenericPrompt, after.KbPrompt, after.PresetID, author, source, restoredFrom)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to insert prompt version: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE session_prompts SET generic_prompt = ?, kb_prompt = ?, preset_id = ?, prompt_version = ?, updated_at = NOW() WHERE session_id = ?`,
+		after.GenericPrompt, after.KbPrompt, after.PresetID, version, sessionId)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to update session prompts: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit prompt version: %w", err)
+	}
+	return version, true, nil
+}
+
+// nullStringPtr 把可空文本转换为指针，NULL 对应 nil
+func nullStringPtr(v sql.NullString) *string {
+	if !v.Valid {
+		return nil
+	}
+	return &v.String
+}
+
+// nullIntPtr 把可空整数转换为指针，NULL 对应 nil
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
+
+// ListPromptVersions 按版本号从新到旧列出会话的提示词版本
+func ListPromptVersions(db *sql.DB, sessionId string) ([]models.PromptVersion, error) {
+	current, err := CurrentPromptVersion(db, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT `+promptVersionColumns+` FROM prompt_versions WHERE session_id = ? ORDER BY version DESC`, sessionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []models.PromptVersion{}
+	for rows.Next() {
+		v, err := scanPromptVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan prompt version: %w", err)
+		}
+		v.Current = v.Version == current
+		versions = append(versions, *v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating prompt versions: %w", err)
+	}
+	return versions, nil
+}
+
+// GetPromptVersion 读取会话的某个提示词版本，不存在时返回 ErrPromptVersionNotFound
+func GetPromptVersion(db *sql.DB, sessionId string, version int) (*models.PromptVersion, error) {
+	v, err := scanPromptVersion(db.QueryRow(`SELECT `+promptVersionColumns+` FROM prompt_versions WHERE session_id = ? AND version = ?`, sessionId, version))
+	if err == sql.ErrNoRows {
+		return nil, ErrPromptVersionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt version: %w", err)
+	}
+	current, err := CurrentPromptVersion(db, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	v.Current = v.Version == current
+	return v, nil
+}
+
+// CurrentPromptVersion 返回会话当前生效的提示词版本，从未保存过时为 0
+func CurrentPromptVersion(db *sql.DB, sessionId string) (int, error) {
+	var current int
+	err := db.QueryRow(`SELECT prompt_version FROM session_prompts WHERE session_id = ?`, sessionId).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query current prompt version: %w", err)
+	}
+	return current, nil
+}
+
+// scanPromptVersion 从一行结果中读取提示词版本，列顺序见 promptVersionColumns
+func scanPromptVersion(row interface{ Scan(...interface{}) error }) (*models.PromptVersion, error) {
+	var v models.PromptVersion
+	var genericPrompt, kbPrompt sql.NullString
+	var presetID, restoredFrom sql.NullInt64
+	if err := row.Scan(&v.SessionID, &v.Version, &genericPrompt, &kbPrompt, &presetID, &v.Author, &v.Source, &restoredFrom, &v.CreatedAt); err != nil {
+		return nil, err
+	}
+	v.GenericPrompt = nullStringPtr(genericPrompt)
+	v.KbPrompt = nullStringPtr(kbPrompt)
+	v.PresetID = nullIntPtr(presetID)
+	v.RestoredFrom = nullIntPtr(restoredFrom)
+	return &v, nil
+}
+
+// DiffLine 行级差异中的一行，Op 为 equal、insert 或 delete
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffLines 按行比较两段文本（最长公共子序列），返回从 a 变为 b 的逐行差异
+func DiffLines(a, b string) []DiffLine {
+	var x, y []string
+	if a != "" {
+		x = strings.Split(a, "\n")
+	}
+	if b != "" {
+		y = strings.Split(b, "\n")
+	}
+
+	// lcs[i][j] 为 x[i:] 与 y[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []DiffLine{}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, DiffLine{Op: "equal", Text: x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: "delete", Text: x[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: "insert", Text: y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, DiffLine{Op: "delete", Text: x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, DiffLine{Op: "insert", Text: y[j]})
+	}
+	return diff
+}
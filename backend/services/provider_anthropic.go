@@ -0,0 +1,235 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// anthropicAPIVersion Messages API 版本请求头
+const anthropicAPIVersion = "2023-06-01"
+
+// AnthropicMessagesRequest 定义了调用 Anthropic Messages API 的请求体结构
+// 与 OpenAI 不同，系统提示词通过独立的 system 字段传递
+type AnthropicMessagesRequest struct {
+	Model       string        `json:"model"`
+	MaxTokens   int           `json:"max_tokens"`
+	System      string        `json:"system,omitempty"`
+	Messages    []ChatMessage `json:"messages"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+}
+
+// AnthropicUsage Anthropic 返回的用量信息
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicMessagesResponse 定义了 Messages API 非流式响应的主要结构
+type AnthropicMessagesResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage AnthropicUsage `json:"usage"`
+}
+
+// AnthropicStreamEvent 定义了 Messages API 流式响应中单个事件的结构
+type AnthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message *struct {
+		Model string         `json:"model"`
+		Usage AnthropicUsage `json:"usage"`
+	} `json:"message"` // message_start
+	Delta *struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"` // content_block_delta
+	Usage *AnthropicUsage `json:"usage"` // message_delta
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"` // error
+}
+
+// toUsageData 转换为通用的 UsageData
+func (u AnthropicUsage) toUsageData() UsageData {
+	return UsageData{
+		PromptTokens:     u.InputTokens,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      u.InputTokens + u.OutputTokens,
+	}
+}
+
+// anthropicProvider Anthropic Messages API 聊天提供方
+type anthropicProvider struct {
+	apiKey    string
+	apiURL    string
+	model     string
+	maxTokens int
+
+	chatHTTP   *apiClient
+	streamHTTP *apiClient
+}
+
+// newAnthropicProvider 创建 Anthropic 提供方
+func newAnthropicProvider(cfg *config.Config) *anthropicProvider {
+	return &anthropicProvider{
+		apiKey:    cfg.AnthropicAPIKey,
+		apiURL:    cfg.AnthropicAPIUrl,
+		model:     cfg.AnthropicModel,
+		maxTokens: cfg.AnthropicMaxTokens,
+
+		chatHTTP:   newAPIClient(cfg, ProviderAnthropic, cfg.AnthropicAPIUrl, 120*time.Second),
+		streamHTTP: newAPIClient(cfg, ProviderAnthropic, cfg.AnthropicAPIUrl, 180*time.Second),
+	}
+}
+
+// Name 返回提供方名称
+func (p *anthropicProvider) Name() string {
+	return ProviderAnthropic
+}
+
+// Chat 发送聊天请求；onDelta 不为 nil 时使用流式请求
+func (p *anthropicProvider) Chat(ctx context.Context, chatReq ChatRequest, onDelta StreamHandler) (*ChatResult, error) {
+	if p.apiKey == "" {
+		return nil, fmt.Errorf("anthropic API key is not configured")
+	}
+
+	model := chatReq.Model
+	if model == "" {
+		model = p.model
+	}
+
+	// system 消息合并到 system 字段，其余消息按原顺序传递
+	var systemParts []string
+	var messages []ChatMessage
+	for _, msg := range chatReq.Messages {
+		if msg.Role == "system" {
+			systemParts = append(systemParts, msg.Content)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	// Anthropic 要求必须指定 max_tokens
+	maxTokens := p.maxTokens
+	if chatReq.MaxTokens != nil {
+		maxTokens = *chatReq.MaxTokens
+	}
+
+	jsonData, err := json.Marshal(AnthropicMessagesRequest{
+		Model:       model,
+		MaxTokens:   maxTokens,
+		System:      strings.Join(systemParts, "\n\n"),
+		Messages:    messages,
+		Temperature: chatReq.Temperature,
+		TopP:        chatReq.TopP,
+		Stream:      onDelta != nil,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	httpClient := p.chatHTTP
+	if onDelta != nil {
+		req.Header.Set("Accept", "text/event-stream")
+		httpClient = p.streamHTTP
+	}
+	resp, err := httpClient.Do(req, "Messages")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if onDelta != nil {
+		return p.readStream(resp, model, onDelta)
+	}
+
+	var result AnthropicMessagesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode anthropic Messages API response: %w", err)
+	}
+
+	var answer strings.Builder
+	for _, block := range result.Content {
+		if block.Type == "text" {
+			answer.WriteString(block.Text)
+		}
+	}
+	if answer.Len() == 0 {
+		return nil, fmt.Errorf("no response content received from anthropic Messages API")
+	}
+	if result.Model != "" {
+		model = result.Model
+	}
+	return &ChatResult{Content: answer.String(), Model: model, Usage: result.Usage.toUsageData()}, nil
+}
+
+// readStream 解析 Messages API 的 SSE 事件流
+func (p *anthropicProvider) readStream(resp *http.Response, model string, onDelta StreamHandler) (*ChatResult, error) {
+	result := &ChatResult{Model: model}
+	var usage AnthropicUsage
+	var answer strings.Builder
+
+	err := readSSE(resp, func(event, data string) (bool, error) {
+		var ev AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return false, fmt.Errorf("failed to decode anthropic stream event: %w", err)
+		}
+
+		switch ev.Type {
+		case "message_start":
+			if ev.Message != nil {
+				if ev.Message.Model != "" {
+					result.Model = ev.Message.Model
+				}
+				usage.InputTokens = ev.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if ev.Delta != nil && ev.Delta.Type == "text_delta" && ev.Delta.Text != "" {
+				answer.WriteString(ev.Delta.Text)
+				onDelta(ev.Delta.Text)
+			}
+		case "message_delta":
+			if ev.Usage != nil {
+				usage.OutputTokens = ev.Usage.OutputTokens
+			}
+		case "message_stop":
+			return false, nil
+		case "error":
+			if ev.Error != nil {
+				return false, fmt.Errorf("anthropic stream error (%s): %s", ev.Error.Type, ev.Error.Message)
+			}
+			return false, fmt.Errorf("anthropic stream error")
+		}
+		return true, nil
+	})
+
+	result.Content = answer.String()
+	result.Usage = usage.toUsageData()
+	if err != nil {
+		return result, err
+	}
+	if result.Content == "" {
+		return nil, fmt.Errorf("no response content received from anthropic Messages API stream")
+	}
+	return result, nil
+}
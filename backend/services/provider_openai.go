@@ -0,0 +1,432 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+)
+
+// ChatMessage 定义了聊天消息的结构
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// OpenAIChatCompletionRequest 定义了调用 Chat Completions API 的请求体结构
+type OpenAIChatCompletionRequest struct {
+	Model          string          `json:"model"`
+	Messages       []ChatMessage   `json:"messages"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	MaxTokens      *int            `json:"max_tokens,omitempty"`
+	TopP           *float64        `json:"top_p,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+// ResponseFormat 结构化输出格式（response_format）
+type ResponseFormat struct {
+	Type       string          `json:"type"` // "json_schema" 或 "json_object"
+	JSONSchema *JSONSchemaSpec `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaSpec json_schema 格式的模式定义
+type JSONSchemaSpec struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// StreamOptions 流式请求的附加选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 在最后一个 SSE 块中返回 usage
+}
+
+// OpenAIChatCompletionResponse 定义了 Chat Completions API 响应体的主要结构
+type OpenAIChatCompletionResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage UsageData `json:"usage"`
+}
+
+// OpenAIChatCompletionChunk 定义了流式响应中单个 SSE 数据块的结构
+type OpenAIChatCompletionChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *UsageData `json:"usage"` // 仅在 include_usage 时出现在最后一个块中
+}
+
+// StreamHandler 接收流式回答的增量文本
+type StreamHandler func(delta string)
+
+// OpenAIEmbeddingRequest 定义了调用 OpenAI Embeddings API 的请求体结构
+type OpenAIEmbeddingRequest struct {
+	Input          []string `json:"input"`
+	Model          string   `json:"model"`
+	EncodingFormat string   `json:"encoding_format,omitempty"`
+	Dimensions     int      `json:"dimensions,omitempty"` // 仅 text-embedding-3-* 及部分兼容服务支持
+}
+
+// OpenAIEmbeddingResponse 定义了 OpenAI Embeddings API 响应体的主要结构
+type OpenAIEmbeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  UsageData       `json:"usage"`
+}
+
+// EmbeddingData 包含单个输入的嵌入向量信息
+type EmbeddingData struct {
+	Object    string    `json:"object"`
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+// UsageData 包含 API 使用情况信息
+type UsageData struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAICompatibleProvider 使用 OpenAI 线上格式的提供方，
+// OpenAI、Azure OpenAI 和 Ollama 只在地址、认证方式和模型上有区别
+type openAICompatibleProvider struct {
+	name            string
+	apiKey          string
+	requireKey      bool   // Ollama 等本地服务不需要密钥
+	authHeader      string // "Authorization"（Bearer）或 Azure 的 "api-key"
+	chatAPIURL      string
+	embeddingAPIURL string
+	chatModel       string
+	embeddingModel  string
+	dimensions      int // 大于 0 时请求指定维度的向量
+
+	embedHTTP  *apiClient // 聊天和流式共用同一个熔断器，向量接口地址不同时使用单独的熔断器
+	chatHTTP   *apiClient
+	streamHTTP *apiClient
+}
+
+// withHTTP 为提供方创建带重试和熔断的 HTTP 客户端
+func (p *openAICompatibleProvider) withHTTP(cfg *config.Config) *openAICompatibleProvider {
+	if cfg.EmbeddingDimensions > 0 {
+		if p.name == ProviderOpenAI && !strings.HasPrefix(p.embeddingModel, "text-embedding-3") {
+			fmt.Printf("警告：模型 %s 不支持 dimensions 参数，忽略 EMBEDDING_DIMENSIONS=%d。\n", p.embeddingModel, cfg.EmbeddingDimensions)
+		} else {
+			p.dimensions = cfg.EmbeddingDimensions
+		}
+	}
+	p.embedHTTP = newAPIClient(cfg, p.name, p.embeddingAPIURL, 60*time.Second)
+	p.chatHTTP = newAPIClient(cfg, p.name, p.chatAPIURL, 120*time.Second)
+	// 流式响应持续时间取决于回答长度，这里只限制整体上限
+	p.streamHTTP = newAPIClient(cfg, p.name, p.chatAPIURL, 180*time.Second)
+	return p
+}
+
+// newOpenAIProvider 创建 OpenAI 官方 API 提供方。
+// 向量接口地址无法确定时留空，作为向量提供方时由 newOpenAIEmbeddingProvider 报错
+func newOpenAIProvider(cfg *config.Config) *openAICompatibleProvider {
+	embeddingURL, _ := openAIEmbeddingURL(cfg)
+	p := &openAICompatibleProvider{
+		name:            ProviderOpenAI,
+		apiKey:          cfg.OpenAIAPIKey,
+		requireKey:      true,
+		authHeader:      "Authorization",
+		chatAPIURL:      cfg.OpenAIAPIUrl,
+		embeddingAPIURL: embeddingURL,
+		chatModel:       cfg.OpenAIModel,
+		embeddingModel:  cfg.OpenAIEmbeddingModel,
+	}
+	return p.withHTTP(cfg)
+}
+
+// newOpenAIEmbeddingProvider 创建用于向量的 OpenAI 提供方，向量接口地址无法确定时返回错误
+func newOpenAIEmbeddingProvider(cfg *config.Config) (*openAICompatibleProvider, error) {
+	if _, err := openAIEmbeddingURL(cfg); err != nil {
+		return nil, err
+	}
+	return newOpenAIProvider(cfg), nil
+}
+
+// openAIEmbeddingURL 返回向量接口地址：优先使用 OPENAI_EMBEDDING_URL，
+// 否则与 OPENAI_API_URL 指向同一个网关。OPENAI_API_URL 不以 /chat/completions 结尾时无法推导，
+// 返回错误而不是退回 api.openai.com，避免文档内容被发往未配置的地址
+func openAIEmbeddingURL(cfg *config.Config) (string, error) {
+	if cfg.OpenAIEmbeddingURL != "" {
+		return cfg.OpenAIEmbeddingURL, nil
+	}
+	chatURL := strings.TrimRight(cfg.OpenAIAPIUrl, "/")
+	if strings.HasSuffix(chatURL, "/chat/completions") {
+		return strings.TrimSuffix(chatURL, "/chat/completions") + "/embeddings", nil
+	}
+	return "", fmt.Errorf("cannot derive the embeddings URL from OPENAI_API_URL %q (expected it to end with /chat/completions); set OPENAI_EMBEDDING_URL", cfg.OpenAIAPIUrl)
+}
+
+// newAzureOpenAIProvider 创建 Azure OpenAI 提供方，模型由部署名决定
+func newAzureOpenAIProvider(cfg *config.Config) *openAICompatibleProvider {
+	deploymentURL := func(deployment, operation string) string {
+		return fmt.Sprintf("%s/openai/deployments/%s/%s?api-version=%s",
+			strings.TrimRight(cfg.AzureOpenAIEndpoint, "/"), url.PathEscape(deployment), operation, url.QueryEscape(cfg.AzureOpenAIAPIVersion))
+	}
+	p := &openAICompatibleProvider{
+		name:            ProviderAzure,
+		apiKey:          cfg.AzureOpenAIAPIKey,
+		requireKey:      true,
+		authHeader:      "api-key",
+		chatAPIURL:      deploymentURL(cfg.AzureOpenAIChatDeployment, "chat/completions"),
+		embeddingAPIURL: deploymentURL(cfg.AzureOpenAIEmbeddingDeployment, "embeddings"),
+		chatModel:       cfg.AzureOpenAIChatDeployment,
+		embeddingModel:  cfg.AzureOpenAIEmbeddingDeployment,
+	}
+	return p.withHTTP(cfg)
+}
+
+// newOllamaProvider 创建本地 OpenAI 兼容服务提供方（Ollama、llama.cpp server 等）
+func newOllamaProvider(cfg *config.Config) *openAICompatibleProvider {
+	baseURL := strings.TrimRight(cfg.OllamaBaseURL, "/")
+	p := &openAICompatibleProvider{
+		name:            ProviderOllama,
+		apiKey:          cfg.OllamaAPIKey,
+		requireKey:      false,
+		authHeader:      "Authorization",
+		chatAPIURL:      baseURL + "/chat/completions",
+		embeddingAPIURL: baseURL + "/embeddings",
+		chatModel:       cfg.OllamaModel,
+		embeddingModel:  cfg.OllamaEmbeddingModel,
+	}
+	return p.withHTTP(cfg)
+}
+
+// newLocalEmbeddingProvider 创建本地向量服务提供方（只用于向量，不提供聊天）
+func newLocalEmbeddingProvider(cfg *config.Config) *openAICompatibleProvider {
+	p := &openAICompatibleProvider{
+		name:            ProviderLocal,
+		apiKey:          cfg.LocalEmbeddingAPIKey,
+		requireKey:      false,
+		authHeader:      "Authorization",
+		embeddingAPIURL: cfg.LocalEmbeddingURL,
+		embeddingModel:  cfg.LocalEmbeddingModel,
+	}
+	return p.withHTTP(cfg)
+}
+
+// Name 返回提供方名称
+func (p *openAICompatibleProvider) Name() string {
+	return p.name
+}
+
+// newRequest 构造带认证头的 JSON POST 请求
+func (p *openAICompatibleProvider) newRequest(ctx context.Context, apiURL string, body interface{}) (*http.Request, error) {
+	if p.requireKey && p.apiKey == "" {
+		return nil, fmt.Errorf("%s API key is not configured", p.name)
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		if p.authHeader == "Authorization" {
+			req.Header.Set("Authorization", "Bearer "+p.apiKey)
+		} else {
+			req.Header.Set(p.authHeader, p.apiKey)
+		}
+	}
+	return req, nil
+}
+
+// Embed 获取一批文本的嵌入向量
+func (p *openAICompatibleProvider) Embed(ctx context.Context, texts []string) (*EmbeddingResult, error) {
+	req, err := p.newRequest(ctx, p.embeddingAPIURL, OpenAIEmbeddingRequest{
+		Input:          texts,
+		Model:          p.embeddingModel,
+		EncodingFormat: "float",
+		Dimensions:     p.dimensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.embedHTTP.Do(req, "Embeddings")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result OpenAIEmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode %s Embeddings API response: %w", p.name, err)
+	}
+
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("mismatch between input texts (%d) and embeddings received (%d)", len(texts), len(result.Data))
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, data := range result.Data {
+		if data.Index >= 0 && data.Index < len(texts) {
+			embeddings[data.Index] = data.Embedding
+		} else {
+			return nil, fmt.Errorf("received invalid index %d from %s API", data.Index, p.name)
+		}
+	}
+	if p.dimensions > 0 && len(embeddings) > 0 && len(embeddings[0]) != p.dimensions {
+		fmt.Printf("警告：%s 返回的向量维度为 %d，与配置的 %d 不一致。\n", p.name, len(embeddings[0]), p.dimensions)
+	}
+
+	model := result.Model
+	if model == "" {
+		model = p.embeddingModel
+	}
+	return &EmbeddingResult{Embeddings: embeddings, Model: model, Usage: result.Usage}, nil
+}
+
+// Chat 发送聊天请求；onDelta 不为 nil 时使用流式请求
+func (p *openAICompatibleProvider) Chat(ctx context.Context, chatReq ChatRequest, onDelta StreamHandler) (*ChatResult, error) {
+	model := chatReq.Model
+	if model == "" {
+		model = p.chatModel
+	}
+	body := OpenAIChatCompletionRequest{
+		Model:       model,
+		Messages:    chatReq.Messages,
+		Temperature: chatReq.Temperature,
+		MaxTokens:   chatReq.MaxTokens,
+		TopP:        chatReq.TopP,
+
+		ResponseFormat: chatReq.ResponseFormat,
+	}
+	if onDelta != nil {
+		return p.streamChat(ctx, body, onDelta)
+	}
+
+	req, err := p.newRequest(ctx, p.chatAPIURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.chatHTTP.Do(req, "Chat")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result OpenAIChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode %s Chat API response: %w", p.name, err)
+	}
+
+	if len(result.Choices) == 0 || result.Choices[0].Message.Content == "" {
+		return nil, fmt.Errorf("no response content received from %s Chat API", p.name)
+	}
+	if result.Model != "" {
+		model = result.Model
+	}
+	return &ChatResult{Content: result.Choices[0].Message.Content, Model: model, Usage: result.Usage}, nil
+}
+
+// streamChat 发送 stream: true 的请求，逐个解析 SSE 增量并回调 onDelta，
+// 流结束后返回拼接好的完整回答
+func (p *openAICompatibleProvider) streamChat(ctx context.Context, body OpenAIChatCompletionRequest, onDelta StreamHandler) (*ChatResult, error) {
+	model := body.Model
+	body.Stream = true
+	body.StreamOptions = &StreamOptions{IncludeUsage: true}
+	req, err := p.newRequest(ctx, p.chatAPIURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// 只有在收到响应头之前的失败会重试；流开始后出错直接返回，避免重复推送增量
+	resp, err := p.streamHTTP.Do(req, "Chat")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatResult{Model: model}
+	var answer strings.Builder
+	err = readSSE(resp, func(event, data string) (bool, error) {
+		if data == "[DONE]" {
+			return false, nil
+		}
+
+		var chunk OpenAIChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return false, fmt.Errorf("failed to decode %s Chat stream chunk: %w", p.name, err)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			answer.WriteString(choice.Delta.Content)
+			onDelta(choice.Delta.Content)
+		}
+		return true, nil
+	})
+	result.Content = answer.String()
+	if err != nil {
+		return result, err
+	}
+
+	if result.Content == "" {
+		return nil, fmt.Errorf("no response content received from %s Chat API stream", p.name)
+	}
+	return result, nil
+}
+
+// readSSE 逐条读取 text/event-stream 响应，对每个 data 字段回调 handle；
+// handle 返回 false 时停止读取
+func readSSE(resp *http.Response, handle func(event string, data string) (bool, error)) error {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	event := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			event = "" // 空行表示一个事件结束
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			more, err := handle(event, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			if err != nil || !more {
+				return err
+			}
+		}
+		// 其余字段（id:、retry:、注释）忽略
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event stream: %w", err)
+	}
+	return nil
+}
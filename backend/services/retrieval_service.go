@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"math"
@@ -10,89 +11,292 @@ import (
 	"github.com/soaringjerry/AnyQA/backend/models"
 )
 
-// ChunkWithSimilarity 用于存储文档块及其与问题的相似度
-type ChunkWithSimilarity struct {
-	Chunk      models.DocumentChunk
-	Similarity float64
+// fusedChunk 一个文档块在向量检索和关键词检索中的名次，以及倒数排名融合后的得分
+type fusedChunk struct {
+	index       int     // 在会话缓存中的下标
+	similarity  float64 // 与问题向量的余弦相似度
+	vectorRank  int     // 向量检索名次，从 1 开始，0 表示未参与排名
+	lexical     float64 // BM25 得分
+	lexicalRank int     // 关键词检索名次，0 表示没有匹配的词
+	score       float64 // 融合得分
+}
+
+// defaultRetrievalTopK 会话和 RETRIEVAL_TOP_K 都没有给出有效的 topK 时检索的文档块数
+const defaultRetrievalTopK = 3
+
+// RetrievalSettings 会话的知识库检索设置，会话未单独设置的项使用全局配置
+type RetrievalSettings struct {
+	TopK             int     // 最多检索的文档块数
+	MinSimilarity    float64 // 文档块与问题的最低余弦相似度，0 表示不限制
+	MaxContextTokens int     // 参考资料的最大 token 数（粗略估算），0 表示不限制
+	LexicalWeight    float64 // 关键词检索的权重（0-1）
 }
 
 // RetrieveRelevantChunks 根据问题检索最相关的文档块
-func RetrieveRelevantChunks(db *sql.DB, cfg *config.Config, question string, sessionId string, topK int) ([]models.DocumentChunk, error) {
+// questionID 用于记录问题向量化的用量，可以为 0
+func RetrieveRelevantChunks(ctx context.Context, db *sql.DB, cfg *config.Config, question string, sessionId string, questionID int64, settings RetrievalSettings) ([]models.DocumentChunk, error) {
 	if question == "" || sessionId == "" {
 		return nil, fmt.Errorf("question and sessionId cannot be empty")
 	}
-	if topK <= 0 {
-		topK = 5 // 默认检索5个最相关的块
+
+	// 只使用关键词检索时不需要问题向量
+	if settings.LexicalWeight >= 1 {
+		return RetrieveChunksByEmbedding(ctx, db, cfg, sessionId, question, nil, settings)
 	}
 
-	// 1. 获取问题的嵌入向量
-	openaiClient := NewOpenAIClient(cfg)
-	questionEmbeddings, err := openaiClient.GetEmbeddings([]string{question})
+	// 获取问题的嵌入向量，失败时由 RetrieveWithQuestionEmbedding 决定是否退回关键词检索
+	aiClient, err := NewAIClient(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get embedding for question: %w", err)
+		return nil, err
+	}
+	aiClient = aiClient.WithUsage(db, UsageScope{SessionID: sessionId, QuestionID: questionID})
+	questionEmbedding, err := aiClient.EmbedQuestion(ctx, question)
+	return RetrieveWithQuestionEmbedding(ctx, db, cfg, sessionId, question, questionEmbedding, err, settings)
+}
+
+// RetrieveWithQuestionEmbedding 使用调用方已经请求过的问题向量检索（例如回答缓存查找时算出的向量），不会再次请求向量服务。
+// embedErr 为获取向量时的错误：向量服务不可用时退回关键词检索；会话完全不使用关键词检索，
+// 或设置了相似度阈值（没有问题向量无法检查）时报错
+func RetrieveWithQuestionEmbedding(ctx context.Context, db *sql.DB, cfg *config.Config, sessionId string, question string, questionEmbedding []float32, embedErr error, settings RetrievalSettings) ([]models.DocumentChunk, error) {
+	if settings.LexicalWeight >= 1 {
+		return RetrieveChunksByEmbedding(ctx, db, cfg, sessionId, question, nil, settings)
 	}
-	if len(questionEmbeddings) == 0 || len(questionEmbeddings[0]) == 0 {
-		return nil, fmt.Errorf("received empty embedding for question")
+	if embedErr == nil && len(questionEmbedding) == 0 {
+		embedErr = fmt.Errorf("received empty embedding for question")
+	}
+	if embedErr != nil {
+		if settings.LexicalWeight > 0 && settings.MinSimilarity <= 0 && ctx.Err() == nil {
+			fmt.Printf("警告：获取问题向量失败，仅使用关键词检索: %v\n", embedErr)
+			return RetrieveChunksByEmbedding(ctx, db, cfg, sessionId, question, nil, settings)
+		}
+		return nil, fmt.Errorf("failed to get embedding for question: %w", embedErr)
 	}
-	questionEmbedding := questionEmbeddings[0]
 	fmt.Printf("问题向量获取成功 (维度: %d)\n", len(questionEmbedding))
 
-	// 2. 从缓存获取文档块向量（避免每次查询都解析 JSON）
+	return RetrieveChunksByEmbedding(ctx, db, cfg, sessionId, question, questionEmbedding, settings)
+}
+
+// RetrieveChunksByEmbedding 使用已经计算好的问题向量和问题原文检索最相关的文档块：
+// 向量相似度和 BM25 关键词匹配分别排名，再按会话的关键词权重做倒数排名融合（RRF），
+// 这样产品型号、缩写、人名等精确匹配的内容即使向量相似度不高也能被找到。
+// 融合后按 settings 过滤相似度过低的文档块，取前 TopK 个，再按参考资料的 token 上限截断。
+// questionEmbedding 为 nil 时只使用关键词检索，此时无法检查相似度，设置了阈值时返回错误
+func RetrieveChunksByEmbedding(ctx context.Context, db *sql.DB, cfg *config.Config, sessionId string, question string, questionEmbedding []float32, settings RetrievalSettings) ([]models.DocumentChunk, error) {
+	topK := settings.TopK
+	if topK <= 0 {
+		topK = defaultRetrievalTopK
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if questionEmbedding == nil && settings.MinSimilarity > 0 {
+		return nil, fmt.Errorf("a question embedding is required to apply the minimum similarity %.2f", settings.MinSimilarity)
+	}
+
+	// 2. 从缓存获取文档块向量和 BM25 索引（避免每次查询都解析 JSON）
 	cache := GetVectorCache()
-	cachedChunks, err := cache.GetSessionChunks(db, sessionId)
+	index, err := cache.GetSessionIndex(db, sessionId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cached chunks for session %s: %w", sessionId, err)
 	}
+	cachedChunks := index.Chunks
 
-	var chunksWithSimilarity []ChunkWithSimilarity
+	weight := settings.LexicalWeight
+	if questionEmbedding == nil {
+		weight = 1
+	}
+	k := float64(cfg.RetrievalRRFK)
+	if k <= 0 {
+		k = 60
+	}
+	candidates := make([]fusedChunk, len(cachedChunks))
+	for i := range candidates {
+		candidates[i].index = i
+	}
 
-	// 3. 计算相似度（直接使用缓存的向量，无需反序列化）
-	fmt.Println("开始计算相似度...")
-	for _, cached := range cachedChunks {
-		similarity, err := cosineSimilarity(questionEmbedding, cached.Embedding)
-		if err != nil {
-			fmt.Printf("警告：计算文档块 %d 的相似度失败: %v\n", cached.ID, err)
-			continue
+	// 3. 向量检索：文档块较多且近似索引已建好时用 HNSW 取最相似的候选，否则计算全部相似度（直接使用缓存的向量，无需反序列化）并排名
+	opts := cache.Options()
+	if weight < 1 && index.ANN != nil && opts.MinChunks > 0 && len(cachedChunks) >= opts.MinChunks {
+		// 只有近似搜索返回的候选参与向量排名，候选数不少于 efSearch，保证融合时有足够多的向量名次
+		hits := index.ANN.search(questionEmbedding, max(topK, opts.EfSearch), opts.EfSearch)
+		rank := 0
+		for _, hit := range hits {
+			i, ok := index.Position(hit.id)
+			if !ok {
+				continue // 索引刚加入、缓存快照中还没有的文档块
+			}
+			rank++
+			candidates[i].similarity = hit.similarity
+			candidates[i].vectorRank = rank
 		}
-
-		chunk := models.DocumentChunk{
-			ID:         cached.ID,
-			DocumentID: cached.DocumentID,
-			Content:    cached.Content,
-			ChunkIndex: cached.ChunkIndex,
+		fmt.Printf("近似向量检索返回 %d 个候选（共 %d 个文档块）。\n", rank, len(cachedChunks))
+	} else if weight < 1 {
+		var ranked []int
+		for i, cached := range cachedChunks {
+			similarity, err := cosineSimilarity(questionEmbedding, cached.Embedding)
+			if err != nil {
+				fmt.Printf("警告：计算文档块 %d 的相似度失败: %v\n", cached.ID, err)
+				continue
+			}
+			candidates[i].similarity = similarity
+			ranked = append(ranked, i)
 		}
-		chunksWithSimilarity = append(chunksWithSimilarity, ChunkWithSimilarity{
-			Chunk:      chunk,
-			Similarity: similarity,
+		sort.SliceStable(ranked, func(a, b int) bool {
+			return candidates[ranked[a]].similarity > candidates[ranked[b]].similarity
 		})
+		for rank, i := range ranked {
+			candidates[i].vectorRank = rank + 1
+		}
 	}
-	fmt.Printf("相似度计算完成，处理了 %d 个有效块。\n", len(chunksWithSimilarity))
 
-	if len(chunksWithSimilarity) == 0 {
+	// 4. 关键词检索：BM25 排名
+	if weight > 0 {
+		for rank, hit := range index.Lexical.search(question) {
+			c := &candidates[hit.index]
+			c.lexical = hit.score
+			c.lexicalRank = rank + 1
+		}
+	}
+	for i := range candidates {
+		candidates[i].score = rrfScore(candidates[i].vectorRank, candidates[i].lexicalRank, weight, k)
+	}
+
+	// 相似度阈值：只被关键词检索命中的文档块也要检查与问题的向量相似度
+	checkSimilarity := settings.MinSimilarity > 0
+	var fused []fusedChunk
+	belowThreshold := 0
+	for _, c := range candidates {
+		if c.score <= 0 {
+			continue
+		}
+		if checkSimilarity {
+			if c.vectorRank == 0 {
+				c.similarity, _ = cosineSimilarity(questionEmbedding, cachedChunks[c.index].Embedding)
+			}
+			if c.similarity < settings.MinSimilarity {
+				belowThreshold++
+				continue
+			}
+		}
+		fused = append(fused, c)
+	}
+	fmt.Printf("检索完成，%d 个文档块参与融合排名（关键词权重 %.2f），%d 个低于相似度阈值 %.2f。\n", len(fused), weight, belowThreshold, settings.MinSimilarity)
+	if len(fused) == 0 {
 		fmt.Println("没有找到可比较的文档块。")
 		return []models.DocumentChunk{}, nil // 返回空切片，表示没有找到相关内容
 	}
 
-	// 4. 按相似度降序排序
-	sort.Slice(chunksWithSimilarity, func(i, j int) bool {
-		return chunksWithSimilarity[i].Similarity > chunksWithSimilarity[j].Similarity
-	})
-
-	// 5. 提取 topK 个块
-	numToReturn := min(topK, len(chunksWithSimilarity))
-	relevantChunks := make([]models.DocumentChunk, numToReturn)
+	// 5. 按融合得分降序排序，提取 topK 个块；参考资料超出 token 上限时丢弃排名靠后的块，
+	// 排名第一的块本身超出上限时截断
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].score > fused[j].score })
+	numToReturn := min(topK, len(fused))
+	relevantChunks := make([]models.DocumentChunk, 0, numToReturn)
 	fmt.Printf("检索到 Top %d 相关块:\n", numToReturn)
+	contextTokens := 0
 	for i := 0; i < numToReturn; i++ {
-		relevantChunks[i] = chunksWithSimilarity[i].Chunk
-		fmt.Printf("  - 块 ID: %d, 相似度: %.4f, 内容: %s...\n",
-			relevantChunks[i].ID,
-			chunksWithSimilarity[i].Similarity,
-			relevantChunks[i].Content[:min(50, len(relevantChunks[i].Content))])
+		c := fused[i]
+		cached := cachedChunks[c.index]
+		content := cached.Content
+		if limit := settings.MaxContextTokens; limit > 0 {
+			tokens := estimateTokens(content)
+			if contextTokens+tokens > limit {
+				if i > 0 {
+					fmt.Printf("参考资料达到 %d token 上限，丢弃其余 %d 个文档块。\n", limit, numToReturn-i)
+					break
+				}
+				content = truncateToTokens(content, limit)
+				tokens = limit
+			}
+			contextTokens += tokens
+		}
+		relevantChunks = append(relevantChunks, models.DocumentChunk{
+			ID:         cached.ID,
+			DocumentID: cached.DocumentID,
+			Content:    content,
+			ChunkIndex: cached.ChunkIndex,
+		})
+		fmt.Printf("  - 块 ID: %d, 融合得分: %.4f (向量 #%d %.4f, 关键词 #%d %.2f), 内容: %s...\n",
+			cached.ID, c.score, c.vectorRank, c.similarity, c.lexicalRank, c.lexical,
+			cached.Content[:min(50, len(cached.Content))])
 	}
 
 	return relevantChunks, nil
 }
 
+// rrfScore 倒数排名融合得分：两路名次（从 1 开始，0 表示该路未命中）分别按 1/(k+名次) 计分，
+// 再按关键词权重 weight 加权求和，两路都未命中时为 0
+func rrfScore(vectorRank, lexicalRank int, weight, k float64) float64 {
+	score := 0.0
+	if vectorRank > 0 {
+		score += (1 - weight) / (k + float64(vectorRank))
+	}
+	if lexicalRank > 0 {
+		score += weight / (k + float64(lexicalRank))
+	}
+	return score
+}
+
+// ValidateRetrievalConfig 检查全局检索配置：相似度阈值依赖问题向量，不能与只用关键词检索同时设置
+func ValidateRetrievalConfig(cfg *config.Config) error {
+	if cfg.RetrievalLexicalWeight >= 1 && cfg.RetrievalMinSimilarity > 0 {
+		return fmt.Errorf("RETRIEVAL_MIN_SIMILARITY cannot be used with RETRIEVAL_LEXICAL_WEIGHT=1 (keyword-only retrieval)")
+	}
+	return nil
+}
+
+// SessionRetrievalSettings 返回会话的检索设置，会话未设置的项使用 RETRIEVAL_TOP_K、RETRIEVAL_MIN_SIMILARITY、
+// RETRIEVAL_MAX_CONTEXT_TOKENS 和 RETRIEVAL_LEXICAL_WEIGHT
+func SessionRetrievalSettings(db *sql.DB, cfg *config.Config, sessionId string) RetrievalSettings {
+	settings := RetrievalSettings{
+		TopK:             cfg.RetrievalTopK,
+		MinSimilarity:    cfg.RetrievalMinSimilarity,
+		MaxContextTokens: cfg.RetrievalMaxContextTokens,
+		LexicalWeight:    cfg.RetrievalLexicalWeight,
+	}
+	var weight, minSimilarity sql.NullFloat64
+	var topK, maxContextTokens sql.NullInt64
+	err := db.QueryRow(`SELECT retrieval_lexical_weight, retrieval_top_k, retrieval_min_similarity, retrieval_max_context_tokens FROM sessions WHERE id = ?`, sessionId).
+		Scan(&weight, &topK, &minSimilarity, &maxContextTokens)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Printf("警告：查询会话 %s 的检索设置失败: %v。将使用默认值。\n", sessionId, err)
+	}
+	if err == nil {
+		if weight.Valid {
+			settings.LexicalWeight = weight.Float64
+		}
+		if topK.Valid {
+			settings.TopK = int(topK.Int64)
+		}
+		if minSimilarity.Valid {
+			settings.MinSimilarity = minSimilarity.Float64
+		}
+		if maxContextTokens.Valid {
+			settings.MaxContextTokens = int(maxContextTokens.Int64)
+		}
+	}
+	settings.LexicalWeight = math.Max(0, math.Min(1, settings.LexicalWeight))
+	if settings.TopK <= 0 {
+		settings.TopK = defaultRetrievalTopK
+	}
+	return settings
+}
+
+// truncateToTokens 截取文本开头不超过 limit 个估算 token 的部分（估算方式同 estimateTokens）
+func truncateToTokens(text string, limit int) string {
+	cjk, other := 0, 0
+	for i, r := range text {
+		if isCJK(r) {
+			cjk++
+		} else {
+			other++
+		}
+		if cjk+(other+3)/4+1 > limit {
+			return text[:i]
+		}
+	}
+	return text
+}
+
 // cosineSimilarity 计算两个 float32 切片的余弦相似度
 func cosineSimilarity(vecA, vecB []float32) (float64, error) {
 	if len(vecA) != len(vecB) {
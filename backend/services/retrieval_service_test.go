@@ -0,0 +1,239 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/mockopenai"
+)
+
+func TestRRFScoreOrdering(t *testing.T) {
+	type candidate struct {
+		name        string
+		vectorRank  int
+		lexicalRank int
+	}
+	tests := []struct {
+		name       string
+		weight     float64
+		candidates []candidate
+		want       []string
+	}{
+		{
+			name:   "found by both sides beats either side alone",
+			weight: 0.5,
+			candidates: []candidate{
+				{"vector-only", 1, 0},
+				{"keyword-only", 0, 1},
+				{"both", 2, 2},
+			},
+			want: []string{"both", "vector-only", "keyword-only"}, // 权重相同时两路名次 1 得分相同，保持原顺序
+		},
+		{
+			name:   "mid ranks on both sides beat the top of one side",
+			weight: 0.5,
+			candidates: []candidate{
+				{"vector-only", 1, 0},
+				{"both", 10, 10},
+			},
+			want: []string{"both", "vector-only"},
+		},
+		{
+			name:   "keyword weight favours keyword-only hits",
+			weight: 0.8,
+			candidates: []candidate{
+				{"vector-only", 1, 0},
+				{"keyword-only", 0, 3},
+			},
+			want: []string{"keyword-only", "vector-only"},
+		},
+		{
+			name:   "vector weight favours vector-only hits",
+			weight: 0.2,
+			candidates: []candidate{
+				{"keyword-only", 0, 1},
+				{"vector-only", 3, 0},
+			},
+			want: []string{"vector-only", "keyword-only"},
+		},
+		{
+			name:   "keyword-only weight ignores vector ranks",
+			weight: 1,
+			candidates: []candidate{
+				{"vector-only", 1, 0},
+				{"keyword-only", 0, 2},
+				{"none", 0, 0},
+			},
+			want: []string{"keyword-only"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scores := make(map[string]float64)
+			var got []string
+			for _, c := range tt.candidates {
+				if s := rrfScore(c.vectorRank, c.lexicalRank, tt.weight, 60); s > 0 {
+					scores[c.name] = s
+					got = append(got, c.name)
+				}
+			}
+			sort.SliceStable(got, func(i, j int) bool { return scores[got[i]] > scores[got[j]] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v (scores %v)", got, tt.want, scores)
+			}
+		})
+	}
+
+	if a, b := rrfScore(1, 0, 0.5, 60), rrfScore(0, 1, 0.5, 60); a != b {
+		t.Errorf("equal weights: vector-only %v != keyword-only %v", a, b)
+	}
+}
+
+// seedSessionCache 把 chunks 直接放入全局向量缓存，检索时不需要数据库
+func seedSessionCache(t *testing.T, sessionId string, chunks []CachedChunk) {
+	t.Helper()
+	vc := GetVectorCache()
+	vc.mu.Lock()
+	vc.sessions[sessionId] = newSessionCache(chunks, nil, time.Now())
+	vc.mu.Unlock()
+	t.Cleanup(func() { vc.InvalidateSession(sessionId) })
+}
+
+func TestRetrieveChunksFusion(t *testing.T) {
+	const sessionId = "fusion-test"
+	seedSessionCache(t, sessionId, []CachedChunk{
+		{ID: 1, Content: "sunrise colours over the harbour", Embedding: []float32{1, 0, 0}},
+		{ID: 2, Content: "refund policy for cancelled tickets", Embedding: []float32{0, 1, 0}},
+		{ID: 3, Content: "refund details", Embedding: []float32{0.9, 0.3, 0}},
+		{ID: 4, Content: "parking information", Embedding: []float32{0, 0, 1}},
+	})
+	cfg := &config.Config{RetrievalRRFK: 60}
+	query := []float32{1, 0, 0}
+
+	tests := []struct {
+		name     string
+		weight   float64
+		minSim   float64
+		question []float32
+		want     []int
+	}{
+		{"vector only", 0, 0, query, []int{1, 3, 2}},
+		{"keyword only", 1, 0, query, []int{2, 3}},
+		{"keyword only without embedding", 0.5, 0, nil, []int{2, 3}},
+		// 2 和 3 两路都命中，排在只有向量名次第一的 1 前面
+		{"hybrid", 0.5, 0, query, []int{2, 3, 1}},
+		{"threshold drops keyword-only hit", 0.5, 0.5, query, []int{3, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := RetrievalSettings{TopK: 3, LexicalWeight: tt.weight, MinSimilarity: tt.minSim}
+			chunks, err := RetrieveChunksByEmbedding(context.Background(), nil, cfg, sessionId, "refund policy", tt.question, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, c := range chunks {
+				got = append(got, c.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retrieved %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveRelevantChunksEmbeddingFailure(t *testing.T) {
+	const sessionId = "embedding-failure-test"
+	seedSessionCache(t, sessionId, []CachedChunk{
+		{ID: 1, Content: "refund policy for cancelled tickets", Embedding: []float32{1, 0}},
+		{ID: 2, Content: "parking information", Embedding: []float32{0, 1}},
+	})
+	// 向量请求始终返回 400（不重试），模拟向量服务不可用
+	srv := mockopenai.NewTestServer(mockopenai.Options{FailFirst: 1000, FailStatus: http.StatusBadRequest})
+	defer srv.Close()
+	cfg := &config.Config{LLMProvider: "openai", OpenAIAPIKey: "test", OpenAIAPIUrl: srv.URL + "/v1/chat/completions", RetrievalRRFK: 60}
+
+	// 未设置相似度阈值时退回关键词检索
+	chunks, err := RetrieveRelevantChunks(context.Background(), nil, cfg, "refund policy", sessionId, 0, RetrievalSettings{TopK: 3, LexicalWeight: 0.5})
+	if err != nil {
+		t.Fatalf("keyword fallback: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].ID != 1 {
+		t.Errorf("keyword fallback returned %+v, want chunk 1", chunks)
+	}
+
+	// 设置了相似度阈值时无法检查，返回错误而不是未经检查的文档块
+	settings := RetrievalSettings{TopK: 3, LexicalWeight: 0.5, MinSimilarity: 0.5}
+	if chunks, err := RetrieveRelevantChunks(context.Background(), nil, cfg, "refund policy", sessionId, 0, settings); err == nil {
+		t.Errorf("with a similarity threshold got %+v, want an error", chunks)
+	}
+	if _, err := RetrieveChunksByEmbedding(context.Background(), nil, cfg, sessionId, "refund policy", nil, settings); err == nil {
+		t.Error("RetrieveChunksByEmbedding without an embedding ignored the similarity threshold")
+	}
+}
+
+// TestRetrieveWithQuestionEmbeddingDoesNotReembed 复用回答缓存查找时的问题向量（或其错误），检索时不再请求向量服务
+func TestRetrieveWithQuestionEmbeddingDoesNotReembed(t *testing.T) {
+	const sessionId = "reuse-embedding-test"
+	seedSessionCache(t, sessionId, []CachedChunk{
+		{ID: 1, Content: "refund policy for cancelled tickets", Embedding: []float32{1, 0}},
+		{ID: 2, Content: "parking information", Embedding: []float32{0, 1}},
+	})
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	cfg := &config.Config{LLMProvider: "openai", OpenAIAPIKey: "test", OpenAIAPIUrl: srv.URL + "/v1/chat/completions", RetrievalRRFK: 60}
+	ctx := context.Background()
+	embedErr := errors.New("embedding service unavailable")
+
+	tests := []struct {
+		name      string
+		embedding []float32
+		embedErr  error
+		settings  RetrievalSettings
+		want      []int
+		wantErr   bool
+	}{
+		{"embedding", []float32{0, 1}, nil, RetrievalSettings{TopK: 1}, []int{2}, false},
+		{"failed embedding falls back to keywords", nil, embedErr, RetrievalSettings{TopK: 3, LexicalWeight: 0.5}, []int{1}, false},
+		{"failed embedding without keywords", nil, embedErr, RetrievalSettings{TopK: 3}, nil, true},
+		{"failed embedding with a threshold", nil, embedErr, RetrievalSettings{TopK: 3, LexicalWeight: 0.5, MinSimilarity: 0.5}, nil, true},
+		{"empty embedding", []float32{}, nil, RetrievalSettings{TopK: 3}, nil, true},
+		{"keyword only ignores the failure", nil, embedErr, RetrievalSettings{TopK: 3, LexicalWeight: 1}, []int{1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := RetrieveWithQuestionEmbedding(ctx, nil, cfg, sessionId, "refund policy", tt.embedding, tt.embedErr, tt.settings)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", chunks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, c := range chunks {
+				got = append(got, c.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retrieved %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := atomic.LoadInt64(&hits); got != 0 {
+		t.Errorf("embedding service called %d times, want 0", got)
+	}
+}
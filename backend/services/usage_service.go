@@ -0,0 +1,170 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soaringjerry/AnyQA/backend/config"
+	"github.com/soaringjerry/AnyQA/backend/models"
+)
+
+// UsageScope 标识一次模型调用归属的会话、问题或文档，用于用量记账
+type UsageScope struct {
+	SessionID  string
+	QuestionID int64 // 0 表示不属于某个问题
+	DocumentID int   // 0 表示不属于某个文档
+}
+
+// ModelPrice 模型单价，单位为美元 / 百万 token
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultModelPrices 内置价格表，可通过 MODEL_PRICES 覆盖或补充
+// 未列出的模型（如本地模型）按 0 计费
+var defaultModelPrices = map[string]ModelPrice{
+	"chatgpt-4o-latest":      {Input: 5, Output: 15},
+	"gpt-4o":                 {Input: 2.5, Output: 10},
+	"gpt-4o-mini":            {Input: 0.15, Output: 0.6},
+	"gpt-4.1":                {Input: 2, Output: 8},
+	"gpt-4.1-mini":           {Input: 0.4, Output: 1.6},
+	"gpt-4.1-nano":           {Input: 0.1, Output: 0.4},
+	"text-embedding-3-large": {Input: 0.13},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-ada-002": {Input: 0.1},
+	"claude-3-5-sonnet":      {Input: 3, Output: 15},
+	"claude-3-5-haiku":       {Input: 0.8, Output: 4},
+	"claude-3-7-sonnet":      {Input: 3, Output: 15},
+}
+
+// PriceTable 模型名到单价的映射
+type PriceTable map[string]ModelPrice
+
+var (
+	priceTable     PriceTable
+	priceTableOnce sync.Once
+)
+
+// GetPriceTable 获取全局价格表（内置价格叠加 cfg.ModelPrices）
+func GetPriceTable(cfg *config.Config) PriceTable {
+	priceTableOnce.Do(func() {
+		priceTable = make(PriceTable, len(defaultModelPrices))
+		for model, price := range defaultModelPrices {
+			priceTable[model] = price
+		}
+		if strings.TrimSpace(cfg.ModelPrices) == "" {
+			return
+		}
+		var overrides map[string]ModelPrice
+		if err := json.Unmarshal([]byte(cfg.ModelPrices), &overrides); err != nil {
+			fmt.Printf("警告：MODEL_PRICES 解析失败，使用内置价格表: %v\n", err)
+			return
+		}
+		for model, price := range overrides {
+			priceTable[strings.ToLower(model)] = price
+		}
+		fmt.Printf("已加载 %d 个自定义模型价格。\n", len(overrides))
+	})
+	return priceTable
+}
+
+// Lookup 查找模型单价：先精确匹配，再取最长的前缀匹配
+// （例如 gpt-4o-2024-08-06 使用 gpt-4o 的价格）
+func (t PriceTable) Lookup(model string) (ModelPrice, bool) {
+	model = strings.ToLower(model)
+	if price, ok := t[model]; ok {
+		return price, true
+	}
+	best := ""
+	for name := range t {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return t[best], true
+}
+
+// Cost 计算一次调用的费用（美元）
+func (t PriceTable) Cost(model string, usage UsageData) float64 {
+	price, ok := t.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// RecordUsage 持久化一次模型调用的用量；写入失败只记录日志，不影响主流程
+func RecordUsage(db *sql.DB, u models.AIUsage) {
+	if db == nil {
+		return
+	}
+	var questionID, documentID interface{}
+	if u.QuestionID != nil {
+		questionID = *u.QuestionID
+	}
+	if u.DocumentID != nil {
+		documentID = *u.DocumentID
+	}
+	var errText interface{}
+	if u.Error != "" {
+		errText = truncateRunes(u.Error, 500)
+	}
+
+	_, err := db.Exec(`INSERT INTO ai_usage
+		(session_id, question_id, document_id, kind, purpose, provider, model,
+		 prompt_tokens, completion_tokens, total_tokens, latency_ms, cost_usd, success, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.SessionID, questionID, documentID, u.Kind, u.Purpose, u.Provider, u.Model,
+		u.PromptTokens, u.CompletionTokens, u.TotalTokens, u.LatencyMs, u.CostUSD, u.Success, errText)
+	if err != nil {
+		fmt.Printf("警告：记录模型用量失败 (会话 %s, %s/%s): %v\n", u.SessionID, u.Kind, u.Purpose, err)
+	}
+}
+
+// newUsageRecord 根据调用范围和结果构造用量记录
+func newUsageRecord(scope UsageScope, kind, purpose, provider, model string, usage UsageData, latency time.Duration, callErr error) models.AIUsage {
+	u := models.AIUsage{
+		SessionID:        scope.SessionID,
+		Kind:             kind,
+		Purpose:          purpose,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		LatencyMs:        latency.Milliseconds(),
+		Success:          callErr == nil,
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	if scope.QuestionID > 0 {
+		questionID := scope.QuestionID
+		u.QuestionID = &questionID
+	}
+	if scope.DocumentID > 0 {
+		documentID := scope.DocumentID
+		u.DocumentID = &documentID
+	}
+	if callErr != nil {
+		u.Error = callErr.Error()
+	}
+	return u
+}
+
+// truncateRunes 按字符截断字符串
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
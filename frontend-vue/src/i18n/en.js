@@ -51,6 +51,11 @@ export default {
       noAiSuggestion: 'No AI suggestion available',
       kbSuggestion: 'Knowledge Base Suggestion', // New
       noKbSuggestion: 'No suggestion from knowledge base', // New
+      assistantFailed: 'This assistant could not generate a suggestion.',
+      assistantNoMatch: 'No relevant knowledge base content was found for this assistant.',
+      showQuestionFailed: 'Could not show this question: {message}',
+      kbSources: 'Sources',
+      kbConfidence: 'confidence',
       loadError: 'Failed to load questions',
       deleteError: 'Delete failed',
       updateError: 'Update failed',
@@ -80,8 +85,26 @@ export default {
       genericPromptLabel: 'Generic AI Suggestion Prompt:',
       genericPromptPlaceholder: '(Leave empty to use system default)',
       kbPromptLabel: 'Knowledge Base QA Prompt:',
-      kbPromptPlaceholder: '(Leave empty to use system default, must include "%s" for context)',
-      kbPromptHint: 'Hint: The knowledge base prompt template must include "%s", which will be replaced by the retrieved document snippets.',
+      kbPromptPlaceholder: '(Leave empty to use system default, must include "{'{{.Context}}'}" for context)',
+      kbPromptHint: 'Hint: Prompts are templates. The knowledge base prompt must include "{'{{.Context}}'}", which will be replaced by the retrieved document snippets. Also available: {'{{.Question}}'}, {'{{.SessionTitle}}'}, {'{{.Language}}'}, {'{{.Now}}'}.',
+      promptPresetLabel: 'Prompt Preset:',
+      promptPresetNone: '(No preset)',
+      promptPresetHint: 'Prompts left empty or unchanged follow the selected preset, then the system default.',
+      promptPresetApplied: 'Prompt preset updated.',
+      dryRunQuestionPlaceholder: 'Sample question to preview the prompts',
+      dryRunGenericButton: 'Preview Generic',
+      dryRunKbButton: 'Preview Knowledge Base',
+      dryRunning: 'Running preview...',
+      dryRunUsage: 'Model {model} · {tokens} tokens · {ms} ms',
+      dryRunSystemPrompt: 'Rendered system prompt',
+      dryRunContext: 'Retrieved context',
+      dryRunError: 'Preview failed: {message}',
+      promptVersionsTitle: 'Prompt History',
+      promptCurrentVersion: 'Current',
+      promptRestoredFrom: 'restored from v{version}',
+      promptRestoreButton: 'Restore',
+      promptRestoreConfirm: 'Restore prompt version v{version}? It will take effect immediately.',
+      promptRestoreSuccess: 'Restored prompt version v{version}.',
       savePromptsButton: 'Save Prompts',
       loadingPrompts: 'Loading prompts...',
       savingPrompts: 'Saving prompts...',
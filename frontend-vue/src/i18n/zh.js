@@ -51,6 +51,11 @@ export default {
       noAiSuggestion: '暂无AI建议',
       kbSuggestion: '知识库建议', // 新增
       noKbSuggestion: '暂无知识库建议', // 新增
+      assistantFailed: '该助手未能生成建议。',
+      assistantNoMatch: '知识库中没有找到该助手可用的相关内容。',
+      showQuestionFailed: '无法展示该问题：{message}',
+      kbSources: '参考来源',
+      kbConfidence: '置信度',
       loadError: '加载问题失败',
       deleteError: '删除失败',
       updateError: '更新失败',
@@ -80,8 +85,26 @@ export default {
       genericPromptLabel: '通用 AI 建议提示词:',
       genericPromptPlaceholder: '（留空则使用系统默认）',
       kbPromptLabel: '知识库问答提示词:',
-      kbPromptPlaceholder: '（留空则使用系统默认，必须包含 "%s" 以插入文档内容）',
-      kbPromptHint: '提示：知识库提示词模板中必须包含 "%s" 占位符，它将被实际检索到的文档片段替换。',
+      kbPromptPlaceholder: '（留空则使用系统默认，必须包含 "{'{{.Context}}'}" 以插入文档内容）',
+      kbPromptHint: '提示：提示词是模板，知识库提示词中必须包含 "{'{{.Context}}'}"，它将被实际检索到的文档片段替换。还可以使用 {'{{.Question}}'}、{'{{.SessionTitle}}'}、{'{{.Language}}'}、{'{{.Now}}'}。',
+      promptPresetLabel: '提示词预设:',
+      promptPresetNone: '（不使用预设）',
+      promptPresetHint: '留空或未修改的提示词依次使用所选预设和系统默认提示词。',
+      promptPresetApplied: '提示词预设已更新。',
+      dryRunQuestionPlaceholder: '输入示例问题以试运行提示词',
+      dryRunGenericButton: '试运行通用提示词',
+      dryRunKbButton: '试运行知识库提示词',
+      dryRunning: '试运行中...',
+      dryRunUsage: '模型 {model} · {tokens} tokens · {ms} 毫秒',
+      dryRunSystemPrompt: '渲染后的系统提示词',
+      dryRunContext: '检索到的参考资料',
+      dryRunError: '试运行失败：{message}',
+      promptVersionsTitle: '提示词历史版本',
+      promptCurrentVersion: '当前版本',
+      promptRestoredFrom: '回滚自 v{version}',
+      promptRestoreButton: '回滚',
+      promptRestoreConfirm: '确定回滚到提示词版本 v{version} 吗？回滚后立即生效。',
+      promptRestoreSuccess: '已回滚到提示词版本 v{version}。',
       savePromptsButton: '保存提示词',
       loadingPrompts: '正在加载提示词...',
       savingPrompts: '正在保存提示词...',
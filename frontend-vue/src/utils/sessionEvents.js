@@ -0,0 +1,42 @@
+// 订阅会话的实时事件（GET /api/ws?sessionId=），断线后按指数退避自动重连。
+// 每次连接（包括重连）成功后调用 onOpen，调用方应在其中重新拉取完整数据，补上断线期间错过的事件
+export function subscribeSessionEvents(wsEndpoint, sessionId, { onEvent, onOpen } = {}) {
+  let ws = null;
+  let closed = false;
+  let retryDelay = 1000;
+  let retryTimer = null;
+
+  function connect() {
+    const separator = wsEndpoint.includes('?') ? '&' : '?';
+    ws = new WebSocket(`${wsEndpoint}${separator}sessionId=${encodeURIComponent(sessionId)}`);
+    ws.onopen = () => {
+      retryDelay = 1000;
+      if (onOpen) onOpen();
+    };
+    ws.onmessage = (message) => {
+      let event;
+      try {
+        event = JSON.parse(message.data);
+      } catch (error) {
+        console.error('无法解析会话事件:', error);
+        return;
+      }
+      if (onEvent) onEvent(event);
+    };
+    ws.onclose = () => {
+      ws = null;
+      if (closed) return;
+      retryTimer = setTimeout(connect, retryDelay);
+      retryDelay = Math.min(retryDelay * 2, 30000);
+    };
+  }
+
+  connect();
+  return {
+    close() {
+      closed = true;
+      clearTimeout(retryTimer);
+      if (ws) ws.close();
+    }
+  };
+}
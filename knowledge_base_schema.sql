@@ -75,4 +75,284 @@ CREATE TABLE IF NOT EXISTS session_prompts (
      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- 创建会话表
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(50) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci PRIMARY KEY,
+    title VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    owner VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    starts_at DATETIME NULL,
+    ends_at DATETIME NULL,
+    accepting_questions BOOLEAN NOT NULL DEFAULT TRUE,
+    status ENUM('active','closed') NOT NULL DEFAULT 'active',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    closed_at DATETIME NULL,
+    INDEX idx_owner (owner)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 为会话表添加演讲者令牌哈希列（明文令牌只在创建会话时返回一次）
+SET @col_token_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'sessions' AND column_name = 'presenter_token_hash');
+SET @sql_add_token = IF(@col_token_exists = 0,
+   'ALTER TABLE sessions ADD COLUMN presenter_token_hash CHAR(64) NULL AFTER closed_at, ADD UNIQUE INDEX idx_presenter_token (presenter_token_hash);',
+   'SELECT "Column presenter_token_hash already exists.";'
+);
+PREPARE stmt_add_token FROM @sql_add_token;
+EXECUTE stmt_add_token;
+DEALLOCATE PREPARE stmt_add_token;
+
+-- 为已有数据中出现过的 sessionId 补建会话记录，保证旧会话仍可写入
+INSERT IGNORE INTO sessions (id, created_at)
+SELECT session_id, MIN(created_at) FROM questions GROUP BY session_id;
+INSERT IGNORE INTO sessions (id, created_at)
+SELECT session_id, MIN(upload_time) FROM documents GROUP BY session_id;
+INSERT IGNORE INTO sessions (id)
+SELECT session_id FROM session_prompts;
+
+-- 创建模型调用用量表（用于按会话、按天统计 token 和费用）
+CREATE TABLE IF NOT EXISTS ai_usage (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  session_id VARCHAR(50) NOT NULL DEFAULT '',
+  question_id INT NULL,
+  document_id INT NULL,
+  kind ENUM('chat','embedding') NOT NULL,
+  purpose VARCHAR(32) NOT NULL DEFAULT '',
+  provider VARCHAR(32) NOT NULL DEFAULT '',
+  model VARCHAR(128) NOT NULL DEFAULT '',
+  prompt_tokens INT NOT NULL DEFAULT 0,
+  completion_tokens INT NOT NULL DEFAULT 0,
+  total_tokens INT NOT NULL DEFAULT 0,
+  latency_ms INT NOT NULL DEFAULT 0,
+  cost_usd DECIMAL(16,8) NOT NULL DEFAULT 0,
+  success BOOLEAN NOT NULL DEFAULT TRUE,
+  error VARCHAR(512) NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_session_created (session_id, created_at),
+  INDEX idx_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 为会话表添加 AI 花费预算列
+SET @col_budget_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'sessions' AND column_name = 'budget_tokens');
+SET @sql_add_budget = IF(@col_budget_exists = 0,
+   'ALTER TABLE sessions ADD COLUMN budget_tokens BIGINT NULL, ADD COLUMN budget_usd DECIMAL(12,4) NULL, ADD COLUMN budget_fallback_model VARCHAR(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '''', ADD COLUMN budget_warned_at DATETIME NULL, ADD COLUMN budget_exceeded_at DATETIME NULL;',
+   'SELECT "Budget columns already exist.";'
+);
+PREPARE stmt_add_budget FROM @sql_add_budget;
+EXECUTE stmt_add_budget;
+DEALLOCATE PREPARE stmt_add_budget;
+
+-- 为问题表添加预算超限标记
+SET @col_budget_q_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'questions' AND column_name = 'budget_exceeded');
+SET @sql_add_budget_q = IF(@col_budget_q_exists = 0,
+   'ALTER TABLE questions ADD COLUMN budget_exceeded BOOLEAN NOT NULL DEFAULT FALSE AFTER kb_suggestion;',
+   'SELECT "Column budget_exceeded already exists.";'
+);
+PREPARE stmt_add_budget_q FROM @sql_add_budget_q;
+EXECUTE stmt_add_budget_q;
+DEALLOCATE PREPARE stmt_add_budget_q;
+
+-- 为会话提示词表添加生成参数列（模型、temperature、max_tokens、top_p，通用与知识库分开设置）
+SET @col_gen_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'session_prompts' AND column_name = 'generic_model');
+SET @sql_add_gen = IF(@col_gen_exists = 0,
+   'ALTER TABLE session_prompts ADD COLUMN generic_model VARCHAR(128) NULL AFTER kb_prompt, ADD COLUMN generic_temperature DECIMAL(4,2) NULL AFTER generic_model, ADD COLUMN generic_max_tokens INT NULL AFTER generic_temperature, ADD COLUMN generic_top_p DECIMAL(4,3) NULL AFTER generic_max_tokens, ADD COLUMN kb_model VARCHAR(128) NULL AFTER generic_top_p, ADD COLUMN kb_temperature DECIMAL(4,2) NULL AFTER kb_model, ADD COLUMN kb_max_tokens INT NULL AFTER kb_temperature, ADD COLUMN kb_top_p DECIMAL(4,3) NULL AFTER kb_max_tokens;',
+   'SELECT "Generation setting columns already exist.";'
+);
+PREPARE stmt_add_gen FROM @sql_add_gen;
+EXECUTE stmt_add_gen;
+DEALLOCATE PREPARE stmt_add_gen;
+
+-- 为问题表添加知识库回答置信度
+SET @col_kb_conf_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'questions' AND column_name = 'kb_confidence');
+SET @sql_add_kb_conf = IF(@col_kb_conf_exists = 0,
+   'ALTER TABLE questions ADD COLUMN kb_confidence DECIMAL(4,3) NULL AFTER kb_suggestion;',
+   'SELECT "Column kb_confidence already exists.";'
+);
+PREPARE stmt_add_kb_conf FROM @sql_add_kb_conf;
+EXECUTE stmt_add_kb_conf;
+DEALLOCATE PREPARE stmt_add_kb_conf;
+
+-- 创建知识库回答引用表（问题或文档块删除时引用随之删除）
+CREATE TABLE IF NOT EXISTS question_citations (
+  question_id INT NOT NULL,
+  chunk_id INT NOT NULL,
+  document_id INT NOT NULL,
+  `rank` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (question_id, chunk_id),
+  FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
+  FOREIGN KEY (chunk_id) REFERENCES document_chunks(id) ON DELETE CASCADE,
+  INDEX idx_chunk (chunk_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 为问题表添加实际生成建议的模型（主模型失败时可能是备用模型）
+SET @col_q_model_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'questions' AND column_name = 'ai_model');
+SET @sql_add_q_model = IF(@col_q_model_exists = 0,
+   'ALTER TABLE questions ADD COLUMN ai_model VARCHAR(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '''' AFTER kb_confidence, ADD COLUMN kb_model VARCHAR(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '''' AFTER ai_model;',
+   'SELECT "Question model columns already exist.";'
+);
+PREPARE stmt_add_q_model FROM @sql_add_q_model;
+EXECUTE stmt_add_q_model;
+DEALLOCATE PREPARE stmt_add_q_model;
+
+-- 将旧版 %s 格式的知识库提示词迁移为模板格式（{{.Context}}），%% 还原为 %
+-- 未迁移的旧提示词在读取时也会自动转换，这一步只是让数据库中的内容保持一致
+-- 与 MigrateLegacyPrompt 一致：先把 %% 换成占位符，避免 %%s 被当成 % 加 %s；旧提示词不含 {{，占位符不会冲突
+UPDATE session_prompts
+SET kb_prompt = REPLACE(REPLACE(REPLACE(kb_prompt, '%%', '{{PCT}}'), '%s', '{{.Context}}'), '{{PCT}}', '%')
+WHERE kb_prompt LIKE '%\%s%' AND kb_prompt NOT LIKE '%{{%';
+
+-- 为会话提示词表添加当前版本号，为问题表添加提问时生效的提示词版本
+SET @col_prompt_ver_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'session_prompts' AND column_name = 'prompt_version');
+SET @sql_add_prompt_ver = IF(@col_prompt_ver_exists = 0,
+   'ALTER TABLE session_prompts ADD COLUMN prompt_version INT NOT NULL DEFAULT 0 AFTER kb_top_p;',
+   'SELECT "Column prompt_version in session_prompts already exists.";'
+);
+PREPARE stmt_add_prompt_ver FROM @sql_add_prompt_ver;
+EXECUTE stmt_add_prompt_ver;
+DEALLOCATE PREPARE stmt_add_prompt_ver;
+
+SET @col_q_prompt_ver_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'questions' AND column_name = 'prompt_version');
+SET @sql_add_q_prompt_ver = IF(@col_q_prompt_ver_exists = 0,
+   'ALTER TABLE questions ADD COLUMN prompt_version INT NULL AFTER kb_model;',
+   'SELECT "Column prompt_version in questions already exists.";'
+);
+PREPARE stmt_add_q_prompt_ver FROM @sql_add_q_prompt_ver;
+EXECUTE stmt_add_q_prompt_ver;
+DEALLOCATE PREPARE stmt_add_q_prompt_ver;
+
+-- 创建提示词版本历史表
+CREATE TABLE IF NOT EXISTS prompt_versions (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  session_id VARCHAR(50) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL,
+  version INT NOT NULL,
+  generic_prompt TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci,
+  kb_prompt TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci,
+  author VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  source ENUM('update','restore') NOT NULL DEFAULT 'update',
+  restored_from INT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_session_version (session_id, version)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 已有的自定义提示词记为版本 1，使其可以在历史中查看和回滚
+INSERT INTO prompt_versions (session_id, version, generic_prompt, kb_prompt, author, source, created_at)
+SELECT session_id, 1, generic_prompt, kb_prompt, 'migration', 'update', updated_at
+FROM session_prompts sp
+WHERE sp.prompt_version = 0
+  AND NOT EXISTS (SELECT 1 FROM prompt_versions pv WHERE pv.session_id = sp.session_id);
+UPDATE session_prompts sp
+SET sp.prompt_version = 1, sp.updated_at = sp.updated_at
+WHERE sp.prompt_version = 0
+  AND EXISTS (SELECT 1 FROM prompt_versions pv WHERE pv.session_id = sp.session_id AND pv.version = 1);
+
+-- 创建共享的提示词预设表
+CREATE TABLE IF NOT EXISTS prompt_presets (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL,
+  description VARCHAR(500) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  generic_prompt TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci,
+  kb_prompt TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci,
+  created_by VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 为会话提示词表添加引用的预设（预设删除时引用置空），为提示词版本表记录当时引用的预设
+SET @col_preset_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'session_prompts' AND column_name = 'preset_id');
+SET @sql_add_preset = IF(@col_preset_exists = 0,
+   'ALTER TABLE session_prompts ADD COLUMN preset_id INT NULL AFTER kb_top_p, ADD CONSTRAINT fk_session_prompts_preset FOREIGN KEY (preset_id) REFERENCES prompt_presets(id) ON DELETE SET NULL;',
+   'SELECT "Column preset_id in session_prompts already exists.";'
+);
+PREPARE stmt_add_preset FROM @sql_add_preset;
+EXECUTE stmt_add_preset;
+DEALLOCATE PREPARE stmt_add_preset;
+
+SET @col_ver_preset_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'prompt_versions' AND column_name = 'preset_id');
+SET @sql_add_ver_preset = IF(@col_ver_preset_exists = 0,
+   'ALTER TABLE prompt_versions ADD COLUMN preset_id INT NULL AFTER kb_prompt;',
+   'SELECT "Column preset_id in prompt_versions already exists.";'
+);
+PREPARE stmt_add_ver_preset FROM @sql_add_ver_preset;
+EXECUTE stmt_add_ver_preset;
+DEALLOCATE PREPARE stmt_add_ver_preset;
+
+-- 创建会话助手表及助手建议表
+CREATE TABLE IF NOT EXISTS session_assistants (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  session_id VARCHAR(50) NOT NULL,
+  name VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL,
+  prompt TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL,
+  use_kb BOOLEAN NOT NULL DEFAULT FALSE,
+  model VARCHAR(128) NULL,
+  temperature DECIMAL(4,2) NULL,
+  max_tokens INT NULL,
+  top_p DECIMAL(4,3) NULL,
+  position INT NOT NULL DEFAULT 0,
+  enabled BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_session_name (session_id, name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS question_assistant_answers (
+  question_id INT NOT NULL,
+  assistant_id INT NOT NULL,
+  assistant_name VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  content TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci,
+  model VARCHAR(128) NOT NULL DEFAULT '',
+  status ENUM('done','failed') NOT NULL DEFAULT 'done',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (question_id, assistant_id),
+  FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 为会话表添加知识库检索的关键词权重（为空时使用 RETRIEVAL_LEXICAL_WEIGHT）
+SET @col_lexical_weight_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'sessions' AND column_name = 'retrieval_lexical_weight');
+SET @sql_add_lexical_weight = IF(@col_lexical_weight_exists = 0,
+   'ALTER TABLE sessions ADD COLUMN retrieval_lexical_weight DECIMAL(4,3) NULL AFTER budget_exceeded_at;',
+   'SELECT "Column retrieval_lexical_weight in sessions already exists.";'
+);
+PREPARE stmt_add_lexical_weight FROM @sql_add_lexical_weight;
+EXECUTE stmt_add_lexical_weight;
+DEALLOCATE PREPARE stmt_add_lexical_weight;
+
+-- 为会话表添加知识库检索的 topK、相似度阈值和参考资料 token 上限（为空时使用全局配置）
+SET @col_retrieval_top_k_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'sessions' AND column_name = 'retrieval_top_k');
+SET @sql_add_retrieval_settings = IF(@col_retrieval_top_k_exists = 0,
+   'ALTER TABLE sessions ADD COLUMN retrieval_top_k INT NULL AFTER retrieval_lexical_weight, ADD COLUMN retrieval_min_similarity DECIMAL(4,3) NULL AFTER retrieval_top_k, ADD COLUMN retrieval_max_context_tokens INT NULL AFTER retrieval_min_similarity;',
+   'SELECT "Columns retrieval_top_k, retrieval_min_similarity and retrieval_max_context_tokens in sessions already exist.";'
+);
+PREPARE stmt_add_retrieval_settings FROM @sql_add_retrieval_settings;
+EXECUTE stmt_add_retrieval_settings;
+DEALLOCATE PREPARE stmt_add_retrieval_settings;
+
+-- 为问题表添加“知识库无匹配”标记
+SET @col_kb_no_match_exists = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'questions' AND column_name = 'kb_no_match');
+SET @sql_add_kb_no_match = IF(@col_kb_no_match_exists = 0,
+   'ALTER TABLE questions ADD COLUMN kb_no_match BOOLEAN NOT NULL DEFAULT FALSE AFTER budget_exceeded;',
+   'SELECT "Column kb_no_match already exists.";'
+);
+PREPARE stmt_add_kb_no_match FROM @sql_add_kb_no_match;
+EXECUTE stmt_add_kb_no_match;
+DEALLOCATE PREPARE stmt_add_kb_no_match;
+
+-- 提示词版本来源增加 preset（引用的预设被修改）
+SET @ver_source_has_preset = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'prompt_versions' AND column_name = 'source' AND column_type LIKE '%''preset''%');
+SET @sql_ver_source_preset = IF(@ver_source_has_preset = 0,
+   'ALTER TABLE prompt_versions MODIFY source ENUM(''update'',''restore'',''preset'') NOT NULL DEFAULT ''update'';',
+   'SELECT "Column source in prompt_versions already accepts preset.";'
+);
+PREPARE stmt_ver_source_preset FROM @sql_ver_source_preset;
+EXECUTE stmt_ver_source_preset;
+DEALLOCATE PREPARE stmt_ver_source_preset;
+
+-- 助手建议状态增加 no_match（使用知识库的助手没有检索到相关内容）
+SET @assistant_status_has_no_match = (SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'question_assistant_answers' AND column_name = 'status' AND column_type LIKE '%''no_match''%');
+SET @sql_assistant_status_no_match = IF(@assistant_status_has_no_match = 0,
+   'ALTER TABLE question_assistant_answers MODIFY status ENUM(''done'',''failed'',''no_match'') NOT NULL DEFAULT ''done'';',
+   'SELECT "Column status in question_assistant_answers already accepts no_match.";'
+);
+PREPARE stmt_assistant_status_no_match FROM @sql_assistant_status_no_match;
+EXECUTE stmt_assistant_status_no_match;
+DEALLOCATE PREPARE stmt_assistant_status_no_match;
+
 SELECT '数据库表结构更新完成（如果需要）。';
\ No newline at end of file
@@ -5,6 +5,32 @@ SET SQL_MODE = "NO_AUTO_VALUE_ON_ZERO";
 SET time_zone = "+00:00";
 SET NAMES utf8mb4;
 
+-- 会话表
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` VARCHAR(50) PRIMARY KEY,
+  `title` VARCHAR(255) NOT NULL DEFAULT '',
+  `owner` VARCHAR(255) NOT NULL DEFAULT '',
+  `starts_at` DATETIME NULL,
+  `ends_at` DATETIME NULL,
+  `accepting_questions` BOOLEAN NOT NULL DEFAULT TRUE,
+  `status` ENUM('active','closed') NOT NULL DEFAULT 'active',
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `closed_at` DATETIME NULL,
+  `presenter_token_hash` CHAR(64) NULL,
+  `budget_tokens` BIGINT NULL,
+  `budget_usd` DECIMAL(12,4) NULL,
+  `budget_fallback_model` VARCHAR(128) NOT NULL DEFAULT '',
+  `budget_warned_at` DATETIME NULL,
+  `budget_exceeded_at` DATETIME NULL,
+  `retrieval_lexical_weight` DECIMAL(4,3) NULL,
+  `retrieval_top_k` INT NULL,
+  `retrieval_min_similarity` DECIMAL(4,3) NULL,
+  `retrieval_max_context_tokens` INT NULL,
+  INDEX idx_owner (owner),
+  UNIQUE INDEX idx_presenter_token (presenter_token_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- 问题表
 CREATE TABLE IF NOT EXISTS `questions` (
   `id` INT AUTO_INCREMENT PRIMARY KEY,
@@ -13,6 +39,12 @@ CREATE TABLE IF NOT EXISTS `questions` (
   `status` ENUM('pending','showing','answered','finished') DEFAULT 'pending',
   `ai_suggestion` TEXT,
   `kb_suggestion` TEXT,
+  `kb_confidence` DECIMAL(4,3) NULL,
+  `ai_model` VARCHAR(128) NOT NULL DEFAULT '',
+  `kb_model` VARCHAR(128) NOT NULL DEFAULT '',
+  `prompt_version` INT NULL,
+  `budget_exceeded` BOOLEAN NOT NULL DEFAULT FALSE,
+  `kb_no_match` BOOLEAN NOT NULL DEFAULT FALSE,
   `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   INDEX idx_session (session_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -39,10 +71,114 @@ CREATE TABLE IF NOT EXISTS `document_chunks` (
   INDEX idx_document (document_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- 知识库回答引用的文档块
+CREATE TABLE IF NOT EXISTS `question_citations` (
+  `question_id` INT NOT NULL,
+  `chunk_id` INT NOT NULL,
+  `document_id` INT NOT NULL,
+  `rank` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (question_id, chunk_id),
+  FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
+  FOREIGN KEY (chunk_id) REFERENCES document_chunks(id) ON DELETE CASCADE,
+  INDEX idx_chunk (chunk_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 共享的提示词预设表（会话可以引用，未自定义的提示词使用预设内容）
+CREATE TABLE IF NOT EXISTS `prompt_presets` (
+  `id` INT AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(100) NOT NULL,
+  `description` VARCHAR(500) NOT NULL DEFAULT '',
+  `generic_prompt` TEXT,
+  `kb_prompt` TEXT,
+  `created_by` VARCHAR(100) NOT NULL DEFAULT '',
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- 会话自定义提示词表
 CREATE TABLE IF NOT EXISTS `session_prompts` (
   `session_id` VARCHAR(50) PRIMARY KEY,
   `generic_prompt` TEXT,
   `kb_prompt` TEXT,
-  `updated_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+  `generic_model` VARCHAR(128) NULL,
+  `generic_temperature` DECIMAL(4,2) NULL,
+  `generic_max_tokens` INT NULL,
+  `generic_top_p` DECIMAL(4,3) NULL,
+  `kb_model` VARCHAR(128) NULL,
+  `kb_temperature` DECIMAL(4,2) NULL,
+  `kb_max_tokens` INT NULL,
+  `kb_top_p` DECIMAL(4,3) NULL,
+  `preset_id` INT NULL,
+  `prompt_version` INT NOT NULL DEFAULT 0,
+  `updated_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  FOREIGN KEY (preset_id) REFERENCES prompt_presets(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 提示词版本历史表（每次保存或回滚提示词都新增一个版本）
+CREATE TABLE IF NOT EXISTS `prompt_versions` (
+  `id` INT AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(50) NOT NULL,
+  `version` INT NOT NULL,
+  `generic_prompt` TEXT,
+  `kb_prompt` TEXT,
+  `preset_id` INT NULL,
+  `author` VARCHAR(100) NOT NULL DEFAULT '',
+  `source` ENUM('update','restore','preset') NOT NULL DEFAULT 'update',
+  `restored_from` INT NULL,
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_session_version (session_id, version)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 会话自定义的助手：每个助手按自己的提示词、模型和是否使用知识库，与内置建议并行生成一路建议
+CREATE TABLE IF NOT EXISTS `session_assistants` (
+  `id` INT AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(50) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `prompt` TEXT NOT NULL,
+  `use_kb` BOOLEAN NOT NULL DEFAULT FALSE,
+  `model` VARCHAR(128) NULL,
+  `temperature` DECIMAL(4,2) NULL,
+  `max_tokens` INT NULL,
+  `top_p` DECIMAL(4,3) NULL,
+  `position` INT NOT NULL DEFAULT 0,
+  `enabled` BOOLEAN NOT NULL DEFAULT TRUE,
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE INDEX idx_session_name (session_id, name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 助手为每个问题生成的建议（不引用助手表，删除助手后历史建议仍保留）
+CREATE TABLE IF NOT EXISTS `question_assistant_answers` (
+  `question_id` INT NOT NULL,
+  `assistant_id` INT NOT NULL,
+  `assistant_name` VARCHAR(100) NOT NULL DEFAULT '',
+  `content` TEXT,
+  `model` VARCHAR(128) NOT NULL DEFAULT '',
+  `status` ENUM('done','failed','no_match') NOT NULL DEFAULT 'done',
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (question_id, assistant_id),
+  FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 模型调用用量表（不设外键，删除问题或文档后账单记录仍保留）
+CREATE TABLE IF NOT EXISTS `ai_usage` (
+  `id` BIGINT AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(50) NOT NULL DEFAULT '',
+  `question_id` INT NULL,
+  `document_id` INT NULL,
+  `kind` ENUM('chat','embedding') NOT NULL,
+  `purpose` VARCHAR(32) NOT NULL DEFAULT '',
+  `provider` VARCHAR(32) NOT NULL DEFAULT '',
+  `model` VARCHAR(128) NOT NULL DEFAULT '',
+  `prompt_tokens` INT NOT NULL DEFAULT 0,
+  `completion_tokens` INT NOT NULL DEFAULT 0,
+  `total_tokens` INT NOT NULL DEFAULT 0,
+  `latency_ms` INT NOT NULL DEFAULT 0,
+  `cost_usd` DECIMAL(16,8) NOT NULL DEFAULT 0,
+  `success` BOOLEAN NOT NULL DEFAULT TRUE,
+  `error` VARCHAR(512) NULL,
+  `created_at` TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_session_created (session_id, created_at),
+  INDEX idx_created (created_at)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;